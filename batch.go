@@ -0,0 +1,499 @@
+package flow
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/thinksystemio/package-flow/command"
+	"github.com/thinksystemio/package-flow/node"
+	"github.com/thinksystemio/package-flow/pipeline"
+	"github.com/thinksystemio/package-flow/tree"
+)
+
+// Transaction records how to roll back or commit the commands of a
+// running batch. Handlers receive it as an option.
+type Transaction struct {
+	Tree *tree.Tree
+
+	step      int
+	existing  map[string]struct{}
+	rollbacks []func()
+	commits   []commit
+}
+
+type commit struct {
+	step int
+	fn   func() error
+}
+
+// Undo is called before a command runs in a batch to record how to roll
+// it back with OnRollback. Rollbacks also run when the command itself
+// fails, so they must check what the command changed. Undo returns an
+// error when the command cannot be run in a batch.
+type Undo func(tx *Transaction, cmd command.Command) error
+
+var (
+	undos   = map[reflect.Type]Undo{}
+	undosMu sync.RWMutex
+)
+
+// RegisterUndo allows an action to be run in a batch. It panics if the
+// action has no decoder or already has an undo, so it is meant to be
+// called from init.
+func RegisterUndo(action string, undo Undo) {
+	if undo == nil {
+		panic(fmt.Sprintf("flow: action %s needs an undo", action))
+	}
+	commandType := commandTypeOf(action)
+
+	undosMu.Lock()
+	defer undosMu.Unlock()
+
+	if _, ok := undos[commandType]; ok {
+		panic(fmt.Sprintf("flow: command %v already has an undo", commandType))
+	}
+	undos[commandType] = undo
+}
+
+func lookupUndo(cmd command.Command) (Undo, bool) {
+	undosMu.RLock()
+	defer undosMu.RUnlock()
+
+	undo, ok := undos[reflect.TypeOf(cmd)]
+	return undo, ok
+}
+
+//
+// Transaction Base
+//
+
+func newTransaction(tree *tree.Tree) *Transaction {
+	tx := &Transaction{Tree: tree, existing: map[string]struct{}{}}
+	for _, p := range tree.ListPipelines(nil) {
+		tx.existing[p.GetID()] = struct{}{}
+	}
+	return tx
+}
+
+// transactionOf returns the transaction passed to a handler, if any.
+func transactionOf(options []interface{}) *Transaction {
+	for _, option := range options {
+		if tx, ok := option.(*Transaction); ok {
+			return tx
+		}
+	}
+	return nil
+}
+
+//
+// Transaction Utils
+//
+
+// OnRollback adds a function to run when the batch fails. Rollbacks run
+// in the reverse order they were added.
+func (tx *Transaction) OnRollback(fn func()) {
+	tx.rollbacks = append(tx.rollbacks, fn)
+}
+
+// OnCommit adds a function to run once every command of the batch has
+// succeeded. Its error is reported on the command being run.
+func (tx *Transaction) OnCommit(fn func() error) {
+	tx.commits = append(tx.commits, commit{step: tx.step, fn: fn})
+}
+
+// Created reports whether a pipeline was created by the batch.
+func (tx *Transaction) Created(p pipeline.Pipeline) bool {
+	_, ok := tx.existing[p.GetID()]
+	return !ok
+}
+
+func (tx *Transaction) rollback() {
+	for i := len(tx.rollbacks) - 1; i >= 0; i-- {
+		tx.rollbacks[i]()
+	}
+}
+
+func (tx *Transaction) commit(steps []command.Command) {
+	for _, c := range tx.commits {
+		steps[c.step].AppendError(c.fn())
+	}
+}
+
+//
+// Batch
+//
+
+func batch(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.Batch)
+	steps := make([]command.Command, len(cmd.Commands))
+	results := make([]command.BatchStep, len(cmd.Commands))
+	defer func() { cmd.Data = results }()
+
+	// Every command is decoded before any is run.
+	failed := -1
+	for i, JSON := range cmd.Commands {
+		var step command.Command = IdentifyCommand(JSON)
+		if !step.HasErrors() {
+			step = command.Dispense(step.GetAction(), JSON)
+		}
+		if _, ok := lookupUndo(step); !ok && !step.HasErrors() {
+			step.AppendError(command.Invalid("action", "action %s cannot be run in a batch", step.GetAction()))
+		}
+
+		steps[i] = step
+		results[i] = command.BatchStep{Action: step.GetAction(), Status: command.BATCH_SKIPPED}
+		if step.HasErrors() && failed < 0 {
+			failed = i
+		}
+	}
+	if failed >= 0 {
+		fail(cmd, steps, results, failed)
+		return
+	}
+
+	tx := newTransaction(tree)
+	options = append(append([]interface{}{}, options...), tx)
+	for i, step := range steps {
+		tx.step = i
+		undo, _ := lookupUndo(step)
+		if err := undo(tx, step); err != nil {
+			step.AppendError(err)
+		} else {
+			Dispatch(tree, step, options...)
+		}
+
+		if step.HasErrors() {
+			tx.rollback()
+			for j := 0; j < i; j++ {
+				results[j] = stepResult(steps[j], command.BATCH_ROLLED_BACK)
+			}
+			fail(cmd, steps, results, i)
+			return
+		}
+	}
+
+	tx.commit(steps)
+	for i, step := range steps {
+		results[i] = stepResult(step, command.BATCH_COMMITTED)
+	}
+}
+
+// fail reports the failed command on the batch with the code of its
+// first error.
+func fail(cmd *command.Batch, steps []command.Command, results []command.BatchStep, failed int) {
+	results[failed] = stepResult(steps[failed], command.BATCH_FAILED)
+
+	err := command.Errorf(command.UNKNOWN, "batch command %d (%s) failed", failed, steps[failed].GetAction())
+	if errs := steps[failed].GetErrors(); len(errs) > 0 {
+		err.Code = errs[0].Code
+	}
+	cmd.AppendError(err.WithField(fmt.Sprintf("commands[%d]", failed)))
+}
+
+func stepResult(step command.Command, status string) command.BatchStep {
+	return command.BatchStep{
+		Action: step.GetAction(),
+		Status: status,
+		Data:   step.GetData(),
+		Errors: step.GetErrors(),
+	}
+}
+
+//
+// Batch Undos
+//
+
+func init() {
+	// Tree
+	RegisterUndo(command.CREATE_NODE, undoCreateNode)
+	RegisterUndo(command.REMOVE_NODE, undoRemoveNode)
+	RegisterUndo(command.CREATE_PIPELINE, undoCreatePipeline)
+	RegisterUndo(command.ADD_CHILD, undoAddChild)
+	RegisterUndo(command.REMOVE_CHILD, undoRemoveChild)
+	RegisterUndo(command.ADD_ERROR_CHILD, undoAddErrorChild)
+	RegisterUndo(command.REMOVE_ERROR_CHILD, undoRemoveErrorChild)
+
+	// Query
+	for _, action := range []string{
+		command.GET_TREE, command.GET_NODE, command.LIST_NODES, command.LIST_PIPELINES,
+		command.GET_PIPELINE, command.GET_CHILDREN, command.GET_PARENTS, command.GET_DEAD_LETTERS,
+	} {
+		RegisterUndo(action, undoNothing)
+	}
+
+	// Pipelines
+	RegisterUndo(command.UPDATE_FILTER_PIPELINE, undoPipelineUpdate(func(c command.Command) string {
+		return c.(*command.UpdateFilterPipeline).Name
+	}))
+	RegisterUndo(command.UPDATE_PREDICATE_PIPELINE, undoPipelineUpdate(func(c command.Command) string {
+		return c.(*command.UpdatePredicatePipeline).Name
+	}))
+	RegisterUndo(command.UPDATE_MAP_PIPELINE, undoPipelineUpdate(func(c command.Command) string {
+		return c.(*command.UpdateMapPipeline).Name
+	}))
+	RegisterUndo(command.UPDATE_EXPRESSION_PIPELINE, undoPipelineUpdate(func(c command.Command) string {
+		return c.(*command.UpdateExpressionPipeline).Name
+	}))
+	RegisterUndo(command.UPDATE_WASM_PIPELINE, undoPipelineUpdate(func(c command.Command) string {
+		return c.(*command.UpdateWasmPipeline).Name
+	}))
+	RegisterUndo(command.UPDATE_REDACT_PIPELINE, undoPipelineUpdate(func(c command.Command) string {
+		return c.(*command.UpdateRedactPipeline).Name
+	}))
+	RegisterUndo(command.UPDATE_SCHEMA_PIPELINE, undoPipelineUpdate(func(c command.Command) string {
+		return c.(*command.UpdateSchemaPipeline).Name
+	}))
+	RegisterUndo(command.UPDATE_CHAIN_PIPELINE, undoPipelineUpdate(func(c command.Command) string {
+		return c.(*command.UpdateChainPipeline).Name
+	}))
+	RegisterUndo(command.INSERT_CHAIN_STAGE, undoPipelineUpdate(func(c command.Command) string {
+		return c.(*command.InsertChainStage).Name
+	}))
+	RegisterUndo(command.REMOVE_CHAIN_STAGE, undoPipelineUpdate(func(c command.Command) string {
+		return c.(*command.RemoveChainStage).Name
+	}))
+	RegisterUndo(command.MOVE_CHAIN_STAGE, undoPipelineUpdate(func(c command.Command) string {
+		return c.(*command.MoveChainStage).Name
+	}))
+
+	// Node
+	RegisterUndo(command.ACTIVATE_NODE, undoActivation(func(c command.Command) string {
+		return c.(*command.ActivateNode).Node
+	}))
+	RegisterUndo(command.DEACTIVATE_NODE, undoActivation(func(c command.Command) string {
+		return c.(*command.DeactivateNode).Node
+	}))
+}
+
+func undoNothing(tx *Transaction, cmd command.Command) error {
+	return nil
+}
+
+func undoCreateNode(tx *Transaction, cmd command.Command) error {
+	tx.OnRollback(func() {
+		id, _ := cmd.GetData().(string)
+		if n, ok := tx.Tree.Nodes[id]; ok {
+			tx.Tree.RemoveNode(n)
+			n.Delete()
+		}
+	})
+	return nil
+}
+
+func undoCreatePipeline(tx *Transaction, cmd command.Command) error {
+	tx.OnRollback(func() {
+		id, _ := cmd.GetData().(string)
+		if p, ok := tx.Tree.Pipelines[id]; ok {
+			tx.Tree.RemovePipeline(p)
+		}
+	})
+	return nil
+}
+
+// undoRemoveNode restores the node with its edges, the pipelines that
+// route errors to it and the pipelines removed with it. The node is
+// only stopped and the pipelines closed on commit.
+func undoRemoveNode(tx *Transaction, cmd command.Command) error {
+	n, err := tx.Tree.GetNodeByNameOrID(cmd.(*command.RemoveNode).Node)
+	if err != nil {
+		return nil
+	}
+
+	edges := append(tx.Tree.GetParentEdges(n), tx.Tree.GetChildEdges(n)...)
+	pipelines := tx.Tree.ListPipelines(nil)
+	routers := []pipeline.Pipeline{}
+	for _, p := range pipelines {
+		if router, ok := p.(pipeline.ErrorRouter); ok && router.GetErrorChild() == n.GetID() {
+			routers = append(routers, p)
+		}
+	}
+
+	tx.OnRollback(func() {
+		if _, ok := tx.Tree.Nodes[n.GetID()]; ok {
+			return
+		}
+		tx.Tree.AddNode(n)
+		for _, p := range pipelines {
+			if _, ok := tx.Tree.Pipelines[p.GetID()]; ok {
+				continue
+			}
+			tx.Tree.AddPipeline(p)
+			if router, ok := p.(pipeline.ErrorRouter); ok && router.GetErrorChild() != n.GetID() {
+				if child, ok := tx.Tree.Nodes[router.GetErrorChild()]; ok {
+					tx.Tree.SetErrorRoute(p, child)
+				}
+			}
+		}
+		for _, edge := range edges {
+			if edge.Error && edge.Pipeline != nil {
+				// an error route, restored with its router below
+				continue
+			}
+			if edge.Error {
+				tx.Tree.AddErrorEdge(edge.Parent, edge.Child)
+			} else {
+				tx.Tree.AddEdge(edge.Parent, edge.Child, edge.Pipeline)
+			}
+		}
+		for _, router := range routers {
+			tx.Tree.SetErrorRoute(router, n)
+		}
+	})
+	return nil
+}
+
+func undoAddChild(tx *Transaction, cmd command.Command) error {
+	add := cmd.(*command.AddChild)
+	parent, child, err := lookupEdge(tx.Tree, add.Parent, add.Child)
+	if err != nil {
+		return nil
+	}
+
+	previous, hadEdge := parent.GetChildren()[child]
+	_, err = tx.Tree.GetPipelineByNameOrID(add.Pipeline)
+	hadPipeline := err == nil
+
+	tx.OnRollback(func() {
+		if hadEdge {
+			tx.Tree.AddEdge(parent, child, previous)
+		} else if parent.HasChild(child) {
+			tx.Tree.RemoveEdge(parent, child)
+		}
+
+		if id, ok := cmd.GetData().(string); ok && !hadPipeline {
+			if p, ok := tx.Tree.Pipelines[id]; ok {
+				tx.Tree.RemovePipeline(p)
+			}
+		}
+	})
+	return nil
+}
+
+func undoRemoveChild(tx *Transaction, cmd command.Command) error {
+	remove := cmd.(*command.RemoveChild)
+	parent, child, err := lookupEdge(tx.Tree, remove.Parent, remove.Child)
+	if err != nil {
+		return nil
+	}
+
+	previous, hadEdge := parent.GetChildren()[child]
+	tx.OnRollback(func() {
+		if hadEdge && !parent.HasChild(child) {
+			tx.Tree.AddEdge(parent, child, previous)
+		}
+	})
+	return nil
+}
+
+func undoAddErrorChild(tx *Transaction, cmd command.Command) error {
+	add := cmd.(*command.AddErrorChild)
+	parent, child, err := lookupEdge(tx.Tree, add.Parent, add.Child)
+	if err != nil {
+		return nil
+	}
+
+	hadEdge := parent.HasErrorChild(child)
+	tx.OnRollback(func() {
+		if !hadEdge && parent.HasErrorChild(child) {
+			tx.Tree.RemoveErrorEdge(parent, child)
+		}
+	})
+	return nil
+}
+
+func undoRemoveErrorChild(tx *Transaction, cmd command.Command) error {
+	remove := cmd.(*command.RemoveErrorChild)
+	parent, child, err := lookupEdge(tx.Tree, remove.Parent, remove.Child)
+	if err != nil {
+		return nil
+	}
+
+	hadEdge := parent.HasErrorChild(child)
+	tx.OnRollback(func() {
+		if hadEdge && !parent.HasErrorChild(child) {
+			tx.Tree.AddErrorEdge(parent, child)
+		}
+	})
+	return nil
+}
+
+// undoPipelineUpdate snapshots a pipeline the batch did not create and
+// puts the snapshot back in its place on rollback. Pipelines created by
+// the batch are discarded with their creation.
+func undoPipelineUpdate(name func(command.Command) string) Undo {
+	return func(tx *Transaction, cmd command.Command) error {
+		p, err := tx.Tree.GetPipelineByNameOrID(name(cmd))
+		if err != nil || tx.Created(p) {
+			return nil
+		}
+
+		snapshot, err := p.ToJSON()
+		if err != nil {
+			return command.Errorf(command.UNKNOWN, "%v", err).WithPipeline(p.GetID())
+		}
+		tx.OnRollback(func() {
+			restorePipeline(tx.Tree, snapshot)
+		})
+		return nil
+	}
+}
+
+// restorePipeline rebuilds a pipeline from its snapshot and replaces
+// the one the tree holds, along with its error route.
+func restorePipeline(tree *tree.Tree, snapshot []byte) error {
+	p, err := pipeline.FromJSON(snapshot)
+	if err != nil {
+		return err
+	}
+	if resolver, ok := p.(pipeline.Resolver); ok {
+		if err := resolver.Resolve(tree.GetPipelineByNameOrID); err != nil {
+			pipeline.Close(p)
+			return err
+		}
+	}
+	if err := tree.ReplacePipeline(p); err != nil {
+		pipeline.Close(p)
+		return err
+	}
+
+	if router, ok := p.(pipeline.ErrorRouter); ok {
+		var child node.Node
+		if n, ok := tree.Nodes[router.GetErrorChild()]; ok {
+			child = n
+		}
+		return tree.SetErrorRoute(p, child)
+	}
+	return nil
+}
+
+func undoActivation(name func(command.Command) string) Undo {
+	return func(tx *Transaction, cmd command.Command) error {
+		n, err := tx.Tree.GetNodeByNameOrID(name(cmd))
+		if err != nil {
+			return nil
+		}
+
+		active := n.GetActive()
+		tx.OnRollback(func() {
+			if active && !n.GetActive() {
+				n.Activate(&command.BaseCommand{})
+			} else if !active && n.GetActive() {
+				n.Deactivate(&command.BaseCommand{})
+			}
+		})
+		return nil
+	}
+}
+
+func lookupEdge(tree *tree.Tree, parentName string, childName string) (node.Node, node.Node, error) {
+	parent, err := tree.GetNodeByNameOrID(parentName)
+	if err != nil {
+		return nil, nil, err
+	}
+	child, err := tree.GetNodeByNameOrID(childName)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parent, child, nil
+}
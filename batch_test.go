@@ -0,0 +1,193 @@
+package flow
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/thinksystemio/package-flow/command"
+	"github.com/thinksystemio/package-flow/pipeline"
+	"github.com/thinksystemio/package-flow/tree"
+)
+
+func Batch(commands ...[]byte) []byte {
+	raw := []json.RawMessage{}
+	for _, JSON := range commands {
+		raw = append(raw, JSON)
+	}
+	JSON, _ := json.Marshal(map[string]interface{}{"action": command.BATCH, "commands": raw})
+	return JSON
+}
+
+// waitStep is a batch step that blocks until the test releases it.
+type waitStep struct {
+	command.BaseCommand
+}
+
+var (
+	waitStarted = make(chan struct{})
+	waitRelease = make(chan struct{})
+)
+
+func init() {
+	RegisterAction("test_wait",
+		command.Decoding(func() command.Command { return &waitStep{} }),
+		func(tree *tree.Tree, c command.Command, options ...interface{}) {
+			waitStarted <- struct{}{}
+			<-waitRelease
+		})
+	RegisterUndo("test_wait", undoNothing)
+}
+
+func statuses(cmd command.Command) []string {
+	result := []string{}
+	for _, step := range cmd.GetData().([]command.BatchStep) {
+		result = append(result, step.Status)
+	}
+	return result
+}
+
+func TestBatch(t *testing.T) {
+	tree := tree.NewTree()
+
+	for _, JSON := range [][]byte{
+		CreateNode("source", "base"),
+		CreateNode("old", "base"),
+		CreatePipeline("shared", "base"),
+		AddChild("source", "old", "shared"),
+	} {
+		if cmd := DispatchFromJSON(tree, JSON); cmd.HasErrors() {
+			t.Fatalf("%s returned errors: %v", JSON, cmd.GetErrors())
+		}
+	}
+	source, _ := tree.GetNodeByNameOrID("source")
+	old, _ := tree.GetNodeByNameOrID("old")
+
+	cmd := DispatchFromJSON(tree, Batch(
+		CreateNode("sink", "base"),
+		CreatePipeline("pipe", "filter"),
+		UpdateFilterPipeline("pipe", map[string]struct{}{"a": {}}),
+		AddChild("source", "sink", "pipe"),
+		RemoveNode("old"),
+		AddChild("sink", "missing", "pipe"),
+		CreateNode("never", "base"),
+	))
+	if !cmd.HasErrors() {
+		t.Fatal("expected the batch to fail")
+	}
+	want := []string{"rolled_back", "rolled_back", "rolled_back", "rolled_back", "rolled_back", "failed", "skipped"}
+	if got := statuses(cmd); !reflect.DeepEqual(got, want) {
+		t.Errorf("statuses = %v, want %v", got, want)
+	}
+
+	for _, name := range []string{"sink", "never"} {
+		if n, _ := tree.GetNodeByNameOrID(name); n != nil {
+			t.Errorf("node %s was not rolled back", name)
+		}
+	}
+	if p, _ := tree.GetPipelineByNameOrID("pipe"); p != nil {
+		t.Error("pipeline pipe was not rolled back")
+	}
+	if n, _ := tree.GetNodeByNameOrID("old"); n != old || !source.HasChild(old) || len(tree.GetParents(old)) != 1 {
+		t.Error("node old was not restored with its edges")
+	}
+	if p, _ := tree.GetPipelineByNameOrID("shared"); p == nil || source.GetChildren()[old] != p {
+		t.Error("pipeline shared was not restored with node old")
+	}
+
+	cmd = DispatchFromJSON(tree, Batch(
+		CreateNode("sink", "base"),
+		AddChild("source", "sink", "shared"),
+		RemoveNode("old"),
+	))
+	if cmd.HasErrors() {
+		t.Fatalf("batch returned errors: %v", cmd.GetErrors())
+	}
+	if got := statuses(cmd); !reflect.DeepEqual(got, []string{"committed", "committed", "committed"}) {
+		t.Errorf("statuses = %v", got)
+	}
+	sink, _ := tree.GetNodeByNameOrID("sink")
+	if sink == nil || !source.HasChild(sink) || source.HasChild(old) {
+		t.Error("batch was not applied")
+	}
+
+	for _, JSON := range [][]byte{
+		CreateNode("filtered", "base"),
+		CreatePipeline("kept", "filter"),
+		UpdateFilterPipeline("kept", map[string]struct{}{"a": {}}),
+		CreatePipeline("outer", "chain"),
+		ChainStage(command.INSERT_CHAIN_STAGE, "outer", "kept", 0),
+		AddChild("source", "filtered", "kept"),
+	} {
+		if cmd := DispatchFromJSON(tree, JSON); cmd.HasErrors() {
+			t.Fatalf("%s returned errors: %v", JSON, cmd.GetErrors())
+		}
+	}
+	filtered, _ := tree.GetNodeByNameOrID("filtered")
+
+	cmd = DispatchFromJSON(tree, Batch(
+		UpdateFilterPipeline("kept", map[string]struct{}{"b": {}}),
+		ChainStage(command.REMOVE_CHAIN_STAGE, "outer", "kept", 0),
+		AddChild("sink", "missing", "kept"),
+	))
+	if got := statuses(cmd); !reflect.DeepEqual(got, []string{"rolled_back", "rolled_back", "failed"}) {
+		t.Errorf("statuses = %v", got)
+	}
+	kept, _ := tree.GetPipelineByNameOrID("kept")
+	outer, _ := tree.GetPipelineByNameOrID("outer")
+	if source.GetChildren()[filtered] != kept {
+		t.Error("edge does not use the restored pipeline kept")
+	}
+	if stages := outer.(*pipeline.ChainPipeline).GetStages(); len(stages) != 1 || stages[0] != kept {
+		t.Errorf("chain outer was not restored, stages %v", stages)
+	}
+	update := &command.BaseCommand{Data: map[string]interface{}{"a": 1, "b": 2}}
+	kept.Apply(update)
+	if data := update.GetData().(map[string]interface{}); len(data) != 1 || data["a"] != 1 {
+		t.Errorf("filter of kept was not restored, got %v", data)
+	}
+
+	for _, JSON := range [][]byte{
+		Batch(UpdateFilterPipeline("shared", map[string]struct{}{"a": {}})),
+		Batch(QueryAllMongo("sink")),
+		Batch([]byte(`{"action":"create_node"}`)),
+	} {
+		if cmd := DispatchFromJSON(tree, JSON); !cmd.HasErrors() {
+			t.Errorf("%s: expected an error", JSON)
+		}
+	}
+}
+
+func TestBatchIsolation(t *testing.T) {
+	tree := tree.NewTree()
+
+	done := make(chan command.Command)
+	go func() {
+		done <- DispatchFromJSON(tree, Batch(
+			CreateNode("isolated", "base"),
+			[]byte(`{"action":"test_wait"}`),
+			AddChild("isolated", "missing", "pipe"),
+		))
+	}()
+	<-waitStarted
+
+	// the query waits for the batch instead of seeing its node
+	query := make(chan command.Command)
+	go func() {
+		query <- DispatchFromJSON(tree, []byte(`{"action":"get_node","node":"isolated"}`))
+	}()
+	select {
+	case cmd := <-query:
+		t.Fatalf("get_node ran during the batch and returned %v", cmd.GetData())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(waitRelease)
+	if cmd := <-done; !cmd.HasErrors() {
+		t.Error("expected the batch to fail")
+	}
+	if errs := (<-query).GetErrors(); len(errs) != 1 || errs[0].Code != command.NOT_FOUND {
+		t.Errorf("expected the rolled back node to be missing, got %v", errs)
+	}
+}
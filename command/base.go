@@ -1,11 +1,10 @@
 package command
 
-import "errors"
-
 type BaseCommand struct {
-	Action string      `json:"action"`
-	Data   interface{} `json:"data"`
-	Errors []Error     `json:"errors"`
+	Action   string      `json:"action" validate:"required"`
+	Data     interface{} `json:"data"`
+	Errors   []Error     `json:"errors"`
+	Metadata *Metadata   `json:"metadata,omitempty"`
 }
 
 func (cmd *BaseCommand) GetAction() string {
@@ -23,13 +22,28 @@ func (cmd *BaseCommand) SetData(data interface{}) {
 	cmd.Data = data
 }
 
+// GetMetadata returns the command's metadata, creating it the first
+// time it is needed.
+func (cmd *BaseCommand) GetMetadata() *Metadata {
+	if cmd.Metadata == nil {
+		cmd.Metadata = NewMetadata("")
+	}
+	return cmd.Metadata
+}
+
+func (cmd *BaseCommand) SetMetadata(metadata *Metadata) {
+	cmd.Metadata = metadata
+}
+
 func (cmd *BaseCommand) GetErrors() []Error {
 	return cmd.Errors
 }
 
+// AppendError adds an error to the command. Errors that are not an
+// Error get the UNKNOWN code.
 func (cmd *BaseCommand) AppendError(err error) {
-	if err != nil {
-		cmd.Errors = append(cmd.Errors, Error{Message: err.Error()})
+	if e := AsError(err); e != nil {
+		cmd.Errors = append(cmd.Errors, *e)
 	}
 }
 
@@ -37,13 +51,9 @@ func (cmd *BaseCommand) HasErrors() bool {
 	return len(cmd.Errors) != 0
 }
 
+// Valid checks what the validate tags of a command cannot express.
+// Decode calls it after Validate; commands with rules that span
+// several fields override it.
 func (cmd *BaseCommand) Valid() error {
-	if cmd.Action == "" {
-		return errors.New("command is not valid")
-	}
 	return nil
 }
-
-type Error struct {
-	Message string `json:"errors"`
-}
@@ -0,0 +1,29 @@
+package command
+
+import "encoding/json"
+
+const (
+	BATCH_COMMITTED   = "committed"
+	BATCH_FAILED      = "failed"
+	BATCH_ROLLED_BACK = "rolled_back"
+	BATCH_SKIPPED     = "skipped"
+)
+
+// Batch runs its commands in order as one unit. Each command is the
+// JSON of a command with its own action, and may refer to nodes and
+// pipelines created by the commands before it. When a command fails,
+// the commands before it are rolled back and the rest are skipped.
+// Other commands wait for the batch to finish, so they never see its
+// partial state.
+type Batch struct {
+	BaseCommand
+	Commands []json.RawMessage `json:"commands" validate:"nonempty"`
+}
+
+// BatchStep is the outcome of one command of a batch.
+type BatchStep struct {
+	Action string      `json:"action"`
+	Status string      `json:"status"`
+	Data   interface{} `json:"data,omitempty"`
+	Errors []Error     `json:"errors,omitempty"`
+}
@@ -0,0 +1,29 @@
+package command
+
+type UpdateChainPipeline struct {
+	BaseCommand
+	Name   string   `json:"name" validate:"required"`
+	Stages []string `json:"stages" validate:"required"`
+}
+
+// InsertChainStage inserts a stage at Index. Without an index the stage
+// is appended.
+type InsertChainStage struct {
+	BaseCommand
+	Name  string `json:"name" validate:"required"`
+	Stage string `json:"stage" validate:"required"`
+	Index *int   `json:"index"`
+}
+
+type RemoveChainStage struct {
+	BaseCommand
+	Name  string `json:"name" validate:"required"`
+	Stage string `json:"stage" validate:"required"`
+}
+
+type MoveChainStage struct {
+	BaseCommand
+	Name  string `json:"name" validate:"required"`
+	Stage string `json:"stage" validate:"required"`
+	Index *int   `json:"index" validate:"required"`
+}
@@ -4,19 +4,30 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
-	"strings"
 )
 
 const (
 	CREATE_NODE     = "create_node"
 	ADD_CHILD       = "add_child"
+	REMOVE_NODE     = "remove_node"
+	REMOVE_CHILD    = "remove_child"
 	ACTIVATE_NODE   = "activate_node"
 	DEACTIVATE_NODE = "deactivate_node"
+	UPDATE_MAILBOX  = "update_mailbox"
 
-	ADD_SUBSCRIBER = "add_subscriber"
-	UPDATE_URL     = "update_url"
-	ACTIVATE_WS    = "activate_ws"
-	DECTIVATE_WS   = "deactivate_ws"
+	ADD_ERROR_CHILD    = "add_error_child"
+	REMOVE_ERROR_CHILD = "remove_error_child"
+
+	REPLAY_DEAD_LETTERS = "replay_dead_letters"
+	GET_DEAD_LETTERS    = "get_dead_letters"
+
+	BATCH = "batch"
+
+	ADD_SUBSCRIBER   = "add_subscriber"
+	UPDATE_PUBLISHER = "update_publisher"
+	UPDATE_URL       = "update_url"
+	ACTIVATE_WS      = "activate_ws"
+	DECTIVATE_WS     = "deactivate_ws"
 
 	CONNECT_MONGO      = "connect_mongo"
 	ADD_MONGO          = "add_mongo"
@@ -26,91 +37,70 @@ const (
 	REMOVE_BY_ID_MONGO = "remove_by_id_mongo"
 	QUERY_ALL_MONGO    = "query_all_mongo"
 
+	GET_TREE       = "get_tree"
+	GET_NODE       = "get_node"
+	LIST_NODES     = "list_nodes"
+	LIST_PIPELINES = "list_pipelines"
+	GET_PIPELINE   = "get_pipeline"
+	GET_CHILDREN   = "get_children"
+	GET_PARENTS    = "get_parents"
+
 	CREATE_PIPELINE        = "create_pipeline"
 	UPDATE_FILTER_PIPELINE = "update_filter_pipeline"
+
+	UPDATE_CHAIN_PIPELINE = "update_chain_pipeline"
+	INSERT_CHAIN_STAGE    = "insert_chain_stage"
+	REMOVE_CHAIN_STAGE    = "remove_chain_stage"
+	MOVE_CHAIN_STAGE      = "move_chain_stage"
+
+	UPDATE_PREDICATE_PIPELINE = "update_predicate_pipeline"
+	UPDATE_MAP_PIPELINE       = "update_map_pipeline"
+
+	UPDATE_EXPRESSION_PIPELINE = "update_expression_pipeline"
+	UPDATE_WASM_PIPELINE       = "update_wasm_pipeline"
+	UPDATE_REDACT_PIPELINE     = "update_redact_pipeline"
+	UPDATE_SCHEMA_PIPELINE     = "update_schema_pipeline"
 )
 
 type Command interface {
 	GetData() interface{}
 	SetData(interface{})
 	GetAction() string
+	GetMetadata() *Metadata
+	SetMetadata(*Metadata)
 	GetErrors() []Error
 	AppendError(error)
 	HasErrors() bool
 	Valid() error
 }
 
+// Dispense decodes the JSON of a command with the decoder registered
+// for its action. Metadata is only ever set by the tree, so any sent
+// by the client is dropped; otherwise it could raise its own hop limit
+// or claim another trace.
 func Dispense(action string, data []byte, options ...interface{}) Command {
-	formatted := strings.ToLower(action)
-	switch formatted {
-
-	// Tree
-	case CREATE_NODE:
-		return Decode(&CreateNode{}, data)
-	case ADD_CHILD:
-		return Decode(&AddChild{}, data)
-	case CREATE_PIPELINE:
-		return Decode(&CreatePipeline{}, data)
-
-	// Filter Pipeline
-	case UPDATE_FILTER_PIPELINE:
-		return Decode(&UpdateFilterPipeline{}, data)
-
-	// Node
-	case ACTIVATE_NODE:
-		return Decode(&ActivateNode{}, data)
-	case DEACTIVATE_NODE:
-		return Decode(&DeactivateNode{}, data)
-
-	// Publisher Node
-	case ADD_SUBSCRIBER:
-		return DecodeWithOptions(&AddSubscriber{}, data, options...)
-
-	// Subscriber Node
-	case UPDATE_URL:
-		return Decode(&UpdateURL{}, data)
-	case ACTIVATE_WS:
-		return Decode(&ActivateWS{}, data)
-	case DECTIVATE_WS:
-		return Decode(&DeactivateWS{}, data)
-
-	// MongoDB Node
-	case CONNECT_MONGO:
-		return Decode(&ConnectMongo{}, data)
-	case ADD_MONGO:
-		return Decode(&AddMongo{}, data)
-	case UPDATE_MONGO:
-		return Decode(&UpdateMongo{}, data)
-	case UPDATE_BY_ID_MONGO:
-		return Decode(&UpdateByIDMongo{}, data)
-	case REMOVE_MONGO:
-		return Decode(&RemoveMongo{}, data)
-	case REMOVE_BY_ID_MONGO:
-		return Decode(&RemoveByIDMongo{}, data)
-	case QUERY_ALL_MONGO:
-		return Decode(&QueryAllMongo{}, data)
-
-	default:
+	decoder, ok := LookupDecoder(action)
+	if !ok {
 		command := &BaseCommand{}
-		command.AppendError(errors.New("invalid action"))
+		command.AppendError(Invalid("action", "invalid action"))
 		return command
 	}
+
+	cmd := decoder(data, options...)
+	cmd.SetMetadata(nil)
+	return cmd
 }
 
 func Decode(cmd Command, data []byte) Command {
-	err := json.Unmarshal(data, cmd)
-	cmd.AppendError(err)
+	cmd.AppendError(decodeError(json.Unmarshal(data, cmd)))
 
-	if err := cmd.Valid(); err != nil {
-		cmd.AppendError(err)
-	}
+	cmd.AppendError(validate(cmd))
 
 	return cmd
 }
 
 func DecodeWithOptions(cmd Command, data []byte, options ...interface{}) Command {
-	err := json.Unmarshal(data, cmd)
-	cmd.AppendError(err)
+	cmd.AppendError(decodeError(json.Unmarshal(data, cmd)))
 
 	if cmd, ok := cmd.(*AddSubscriber); ok {
 		for _, arg := range options {
@@ -124,9 +114,31 @@ func DecodeWithOptions(cmd Command, data []byte, options ...interface{}) Command
 		}
 	}
 
-	if err := cmd.Valid(); err != nil {
-		cmd.AppendError(err)
-	}
+	cmd.AppendError(validate(cmd))
 
 	return cmd
 }
+
+// validate runs the tag checks of a command and then its Valid method,
+// which may rely on the tagged fields being set.
+func validate(cmd Command) error {
+	if err := Validate(cmd); err != nil {
+		return err
+	}
+	return cmd.Valid()
+}
+
+// decodeError reports malformed JSON as an invalid argument, naming the
+// field when its value has the wrong type.
+func decodeError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	e := Errorf(INVALID_ARGUMENT, "%v", err)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		e.Field = typeErr.Field
+	}
+	return e
+}
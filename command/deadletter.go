@@ -0,0 +1,20 @@
+package command
+
+// ReplayDeadLetters sends the letters retained by a dead letter node
+// again from the nodes they failed in. Limit replays only the oldest
+// letters; zero replays every letter.
+type ReplayDeadLetters struct {
+	BaseCommand
+	Node  string `json:"node" validate:"required"`
+	Limit int    `json:"limit" validate:"min=0"`
+}
+
+// GetDeadLetters returns a page of the letters retained by a dead
+// letter node, oldest first, starting at Offset. Limit caps the page;
+// zero returns a page of the default size.
+type GetDeadLetters struct {
+	BaseCommand
+	Node   string `json:"node" validate:"required"`
+	Offset int    `json:"offset" validate:"min=0"`
+	Limit  int    `json:"limit" validate:"min=0"`
+}
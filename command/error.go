@@ -0,0 +1,118 @@
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Error codes tell clients why a command failed without matching on
+// messages.
+const (
+	UNKNOWN             = "UNKNOWN"
+	INVALID_ARGUMENT    = "INVALID_ARGUMENT"
+	NOT_FOUND           = "NOT_FOUND"
+	ALREADY_EXISTS      = "ALREADY_EXISTS"
+	TYPE_MISMATCH       = "TYPE_MISMATCH"
+	FAILED_PRECONDITION = "FAILED_PRECONDITION"
+	UPSTREAM_FAILURE    = "UPSTREAM_FAILURE"
+)
+
+// Error is an error reported on a command. Field is the JSON name of
+// the input that was wrong, and Node and Pipeline are the IDs of the
+// node or pipeline involved, when known.
+type Error struct {
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	Field    string `json:"field,omitempty"`
+	Node     string `json:"node,omitempty"`
+	Pipeline string `json:"pipeline,omitempty"`
+}
+
+// Errorf returns an error with a code and a formatted message.
+func Errorf(code string, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Required reports that a field is missing.
+func Required(field string) *Error {
+	return &Error{Code: INVALID_ARGUMENT, Message: field + " is required", Field: field}
+}
+
+// Invalid reports that a field has a value that is not allowed.
+func Invalid(field string, format string, args ...interface{}) *Error {
+	return Errorf(INVALID_ARGUMENT, format, args...).WithField(field)
+}
+
+// AsError returns err as an Error. Errors that are not already one get
+// the UNKNOWN code.
+func AsError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		if e == nil {
+			return nil
+		}
+		copied := *e
+		return &copied
+	}
+	return &Error{Code: UNKNOWN, Message: err.Error()}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// WithCode returns a copy of the error with another code.
+func (e *Error) WithCode(code string) *Error {
+	copied := *e
+	copied.Code = code
+	return &copied
+}
+
+// WithField returns a copy of the error naming the field involved.
+func (e *Error) WithField(field string) *Error {
+	copied := *e
+	copied.Field = field
+	return &copied
+}
+
+// WithNode returns a copy of the error naming the node involved.
+func (e *Error) WithNode(id string) *Error {
+	copied := *e
+	copied.Node = id
+	return &copied
+}
+
+// WithPipeline returns a copy of the error naming the pipeline
+// involved.
+func (e *Error) WithPipeline(id string) *Error {
+	copied := *e
+	copied.Pipeline = id
+	return &copied
+}
+
+// UnmarshalJSON also reads errors serialized before codes were added,
+// whose message was under the errors key.
+func (e *Error) UnmarshalJSON(data []byte) error {
+	type plain Error
+	decoded := struct {
+		plain
+		Legacy string `json:"errors"`
+	}{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	*e = Error(decoded.plain)
+	if e.Message == "" {
+		e.Message = decoded.Legacy
+	}
+	if e.Code == "" {
+		e.Code = UNKNOWN
+	}
+	return nil
+}
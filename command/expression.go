@@ -0,0 +1,10 @@
+package command
+
+// UpdateExpressionPipeline replaces the expressions of an expression
+// pipeline. Each expression has the form "target = expression", for
+// example "total = price * qty".
+type UpdateExpressionPipeline struct {
+	BaseCommand
+	Name        string   `json:"name" validate:"required"`
+	Expressions []string `json:"expressions" validate:"required"`
+}
@@ -1,16 +1,45 @@
 package command
 
-import "errors"
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+)
 
-type UpdateFilterPipeline struct {
-	BaseCommand
-	Name   string              `json:"name"`
-	Filter map[string]struct{} `json:"filter"`
-}
+const (
+	FILTER_INCLUDE = "include"
+	FILTER_EXCLUDE = "exclude"
+)
+
+// Paths is a list of field paths such as "user.address.city" or
+// "items[].sku". It decodes from a JSON array or, for compatibility
+// with the original filter format, from an object whose keys are the
+// paths.
+type Paths []string
+
+func (paths *Paths) UnmarshalJSON(data []byte) error {
+	list := []string{}
+	if err := json.Unmarshal(data, &list); err == nil {
+		*paths = list
+		return nil
+	}
 
-func (cmd *UpdateFilterPipeline) Valid() error {
-	if cmd.Action == "" || cmd.Name == "" || cmd.Filter == nil {
-		return errors.New("command is not valid")
+	set := map[string]struct{}{}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return errors.New("paths must be a list or a set of strings")
 	}
+
+	*paths = Paths{}
+	for path := range set {
+		*paths = append(*paths, path)
+	}
+	sort.Strings(*paths)
 	return nil
 }
+
+type UpdateFilterPipeline struct {
+	BaseCommand
+	Name   string `json:"name" validate:"required"`
+	Filter Paths  `json:"filter" validate:"required"`
+	Mode   string `json:"mode" validate:"oneof=include exclude"`
+}
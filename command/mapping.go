@@ -0,0 +1,26 @@
+package command
+
+const (
+	MAP_RENAME = "rename"
+	MAP_MOVE   = "move"
+	MAP_COPY   = "copy"
+	MAP_SET    = "set"
+	MAP_DELETE = "delete"
+)
+
+// MapRule reshapes command data. rename and move take the value at
+// From and put it at To, copy leaves From in place, set puts Value at
+// To and delete removes From. Paths are dot separated and may cross
+// nesting levels.
+type MapRule struct {
+	Op    string      `json:"op"`
+	From  string      `json:"from,omitempty"`
+	To    string      `json:"to,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+type UpdateMapPipeline struct {
+	BaseCommand
+	Name  string    `json:"name" validate:"required"`
+	Rules []MapRule `json:"rules" validate:"required"`
+}
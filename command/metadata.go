@@ -0,0 +1,81 @@
+package command
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DefaultMaxHops limits how many edges a message can cross when it
+// does not set its own limit, which stops messages from circling a
+// feedback loop forever.
+const DefaultMaxHops = 64
+
+// Metadata travels with a command through the tree. Origin is the ID of
+// the first node that sent the command and Visited lists every node
+// that has sent it, in order. Hops counts the edges it has crossed and
+// MaxHops limits them. Commands started by another command share its
+// TraceID.
+type Metadata struct {
+	MessageID string    `json:"message_id"`
+	Created   time.Time `json:"created"`
+	Origin    string    `json:"origin,omitempty"`
+	Visited   []string  `json:"visited,omitempty"`
+	TraceID   string    `json:"trace_id"`
+	Hops      int       `json:"hops"`
+	MaxHops   int       `json:"max_hops,omitempty"`
+}
+
+// NewMetadata creates the metadata of a new message. An empty traceID
+// starts a new trace.
+func NewMetadata(traceID string) *Metadata {
+	metadata := &Metadata{
+		MessageID: primitive.NewObjectID().Hex(),
+		Created:   time.Now().UTC(),
+		TraceID:   traceID,
+	}
+	if metadata.TraceID == "" {
+		metadata.TraceID = metadata.MessageID
+	}
+	return metadata
+}
+
+// DeriveMetadata creates the metadata of a new message triggered by
+// cmd, such as a websocket message received by an activated
+// subscriber.
+func DeriveMetadata(cmd Command) *Metadata {
+	metadata := NewMetadata(cmd.GetMetadata().TraceID)
+	metadata.MaxHops = cmd.GetMetadata().MaxHops
+	return metadata
+}
+
+// Copy returns a copy that does not share Visited.
+func (metadata *Metadata) Copy() *Metadata {
+	copied := *metadata
+	copied.Visited = append([]string{}, metadata.Visited...)
+	return &copied
+}
+
+// Hop records that the message crossed an edge. It fails once the
+// message has crossed more edges than it is allowed to.
+func (metadata *Metadata) Hop() error {
+	metadata.Hops++
+
+	limit := metadata.MaxHops
+	if limit <= 0 {
+		limit = DefaultMaxHops
+	}
+	if metadata.Hops > limit {
+		return fmt.Errorf("message %s exceeded %d hops", metadata.MessageID, limit)
+	}
+	return nil
+}
+
+// Visit records that a node is sending the message.
+func (metadata *Metadata) Visit(nodeID string) {
+	if metadata.Origin == "" {
+		metadata.Origin = nodeID
+	}
+	metadata.Visited = append(metadata.Visited, nodeID)
+}
@@ -1,54 +1,83 @@
 package command
 
-import "errors"
-
 type CreateNode struct {
 	BaseCommand
-	Name string `json:"name"`
-	Type string `json:"type"`
-}
-
-func (cmd *CreateNode) Valid() error {
-	if cmd.Action == "" || cmd.Name == "" || cmd.Type == "" {
-		return errors.New("command is not valid")
-	}
-	return nil
+	Name string `json:"name" validate:"required"`
+	Type string `json:"type" validate:"required,node_type"`
 }
 
 type ActivateNode struct {
 	BaseCommand
-	Node string `json:"node"`
+	Node string `json:"node" validate:"required"`
 }
 
-func (cmd *ActivateNode) Valid() error {
-	if cmd.Action == "" || cmd.Node == "" {
-		return errors.New("command is not valid")
-	}
-	return nil
+type DeactivateNode struct {
+	BaseCommand
+	Node string `json:"node" validate:"required"`
 }
 
-type DeactivateNode struct {
+// UpdateMailbox changes the capacity and overflow policy of a node's
+// mailbox. A zero capacity or empty policy keeps the current value.
+type UpdateMailbox struct {
 	BaseCommand
-	Node string `json:"node"`
+	Node     string `json:"node" validate:"required"`
+	Capacity int    `json:"capacity" validate:"min=0"`
+	Policy   string `json:"policy" validate:"oneof=block drop_oldest drop_newest"`
 }
 
-func (cmd *DeactivateNode) Valid() error {
-	if cmd.Action == "" || cmd.Node == "" {
-		return errors.New("command is not valid")
+func (cmd *UpdateMailbox) Valid() error {
+	if cmd.Capacity == 0 && cmd.Policy == "" {
+		return Errorf(INVALID_ARGUMENT, "capacity or policy is required")
 	}
 	return nil
 }
 
+// AddChild attaches a child to a parent through a pipeline registered
+// with create_pipeline. When Create is set and the pipeline does not
+// exist, a pipeline of PipelineType (base by default) is created. An
+// edge that closes a cycle is rejected unless AllowCycle is set, in
+// which case messages circle until they exceed their hop limit. The
+// nodes of such a cycle must use a drop mailbox policy, as blocking
+// mailboxes could wait on each other for good.
 type AddChild struct {
 	BaseCommand
-	Parent   string `json:"parent"`
-	Child    string `json:"child"`
-	Pipeline string `json:"pipeline"`
+	Parent       string `json:"parent" validate:"required"`
+	Child        string `json:"child" validate:"required"`
+	Pipeline     string `json:"pipeline" validate:"required"`
+	Create       bool   `json:"create"`
+	PipelineType string `json:"pipeline_type" validate:"pipeline_type"`
+	AllowCycle   bool   `json:"allow_cycle"`
 }
 
-func (cmd *AddChild) Valid() error {
-	if cmd.Action == "" || cmd.Parent == "" || cmd.Child == "" || cmd.Pipeline == "" {
-		return errors.New("command is not valid")
-	}
-	return nil
+// RemoveNode removes a node with every edge to or from it and stops
+// its background work. Pipelines that were only used by those edges
+// are removed too, unless KeepPipelines is set.
+type RemoveNode struct {
+	BaseCommand
+	Node          string `json:"node" validate:"required"`
+	KeepPipelines bool   `json:"keep_pipelines"`
+}
+
+type RemoveChild struct {
+	BaseCommand
+	Parent string `json:"parent" validate:"required"`
+	Child  string `json:"child" validate:"required"`
+}
+
+// AddErrorChild attaches an error child to a parent. Commands that
+// fail in the parent are sent to its error children instead of being
+// dropped.
+// Like AddChild, a cycle is only allowed with AllowCycle and through
+// nodes with a drop mailbox policy.
+type AddErrorChild struct {
+	BaseCommand
+	Parent     string `json:"parent" validate:"required"`
+	Child      string `json:"child" validate:"required"`
+	AllowCycle bool   `json:"allow_cycle"`
+}
+
+type RemoveErrorChild struct {
+	BaseCommand
+	Parent string `json:"parent" validate:"required"`
+	Child  string `json:"child" validate:"required"`
 }
@@ -1,16 +1,7 @@
 package command
 
-import "errors"
-
 type CreatePipeline struct {
 	BaseCommand
-	Name string `json:"name"`
-	Type string `json:"type"`
-}
-
-func (cmd *CreatePipeline) Valid() error {
-	if cmd.Action == "" || cmd.Name == "" || cmd.Type == "" {
-		return errors.New("command is not valid")
-	}
-	return nil
+	Name string `json:"name" validate:"required"`
+	Type string `json:"type" validate:"required,pipeline_type"`
 }
@@ -0,0 +1,19 @@
+package command
+
+// Condition is a predicate over command data. Comparison operators
+// read Field, a dot separated path, and compare it with Value or
+// Values. The logical operators and, or and not combine Conditions;
+// not takes exactly one.
+type Condition struct {
+	Op         string        `json:"op"`
+	Field      string        `json:"field,omitempty"`
+	Value      interface{}   `json:"value,omitempty"`
+	Values     []interface{} `json:"values,omitempty"`
+	Conditions []Condition   `json:"conditions,omitempty"`
+}
+
+type UpdatePredicatePipeline struct {
+	BaseCommand
+	Name      string     `json:"name" validate:"required"`
+	Condition *Condition `json:"condition" validate:"required"`
+}
@@ -1,20 +1,28 @@
 package command
 
 import (
-	"errors"
 	"net/http"
 )
 
 type AddSubscriber struct {
 	BaseCommand
-	Node string `json:"node"`
+	Node string `json:"node" validate:"required"`
 	W    http.ResponseWriter
 	R    *http.Request
 }
 
 func (cmd *AddSubscriber) Valid() error {
-	if cmd.Action == "" || cmd.Node == "" || cmd.W == nil || cmd.R == nil {
-		return errors.New("command is not valid")
+	if cmd.W == nil || cmd.R == nil {
+		return Errorf(INVALID_ARGUMENT, "subscriber must connect over HTTP")
 	}
 	return nil
 }
+
+// UpdatePublisher configures what a publisher sends. With
+// IncludeMetadata, subscribers receive {"data": ..., "metadata": ...}
+// instead of the bare data.
+type UpdatePublisher struct {
+	BaseCommand
+	Node            string `json:"node" validate:"required"`
+	IncludeMetadata bool   `json:"include_metadata"`
+}
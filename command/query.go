@@ -0,0 +1,48 @@
+package command
+
+// GetTree returns the whole graph as it is serialized by the tree.
+type GetTree struct {
+	BaseCommand
+}
+
+// GetNode returns a single node with its children and properties.
+type GetNode struct {
+	BaseCommand
+	Node string `json:"node" validate:"required"`
+}
+
+// ListNodes returns the nodes sorted by name. Every filter that is set
+// must match; Prefix matches the start of the node's name.
+type ListNodes struct {
+	BaseCommand
+	Type   string `json:"type"`
+	Active *bool  `json:"active"`
+	Prefix string `json:"prefix"`
+}
+
+// ListPipelines returns the pipelines sorted by name, optionally only
+// those of one type.
+type ListPipelines struct {
+	BaseCommand
+	Type string `json:"type"`
+}
+
+// GetPipeline returns a single pipeline.
+type GetPipeline struct {
+	BaseCommand
+	Pipeline string `json:"pipeline" validate:"required"`
+}
+
+// GetChildren returns the nodes a node sends to, including its error
+// children.
+type GetChildren struct {
+	BaseCommand
+	Node string `json:"node" validate:"required"`
+}
+
+// GetParents returns the nodes that send to a node, including those it
+// is an error child of.
+type GetParents struct {
+	BaseCommand
+	Node string `json:"node" validate:"required"`
+}
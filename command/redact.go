@@ -0,0 +1,29 @@
+package command
+
+const (
+	REDACT_REMOVE  = "remove"
+	REDACT_HASH    = "hash"
+	REDACT_MASK    = "mask"
+	REDACT_REPLACE = "replace"
+)
+
+// RedactRule hides sensitive values. A rule either targets the value
+// at Path, or every match of Pattern in any string of the data.
+// Pattern is a regular expression or one of the built in patterns
+// email, phone and card. remove deletes the value (or the match), hash
+// replaces it with a salted SHA-256, mask replaces all but the last
+// Keep characters with * and replace puts Value in its place.
+type RedactRule struct {
+	Op      string      `json:"op"`
+	Path    string      `json:"path,omitempty"`
+	Pattern string      `json:"pattern,omitempty"`
+	Salt    string      `json:"salt,omitempty"`
+	Keep    int         `json:"keep,omitempty"`
+	Value   interface{} `json:"value,omitempty"`
+}
+
+type UpdateRedactPipeline struct {
+	BaseCommand
+	Name  string       `json:"name" validate:"required"`
+	Rules []RedactRule `json:"rules" validate:"required"`
+}
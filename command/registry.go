@@ -0,0 +1,128 @@
+package command
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Decoder decodes the JSON of a command. The options are those passed
+// to Dispense.
+type Decoder func(data []byte, options ...interface{}) Command
+
+var (
+	decoders   = map[string]Decoder{}
+	decodersMu sync.RWMutex
+)
+
+// RegisterDecoder makes Dispense decode action with decoder. Actions
+// are case insensitive. It panics if the action is empty or already
+// registered, so it is meant to be called from init.
+func RegisterDecoder(action string, decoder Decoder) {
+	action = strings.ToLower(action)
+	if action == "" || decoder == nil {
+		panic("command: RegisterDecoder needs an action and a decoder")
+	}
+
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+
+	if _, ok := decoders[action]; ok {
+		panic(fmt.Sprintf("command: action %s is already registered", action))
+	}
+	decoders[action] = decoder
+}
+
+// LookupDecoder returns the decoder registered for an action.
+func LookupDecoder(action string) (Decoder, bool) {
+	decodersMu.RLock()
+	defer decodersMu.RUnlock()
+
+	decoder, ok := decoders[strings.ToLower(action)]
+	return decoder, ok
+}
+
+// Decoding returns a decoder that decodes into the command returned by
+// new and validates it.
+func Decoding(new func() Command) Decoder {
+	return func(data []byte, options ...interface{}) Command {
+		return Decode(new(), data)
+	}
+}
+
+func init() {
+	// Tree
+	RegisterDecoder(CREATE_NODE, Decoding(func() Command { return &CreateNode{} }))
+	RegisterDecoder(ADD_CHILD, Decoding(func() Command { return &AddChild{} }))
+	RegisterDecoder(REMOVE_NODE, Decoding(func() Command { return &RemoveNode{} }))
+	RegisterDecoder(REMOVE_CHILD, Decoding(func() Command { return &RemoveChild{} }))
+	RegisterDecoder(ADD_ERROR_CHILD, Decoding(func() Command { return &AddErrorChild{} }))
+	RegisterDecoder(REMOVE_ERROR_CHILD, Decoding(func() Command { return &RemoveErrorChild{} }))
+	RegisterDecoder(CREATE_PIPELINE, Decoding(func() Command { return &CreatePipeline{} }))
+	RegisterDecoder(BATCH, Decoding(func() Command { return &Batch{} }))
+
+	// Query
+	RegisterDecoder(GET_TREE, Decoding(func() Command { return &GetTree{} }))
+	RegisterDecoder(GET_NODE, Decoding(func() Command { return &GetNode{} }))
+	RegisterDecoder(LIST_NODES, Decoding(func() Command { return &ListNodes{} }))
+	RegisterDecoder(LIST_PIPELINES, Decoding(func() Command { return &ListPipelines{} }))
+	RegisterDecoder(GET_PIPELINE, Decoding(func() Command { return &GetPipeline{} }))
+	RegisterDecoder(GET_CHILDREN, Decoding(func() Command { return &GetChildren{} }))
+	RegisterDecoder(GET_PARENTS, Decoding(func() Command { return &GetParents{} }))
+
+	// Filter Pipeline
+	RegisterDecoder(UPDATE_FILTER_PIPELINE, Decoding(func() Command { return &UpdateFilterPipeline{} }))
+
+	// Chain Pipeline
+	RegisterDecoder(UPDATE_CHAIN_PIPELINE, Decoding(func() Command { return &UpdateChainPipeline{} }))
+	RegisterDecoder(INSERT_CHAIN_STAGE, Decoding(func() Command { return &InsertChainStage{} }))
+	RegisterDecoder(REMOVE_CHAIN_STAGE, Decoding(func() Command { return &RemoveChainStage{} }))
+	RegisterDecoder(MOVE_CHAIN_STAGE, Decoding(func() Command { return &MoveChainStage{} }))
+
+	// Predicate Pipeline
+	RegisterDecoder(UPDATE_PREDICATE_PIPELINE, Decoding(func() Command { return &UpdatePredicatePipeline{} }))
+
+	// Map Pipeline
+	RegisterDecoder(UPDATE_MAP_PIPELINE, Decoding(func() Command { return &UpdateMapPipeline{} }))
+
+	// Expression Pipeline
+	RegisterDecoder(UPDATE_EXPRESSION_PIPELINE, Decoding(func() Command { return &UpdateExpressionPipeline{} }))
+
+	// Wasm Pipeline
+	RegisterDecoder(UPDATE_WASM_PIPELINE, Decoding(func() Command { return &UpdateWasmPipeline{} }))
+
+	// Redact Pipeline
+	RegisterDecoder(UPDATE_REDACT_PIPELINE, Decoding(func() Command { return &UpdateRedactPipeline{} }))
+
+	// Schema Pipeline
+	RegisterDecoder(UPDATE_SCHEMA_PIPELINE, Decoding(func() Command { return &UpdateSchemaPipeline{} }))
+
+	// Node
+	RegisterDecoder(ACTIVATE_NODE, Decoding(func() Command { return &ActivateNode{} }))
+	RegisterDecoder(DEACTIVATE_NODE, Decoding(func() Command { return &DeactivateNode{} }))
+	RegisterDecoder(UPDATE_MAILBOX, Decoding(func() Command { return &UpdateMailbox{} }))
+
+	// Dead Letter Node
+	RegisterDecoder(REPLAY_DEAD_LETTERS, Decoding(func() Command { return &ReplayDeadLetters{} }))
+	RegisterDecoder(GET_DEAD_LETTERS, Decoding(func() Command { return &GetDeadLetters{} }))
+
+	// Publisher Node
+	RegisterDecoder(ADD_SUBSCRIBER, func(data []byte, options ...interface{}) Command {
+		return DecodeWithOptions(&AddSubscriber{}, data, options...)
+	})
+	RegisterDecoder(UPDATE_PUBLISHER, Decoding(func() Command { return &UpdatePublisher{} }))
+
+	// Subscriber Node
+	RegisterDecoder(UPDATE_URL, Decoding(func() Command { return &UpdateURL{} }))
+	RegisterDecoder(ACTIVATE_WS, Decoding(func() Command { return &ActivateWS{} }))
+	RegisterDecoder(DECTIVATE_WS, Decoding(func() Command { return &DeactivateWS{} }))
+
+	// MongoDB Node
+	RegisterDecoder(CONNECT_MONGO, Decoding(func() Command { return &ConnectMongo{} }))
+	RegisterDecoder(ADD_MONGO, Decoding(func() Command { return &AddMongo{} }))
+	RegisterDecoder(UPDATE_MONGO, Decoding(func() Command { return &UpdateMongo{} }))
+	RegisterDecoder(UPDATE_BY_ID_MONGO, Decoding(func() Command { return &UpdateByIDMongo{} }))
+	RegisterDecoder(REMOVE_MONGO, Decoding(func() Command { return &RemoveMongo{} }))
+	RegisterDecoder(REMOVE_BY_ID_MONGO, Decoding(func() Command { return &RemoveByIDMongo{} }))
+	RegisterDecoder(QUERY_ALL_MONGO, Decoding(func() Command { return &QueryAllMongo{} }))
+}
@@ -0,0 +1,18 @@
+package command
+
+import "encoding/json"
+
+// UpdateSchemaPipeline uploads the JSON Schema of a schema pipeline.
+// Commands that fail validation are sent to ErrorChild, a node name or
+// ID, instead of the edge's child. Without an ErrorChild they are
+// dropped. ErrorChild becomes an error child of every node with an
+// edge through the pipeline, so it is rejected when it would close a
+// cycle unless AllowCycle is set and the nodes of the cycle use a drop
+// mailbox policy.
+type UpdateSchemaPipeline struct {
+	BaseCommand
+	Name       string          `json:"name" validate:"required"`
+	Schema     json.RawMessage `json:"schema" validate:"nonempty"`
+	ErrorChild string          `json:"error_child,omitempty"`
+	AllowCycle bool            `json:"allow_cycle,omitempty"`
+}
@@ -1,40 +1,36 @@
 package command
 
-import "errors"
+import (
+	"net/url"
+	"strings"
+)
 
+// UpdateURL points a subscriber at the websocket it reads from.
 type UpdateURL struct {
 	BaseCommand
-	Node string `json:"node"`
-	URL  string `json:"url"`
+	Node string `json:"node" validate:"required"`
+	URL  string `json:"url" validate:"required,url"`
 }
 
-func (cmd *UpdateURL) UpdateURL() error {
-	if cmd.Action == "" || cmd.Node == "" || cmd.URL == "" {
-		return errors.New("command is not valid")
+func (cmd *UpdateURL) Valid() error {
+	u, err := url.Parse(cmd.URL)
+	if err != nil {
+		return Invalid("url", "url must be an absolute URL")
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "ws", "wss", "http", "https":
+	default:
+		return Invalid("url", "url must use the ws, wss, http or https scheme")
 	}
 	return nil
 }
 
 type ActivateWS struct {
 	BaseCommand
-	Node string `json:"node"`
-}
-
-func (cmd *ActivateWS) ActivateWS() error {
-	if cmd.Action == "" || cmd.Node == "" {
-		return errors.New("command is not valid")
-	}
-	return nil
+	Node string `json:"node" validate:"required"`
 }
 
 type DeactivateWS struct {
 	BaseCommand
-	Node string `json:"node"`
-}
-
-func (cmd *DeactivateWS) DeactivateWS() error {
-	if cmd.Action == "" || cmd.Node == "" {
-		return errors.New("command is not valid")
-	}
-	return nil
+	Node string `json:"node" validate:"required"`
 }
@@ -0,0 +1,209 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Rule checks the value of a field tagged with its name. Empty values
+// are not passed to rules; tag the field required for that.
+type Rule func(value interface{}) error
+
+var (
+	rules   = map[string]Rule{}
+	rulesMu sync.RWMutex
+)
+
+// RegisterRule adds a rule that validate tags can name. It panics if
+// the name is empty, is a built-in rule or is already registered, so it
+// is meant to be called from init.
+func RegisterRule(name string, rule Rule) {
+	switch name {
+	case "", "required", "nonempty", "url", "hostname", "oneof", "min", "max":
+		panic(fmt.Sprintf("command: cannot register rule %q", name))
+	}
+	if rule == nil {
+		panic(fmt.Sprintf("command: rule %s needs a function", name))
+	}
+
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+
+	if _, ok := rules[name]; ok {
+		panic(fmt.Sprintf("command: rule %s is already registered", name))
+	}
+	rules[name] = rule
+}
+
+func lookupRule(name string) (Rule, bool) {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+
+	rule, ok := rules[name]
+	return rule, ok
+}
+
+// Validate checks the fields of a command, including those of embedded
+// structs, against their validate tags and returns the first failure.
+// A tag is a comma separated list of:
+//
+//	required     the field is not empty, nil or zero
+//	nonempty     the field has a length of at least one
+//	url          the field is an absolute URL
+//	hostname     the field is a host name or IP address without a
+//	             scheme, port or path
+//	oneof=a b c  the field is one of the listed values
+//	min=n        the field is a number of at least n
+//	max=n        the field is a number of at most n
+//
+// or the name of a rule added with RegisterRule. Rules other than
+// required and nonempty skip empty fields. Rules that are not
+// registered are skipped, as they belong to packages that are not
+// linked in.
+func Validate(cmd interface{}) error {
+	value := reflect.ValueOf(cmd)
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+	return validateStruct(value)
+}
+
+func validateStruct(value reflect.Value) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			if err := validateStruct(value.Field(i)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tag := field.Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+		if err := validateField(fieldName(field), value.Field(i), tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateField(name string, value reflect.Value, tag string) error {
+	empty := value.IsZero()
+	for _, rule := range strings.Split(tag, ",") {
+		rule, arg := strings.TrimSpace(rule), ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			rule, arg = rule[:i], rule[i+1:]
+		}
+
+		switch {
+		case rule == "required":
+			if empty {
+				return Required(name)
+			}
+		case rule == "nonempty":
+			if (value.Kind() == reflect.Slice || value.Kind() == reflect.Map || value.Kind() == reflect.String) && value.Len() == 0 {
+				return Required(name)
+			}
+		case empty:
+		case rule == "url":
+			if u, err := url.Parse(fmt.Sprint(value.Interface())); err != nil || !u.IsAbs() || u.Host == "" {
+				return Invalid(name, "%s must be an absolute URL", name)
+			}
+		case rule == "hostname":
+			if !isHostname(fmt.Sprint(value.Interface())) {
+				return Invalid(name, "%s must be a host name without a scheme or port", name)
+			}
+		case rule == "oneof":
+			allowed := strings.Fields(arg)
+			if !contains(allowed, fmt.Sprint(value.Interface())) {
+				return Invalid(name, "%s must be one of %s", name, strings.Join(allowed, ", "))
+			}
+		case rule == "min":
+			if number, ok := toFloat(value); ok {
+				if bound, err := strconv.ParseFloat(arg, 64); err == nil && number < bound {
+					return Invalid(name, "%s must be at least %s", name, arg)
+				}
+			}
+		case rule == "max":
+			if number, ok := toFloat(value); ok {
+				if bound, err := strconv.ParseFloat(arg, 64); err == nil && number > bound {
+					return Invalid(name, "%s must be at most %s", name, arg)
+				}
+			}
+		default:
+			check, ok := lookupRule(rule)
+			if !ok {
+				continue
+			}
+			if err := check(value.Interface()); err != nil {
+				return Invalid(name, "%v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// fieldName returns the JSON name of a field.
+func fieldName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" || name == "-" {
+		return strings.ToLower(field.Name)
+	}
+	return name
+}
+
+// isHostname reports whether host is an IP address or a name made of
+// dot separated labels of letters, digits and hyphens.
+func isHostname(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	if len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func toFloat(value reflect.Value) (float64, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), true
+	}
+	return 0, false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
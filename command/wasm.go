@@ -0,0 +1,12 @@
+package command
+
+// UpdateWasmPipeline uploads the module of a wasm pipeline. Module is
+// base64 encoded in JSON. MemoryPages and Timeout (milliseconds) limit
+// each invocation and use the pipeline defaults when zero.
+type UpdateWasmPipeline struct {
+	BaseCommand
+	Name        string `json:"name" validate:"required"`
+	Module      []byte `json:"module" validate:"nonempty"`
+	MemoryPages uint32 `json:"memory_pages" validate:"max=65536"`
+	Timeout     int    `json:"timeout" validate:"min=0"`
+}
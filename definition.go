@@ -0,0 +1,448 @@
+package flow
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/thinksystemio/package-flow/command"
+	"github.com/thinksystemio/package-flow/node"
+	"github.com/thinksystemio/package-flow/tree"
+	"gopkg.in/yaml.v3"
+)
+
+// Definition is a declarative description of a flow. It lists every
+// node, pipeline and edge the tree should contain. Plan compares it
+// against a live tree and Apply converges the tree to it.
+type Definition struct {
+	Nodes     []NodeDefinition     `json:"nodes" yaml:"nodes"`
+	Pipelines []PipelineDefinition `json:"pipelines" yaml:"pipelines"`
+	Edges     []EdgeDefinition     `json:"edges" yaml:"edges"`
+}
+
+type NodeDefinition struct {
+	Name    string             `json:"name" yaml:"name"`
+	Type    string             `json:"type" yaml:"type"`
+	Active  *bool              `json:"active,omitempty" yaml:"active,omitempty"`
+	URL     string             `json:"url,omitempty" yaml:"url,omitempty"`
+	Mailbox *MailboxDefinition `json:"mailbox,omitempty" yaml:"mailbox,omitempty"`
+}
+
+// MailboxDefinition configures a node's mailbox. Nodes on a cycle
+// allowed by an edge must use a drop policy. A zero capacity or empty
+// policy keeps the current value.
+type MailboxDefinition struct {
+	Capacity int    `json:"capacity,omitempty" yaml:"capacity,omitempty"`
+	Policy   string `json:"policy,omitempty" yaml:"policy,omitempty"`
+}
+
+type PipelineDefinition struct {
+	Name   string                 `json:"name" yaml:"name"`
+	Type   string                 `json:"type" yaml:"type"`
+	Config map[string]interface{} `json:"config,omitempty" yaml:"config,omitempty"`
+}
+
+type EdgeDefinition struct {
+	Parent     string `json:"parent" yaml:"parent"`
+	Child      string `json:"child" yaml:"child"`
+	Pipeline   string `json:"pipeline" yaml:"pipeline"`
+	AllowCycle bool   `json:"allow_cycle,omitempty" yaml:"allow_cycle,omitempty"`
+}
+
+// pipelineUpdateActions maps a pipeline type to the command that
+// applies a definition's config to it. The config is merged into the
+// command alongside the action and pipeline name.
+var pipelineUpdateActions = map[string]string{
+	"filter":     command.UPDATE_FILTER_PIPELINE,
+	"chain":      command.UPDATE_CHAIN_PIPELINE,
+	"predicate":  command.UPDATE_PREDICATE_PIPELINE,
+	"map":        command.UPDATE_MAP_PIPELINE,
+	"expression": command.UPDATE_EXPRESSION_PIPELINE,
+	"wasm":       command.UPDATE_WASM_PIPELINE,
+	"redact":     command.UPDATE_REDACT_PIPELINE,
+	"schema":     command.UPDATE_SCHEMA_PIPELINE,
+}
+
+// ParseDefinition decodes a definition from YAML or JSON.
+func ParseDefinition(data []byte) (*Definition, error) {
+	def := &Definition{}
+	if err := yaml.Unmarshal(data, def); err != nil {
+		return nil, err
+	}
+
+	if err := def.Valid(); err != nil {
+		return nil, err
+	}
+
+	return def, nil
+}
+
+// Valid checks that names are unique and that every edge refers to a
+// declared node and pipeline.
+func (def *Definition) Valid() error {
+	nodes := map[string]struct{}{}
+	for _, n := range def.Nodes {
+		if n.Name == "" || n.Type == "" {
+			return fmt.Errorf("node definition must have name and type")
+		}
+		if _, exists := nodes[n.Name]; exists {
+			return fmt.Errorf("node %s is defined more than once", n.Name)
+		}
+		nodes[n.Name] = struct{}{}
+	}
+
+	pipelines := map[string]struct{}{}
+	for _, p := range def.Pipelines {
+		if p.Name == "" || p.Type == "" {
+			return fmt.Errorf("pipeline definition must have name and type")
+		}
+		if _, exists := pipelines[p.Name]; exists {
+			return fmt.Errorf("pipeline %s is defined more than once", p.Name)
+		}
+		if _, ok := pipelineUpdateActions[strings.ToLower(p.Type)]; !ok && len(p.Config) != 0 {
+			return fmt.Errorf("pipeline %s of type %s does not accept config", p.Name, p.Type)
+		}
+		pipelines[p.Name] = struct{}{}
+	}
+
+	edges := map[[2]string]struct{}{}
+	for _, e := range def.Edges {
+		if _, ok := nodes[e.Parent]; !ok {
+			return fmt.Errorf("edge parent %s is not defined", e.Parent)
+		}
+		if _, ok := nodes[e.Child]; !ok {
+			return fmt.Errorf("edge child %s is not defined", e.Child)
+		}
+		if _, ok := pipelines[e.Pipeline]; !ok {
+			return fmt.Errorf("edge pipeline %s is not defined", e.Pipeline)
+		}
+
+		key := [2]string{e.Parent, e.Child}
+		if _, exists := edges[key]; exists {
+			return fmt.Errorf("edge %s -> %s is defined more than once", e.Parent, e.Child)
+		}
+		edges[key] = struct{}{}
+	}
+
+	return nil
+}
+
+// Plan lists the commands that converge the tree to the definition,
+// in the order they must be dispatched. Nodes in the tree that are
+// not in the definition are removed. Pipelines are never removed, so
+// a pipeline whose type differs from its definition is reported as an
+// error.
+func Plan(t *tree.Tree, def *Definition) ([]command.Command, error) {
+	if err := def.Valid(); err != nil {
+		return nil, err
+	}
+
+	plan := []command.Command{}
+	add := func(action string, fields map[string]interface{}) error {
+		cmd, err := planCommand(action, fields)
+		if err != nil {
+			return err
+		}
+		plan = append(plan, cmd)
+		return nil
+	}
+
+	// Nodes that must be created, either because they are missing or
+	// because their type changed.
+	desired := map[string]NodeDefinition{}
+	for _, n := range def.Nodes {
+		desired[n.Name] = n
+	}
+
+	created := map[string]struct{}{}
+	removed := map[string]struct{}{}
+	for _, n := range def.Nodes {
+		existing, _ := t.GetNodeByNameOrID(n.Name)
+		if existing == nil {
+			created[n.Name] = struct{}{}
+			continue
+		}
+		if !strings.EqualFold(existing.GetType(), n.Type) {
+			removed[n.Name] = struct{}{}
+			created[n.Name] = struct{}{}
+		}
+	}
+	for _, n := range t.Nodes {
+		if _, ok := desired[n.GetName()]; !ok {
+			removed[n.GetName()] = struct{}{}
+		}
+	}
+
+	// Pipelines
+	deferred := []command.Command{}
+	for _, p := range def.Pipelines {
+		existing, _ := t.GetPipelineByNameOrID(p.Name)
+		if existing != nil && !strings.EqualFold(pipelineType(existing.GetType()), p.Type) {
+			return nil, fmt.Errorf("pipeline %s has type %s, cannot change it to %s", p.Name, existing.GetType(), p.Type)
+		}
+
+		if existing == nil {
+			fields := map[string]interface{}{"name": p.Name, "type": p.Type}
+			if err := add(command.CREATE_PIPELINE, fields); err != nil {
+				return nil, err
+			}
+		}
+
+		if len(p.Config) == 0 {
+			continue
+		}
+
+		fields := map[string]interface{}{}
+		for k, v := range p.Config {
+			fields[k] = v
+		}
+		fields["name"] = p.Name
+
+		// Pipelines store their error child by ID, so a surviving node
+		// is referred to by ID for the comparison to work. The update
+		// waits until every node exists, since the error child may be
+		// created by this plan.
+		errorChild, hasErrorChild := fields["error_child"].(string)
+		if hasErrorChild {
+			if _, ok := removed[errorChild]; !ok {
+				if n, _ := t.GetNodeByNameOrID(errorChild); n != nil {
+					fields["error_child"] = n.GetID()
+				}
+			}
+		}
+
+		update, err := planCommand(pipelineUpdateActions[strings.ToLower(p.Type)], fields)
+		if err != nil {
+			return nil, err
+		}
+
+		if existing != nil && configMatches(existing, update, p.Config) {
+			continue
+		}
+		if hasErrorChild {
+			deferred = append(deferred, update)
+			continue
+		}
+		plan = append(plan, update)
+	}
+
+	// Edges between nodes that survive the plan.
+	current := map[[2]string]string{}
+	for _, parent := range t.Nodes {
+		if _, ok := removed[parent.GetName()]; ok {
+			continue
+		}
+		for child, p := range parent.GetChildren() {
+			if _, ok := removed[child.GetName()]; ok {
+				continue
+			}
+			name := ""
+			if p != nil {
+				name = p.GetName()
+			}
+			current[[2]string{parent.GetName(), child.GetName()}] = name
+		}
+	}
+
+	wanted := map[[2]string]string{}
+	for _, e := range def.Edges {
+		wanted[[2]string{e.Parent, e.Child}] = e.Pipeline
+	}
+
+	for _, key := range sortedEdges(current) {
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+		fields := map[string]interface{}{"parent": key[0], "child": key[1]}
+		if err := add(command.REMOVE_CHILD, fields); err != nil {
+			return nil, err
+		}
+	}
+
+	names := make([]string, 0, len(removed))
+	for name := range removed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fields := map[string]interface{}{"node": name, "keep_pipelines": true}
+		if err := add(command.REMOVE_NODE, fields); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, n := range def.Nodes {
+		var existing node.Node
+		if _, ok := created[n.Name]; ok {
+			fields := map[string]interface{}{"name": n.Name, "type": n.Type}
+			if err := add(command.CREATE_NODE, fields); err != nil {
+				return nil, err
+			}
+		} else {
+			existing, _ = t.GetNodeByNameOrID(n.Name)
+		}
+
+		active := n.Active == nil || *n.Active
+		if existing == nil && !active || existing != nil && existing.GetActive() != active {
+			action := command.ACTIVATE_NODE
+			if !active {
+				action = command.DEACTIVATE_NODE
+			}
+			if err := add(action, map[string]interface{}{"node": n.Name}); err != nil {
+				return nil, err
+			}
+		}
+
+		if n.URL != "" && (existing == nil || existing.ToJSONStruct()["url"] != n.URL) {
+			fields := map[string]interface{}{"node": n.Name, "url": n.URL}
+			if err := add(command.UPDATE_URL, fields); err != nil {
+				return nil, err
+			}
+		}
+
+		if n.Mailbox != nil && !mailboxMatches(existing, n.Mailbox) {
+			fields := map[string]interface{}{"node": n.Name, "capacity": n.Mailbox.Capacity, "policy": n.Mailbox.Policy}
+			if err := add(command.UPDATE_MAILBOX, fields); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	plan = append(plan, deferred...)
+
+	for _, e := range def.Edges {
+		if name, ok := current[[2]string{e.Parent, e.Child}]; ok && name == e.Pipeline {
+			continue
+		}
+		fields := map[string]interface{}{"parent": e.Parent, "child": e.Child, "pipeline": e.Pipeline, "allow_cycle": e.AllowCycle}
+		if err := add(command.ADD_CHILD, fields); err != nil {
+			return nil, err
+		}
+	}
+
+	return plan, nil
+}
+
+// Apply plans the definition against the tree and dispatches every
+// command in order. It stops at the first command that fails and
+// returns the commands dispatched so far.
+func Apply(t *tree.Tree, def *Definition, options ...interface{}) ([]command.Command, error) {
+	plan, err := Plan(t, def)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := []command.Command{}
+	for _, cmd := range plan {
+		result := Dispatch(t, cmd, options...)
+		applied = append(applied, result)
+		if result.HasErrors() {
+			return applied, fmt.Errorf("%s failed: %s", result.GetAction(), result.GetErrors()[0].Message)
+		}
+	}
+
+	return applied, nil
+}
+
+//
+// Definition Utils
+//
+
+// planCommand builds a command the same way DispatchFromJSON does so
+// that a plan is validated before anything is dispatched.
+func planCommand(action string, fields map[string]interface{}) (command.Command, error) {
+	fields["action"] = action
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := command.Dispense(action, data)
+	if cmd.HasErrors() {
+		return nil, fmt.Errorf("%s: %s", action, cmd.GetErrors()[0].Message)
+	}
+
+	return cmd, nil
+}
+
+// mailboxMatches reports whether an existing node's mailbox already
+// has the defined capacity and policy.
+func mailboxMatches(n node.Node, def *MailboxDefinition) bool {
+	if n == nil || n.GetMailbox() == nil {
+		return false
+	}
+	capacity, policy := n.GetMailbox().Config()
+	return (def.Capacity == 0 || def.Capacity == capacity) && (def.Policy == "" || def.Policy == policy)
+}
+
+// configMatches reports whether the pipeline's JSON already holds the
+// values the update command would set for every config key. The
+// command is compared rather than the raw config so that equivalent
+// forms, such as a filter given as a set or a list, match. Keys are
+// matched case insensitively, as encoding/json does when decoding.
+func configMatches(p interface{ ToJSON() ([]byte, error) }, update command.Command, config map[string]interface{}) bool {
+	current, err := toJSONMap(p.ToJSON())
+	if err != nil {
+		return false
+	}
+
+	wanted, err := toJSONMap(json.Marshal(update))
+	if err != nil {
+		return false
+	}
+
+	for k := range config {
+		want, ok := lookupFold(wanted, k)
+		if !ok {
+			return false
+		}
+		value, ok := lookupFold(current, k)
+		if !ok || !reflect.DeepEqual(value, want) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func toJSONMap(JSON []byte, err error) (map[string]interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	m := map[string]interface{}{}
+	err = json.Unmarshal(JSON, &m)
+	return m, err
+}
+
+func lookupFold(m map[string]interface{}, key string) (interface{}, bool) {
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func pipelineType(t string) string {
+	if t == "" {
+		return "base"
+	}
+	return t
+}
+
+func sortedEdges(edges map[[2]string]string) [][2]string {
+	keys := make([][2]string, 0, len(edges))
+	for key := range edges {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
@@ -0,0 +1,137 @@
+package flow
+
+import (
+	"testing"
+
+	"github.com/thinksystemio/package-flow/tree"
+)
+
+const testingDefinition = `
+nodes:
+  - name: node_source
+    type: base
+  - name: node_sink
+    type: base
+  - name: node_other
+    type: base
+    active: false
+pipelines:
+  - name: pipe_filter
+    type: filter
+    config:
+      filter: {a: {}, b: {}}
+edges:
+  - parent: node_source
+    child: node_sink
+    pipeline: pipe_filter
+  - parent: node_source
+    child: node_other
+    pipeline: pipe_filter
+`
+
+func planActions(t *testing.T, tree *tree.Tree, def *Definition) []string {
+	plan, err := Plan(tree, def)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions := []string{}
+	for _, cmd := range plan {
+		actions = append(actions, cmd.GetAction())
+	}
+	return actions
+}
+
+func TestApplyDefinition(t *testing.T) {
+	tree := tree.NewTree()
+
+	def, err := ParseDefinition([]byte(testingDefinition))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Apply(tree, def); err != nil {
+		t.Fatal(err)
+	}
+
+	source, _ := tree.GetNodeByNameOrID("node_source")
+	other, _ := tree.GetNodeByNameOrID("node_other")
+	if len(source.GetChildren()) != 2 {
+		t.Errorf("node_source should have 2 children, has %d", len(source.GetChildren()))
+	}
+	if other.GetActive() {
+		t.Error("node_other should be inactive")
+	}
+
+	if actions := planActions(t, tree, def); len(actions) != 0 {
+		t.Errorf("applied definition should plan no commands, planned %v", actions)
+	}
+
+	def.Nodes = def.Nodes[:2]
+	def.Edges = def.Edges[:1]
+	def.Pipelines[0].Config["filter"] = map[string]interface{}{"a": map[string]interface{}{}}
+
+	want := []string{"update_filter_pipeline", "remove_node"}
+	actions := planActions(t, tree, def)
+	if len(actions) != len(want) {
+		t.Fatalf("planned %v, want %v", actions, want)
+	}
+	for i := range want {
+		if actions[i] != want[i] {
+			t.Fatalf("planned %v, want %v", actions, want)
+		}
+	}
+
+	if _, err := Apply(tree, def); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.GetNodeByNameOrID("node_other"); err == nil {
+		t.Error("node_other should have been removed")
+	}
+}
+
+func TestParseDefinitionInvalid(t *testing.T) {
+	data := []byte(`{"nodes":[{"name":"a","type":"base"}],"edges":[{"parent":"a","child":"b","pipeline":"p"}]}`)
+	if _, err := ParseDefinition(data); err == nil {
+		t.Error("definition with an undefined child should not parse")
+	}
+}
+
+func TestApplyDefinitionCycle(t *testing.T) {
+	tree := tree.NewTree()
+
+	def, err := ParseDefinition([]byte(`
+nodes:
+  - name: node_ping
+    type: base
+    mailbox: {policy: drop_oldest}
+  - name: node_pong
+    type: base
+    mailbox: {capacity: 8, policy: drop_newest}
+pipelines:
+  - name: pipe_base
+    type: base
+edges:
+  - parent: node_ping
+    child: node_pong
+    pipeline: pipe_base
+  - parent: node_pong
+    child: node_ping
+    pipeline: pipe_base
+    allow_cycle: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Apply(tree, def); err != nil {
+		t.Fatal(err)
+	}
+	pong, _ := tree.GetNodeByNameOrID("node_pong")
+	if capacity, policy := pong.GetMailbox().Config(); capacity != 8 || policy != "drop_newest" {
+		t.Errorf("node_pong mailbox is %d %s", capacity, policy)
+	}
+	if actions := planActions(t, tree, def); len(actions) != 0 {
+		t.Errorf("applied definition should plan no commands, planned %v", actions)
+	}
+}
@@ -2,7 +2,8 @@ package flow
 
 import (
 	"encoding/json"
-	"errors"
+	"fmt"
+	"strings"
 
 	"github.com/thinksystemio/package-flow/command"
 	"github.com/thinksystemio/package-flow/node"
@@ -14,13 +15,18 @@ func NewTree() *tree.Tree {
 	return tree.NewTree()
 }
 
+// LoadTree rebuilds a tree from a file written by Tree.Save.
+func LoadTree(path string) (*tree.Tree, error) {
+	return tree.LoadTree(path)
+}
+
 func IdentifyCommand(data []byte) *command.BaseCommand {
-	command := &command.BaseCommand{}
-	err := json.Unmarshal(data, command)
+	base := &command.BaseCommand{}
+	err := json.Unmarshal(data, base)
 	if err != nil {
-		command.AppendError(err)
+		base.AppendError(command.Errorf(command.INVALID_ARGUMENT, "%v", err))
 	}
-	return command
+	return base
 }
 
 func DispatchFromJSON(tree *tree.Tree, data []byte, options ...interface{}) command.Command {
@@ -37,212 +43,963 @@ func DispatchFromJSON(tree *tree.Tree, data []byte, options ...interface{}) comm
 	return Dispatch(tree, dispensed, options...)
 }
 
+// Dispatch runs a command against the tree with the handler registered
+// for its type. Commands without a handler are returned unchanged. A
+// batch runs alone, so other commands neither see nor change the tree
+// while it may still roll back; other commands run concurrently.
 func Dispatch(tree *tree.Tree, cmd command.Command, options ...interface{}) command.Command {
-	switch cmd := cmd.(type) {
-
-	//
-	// Tree
-	//
+	handler, ok := lookupHandler(cmd)
+	if !ok {
+		return cmd
+	}
 
-	case *command.CreateNode:
-		if found, _ := tree.GetNodeByNameOrID(cmd.Name); found != nil {
-			cmd.AppendError(errors.New("node already exists"))
-			return cmd
+	// The commands of a batch run under the batch's lock, and
+	// add_subscriber only locks to find its node as it then waits for
+	// the subscriber to leave.
+	switch cmd.(type) {
+	case *command.Batch:
+		tree.DispatchMu.Lock()
+		defer tree.DispatchMu.Unlock()
+	case *command.AddSubscriber:
+	default:
+		if transactionOf(options) == nil {
+			tree.DispatchMu.RLock()
+			defer tree.DispatchMu.RUnlock()
 		}
+	}
 
-		n := node.NewNode(cmd)
-		if n != nil {
-			if err := tree.AddNode(n); err != nil {
-				cmd.AppendError(err)
-				return cmd
-			}
-		}
+	handler(tree, cmd, options...)
+	return cmd
+}
 
-		cmd.Data = n.GetID()
-	case *command.AddChild:
-		parent, err := tree.GetNodeByNameOrID(cmd.Parent)
-		if err != nil {
-			cmd.AppendError(err)
-			return cmd
-		}
+//
+// Tree
+//
 
-		child, err := tree.GetNodeByNameOrID(cmd.Child)
-		if err != nil {
-			cmd.AppendError(err)
-			return cmd
-		}
+func createNode(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.CreateNode)
+	if found, _ := tree.GetNodeByNameOrID(cmd.Name); found != nil {
+		cmd.AppendError(command.Errorf(command.ALREADY_EXISTS, "node already exists").WithField("name").WithNode(found.GetID()))
+		return
+	}
 
-		pipe := pipeline.NewBasePipelineDefault(cmd.Pipeline)
-		if pipe != nil {
-			if err := tree.AddPipeline(pipe); err != nil {
-				cmd.AppendError(err)
-				return cmd
-			}
+	n := node.NewNode(cmd)
+	if n == nil {
+		return
+	}
+	if err := tree.AddNode(n); err != nil {
+		cmd.AppendError(err)
+		return
+	}
+
+	cmd.Data = n.GetID()
+}
+
+func addChild(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.AddChild)
+	parent, err := tree.GetNodeByNameOrID(cmd.Parent)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("parent"))
+		return
+	}
+
+	child, err := tree.GetNodeByNameOrID(cmd.Child)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("child"))
+		return
+	}
+
+	if !cmd.AllowCycle && tree.Reaches(child, parent) {
+		cmd.AppendError(command.Errorf(command.FAILED_PRECONDITION, "edge would create a cycle").WithField("child").WithNode(child.GetID()))
+		return
+	}
+	if n := blockingCycle(tree, []node.Node{child}, []node.Node{parent}); n != nil {
+		cmd.AppendError(cycleBlocks(n, "child"))
+		return
+	}
+
+	pipe, err := tree.GetPipelineByNameOrID(cmd.Pipeline)
+	if err != nil && !cmd.Create {
+		cmd.AppendError(command.AsError(err).WithField("pipeline"))
+		return
+	}
+	if pipe != nil && !cmd.AllowCycle && routesCycle(tree, tree.GetErrorRoutes(pipe), []node.Node{parent}) {
+		cmd.AppendError(command.Errorf(command.FAILED_PRECONDITION, "error route of pipeline would create a cycle").WithField("pipeline").WithPipeline(pipe.GetID()))
+		return
+	}
+	if pipe != nil {
+		if n := blockingCycle(tree, tree.GetErrorRoutes(pipe), []node.Node{parent}); n != nil {
+			cmd.AppendError(cycleBlocks(n, "pipeline"))
+			return
 		}
+	}
 
-		parent.AddPipeline(child, pipe)
-	case *command.CreatePipeline:
-		if found, _ := tree.GetPipelineByNameOrID(cmd.Name); found != nil {
-			cmd.AppendError(errors.New("pipeline already exists"))
-			return cmd
+	if pipe == nil {
+		create := &command.CreatePipeline{Name: cmd.Pipeline, Type: cmd.PipelineType}
+		create.Action = command.CREATE_PIPELINE
+		if create.Type == "" {
+			create.Type = "base"
 		}
 
-		p := pipeline.NewPipeline(cmd)
-		if p != nil {
-			if err := tree.AddPipeline(p); err != nil {
-				cmd.AppendError(err)
-				return cmd
+		pipe = pipeline.NewPipeline(create)
+		if pipe == nil {
+			for _, err := range create.GetErrors() {
+				cmd.Errors = append(cmd.Errors, err)
 			}
+			return
 		}
 
-	//
-	// Filter Pipeline
-	//
-
-	case *command.UpdateFilterPipeline:
-		p, err := tree.GetPipelineByNameOrID(cmd.Name)
-		if err != nil {
+		if err := tree.AddPipeline(pipe); err != nil {
 			cmd.AppendError(err)
-			return cmd
-		}
-		if filter, ok := p.(*pipeline.FilterPipeline); ok {
-			filter.UpdatePipelineFilter(cmd)
+			return
 		}
+	}
 
-	//
-	// Node
-	//
+	tree.AddEdge(parent, child, pipe)
+	cmd.Data = pipe.GetID()
+}
 
-	case *command.ActivateNode:
-		n, err := tree.GetNodeByNameOrID(cmd.Node)
-		if err != nil {
-			cmd.AppendError(err)
-			return cmd
-		}
-		n.Activate(cmd)
-	case *command.DeactivateNode:
-		n, err := tree.GetNodeByNameOrID(cmd.Node)
-		if err != nil {
-			cmd.AppendError(err)
-			return cmd
-		}
-		n.Deactivate(cmd)
+func removeNode(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.RemoveNode)
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
 
-	//
-	// Publisher
-	//
+	pipelines := []pipeline.Pipeline{}
+	for _, edge := range append(tree.GetParentEdges(n), tree.GetChildEdges(n)...) {
+		pipelines = append(pipelines, edge.Pipeline)
+	}
 
-	case *command.AddSubscriber:
-		n, err := tree.GetNodeByNameOrID(cmd.Node)
-		if err != nil {
-			cmd.AppendError(err)
-			return cmd
-		}
-		if publisher, ok := n.(*node.Publisher); ok {
-			publisher.AddSubscriber(cmd)
+	tree.RemoveNode(n)
+	if !cmd.KeepPipelines {
+		pipelines = tree.RemoveUnusedPipelines(pipelines)
+	} else {
+		pipelines = nil
+	}
+	stop := func() error {
+		for _, p := range pipelines {
+			pipeline.Close(p)
 		}
+		return n.Delete()
+	}
 
-	//
-	// Subscriber
-	//
+	// A batch stops the node and closes its pipelines only once it
+	// commits, so that the removal can be rolled back.
+	if tx := transactionOf(options); tx != nil {
+		tx.OnCommit(stop)
+	} else {
+		cmd.AppendError(stop())
+	}
 
-	case *command.UpdateURL:
-		n, err := tree.GetNodeByNameOrID(cmd.Node)
-		if err != nil {
-			cmd.AppendError(err)
-			return cmd
-		}
-		if subscriber, ok := n.(*node.Subscriber); ok {
-			subscriber.UpdateURL(cmd)
-		}
+	cmd.Data = n.GetID()
+}
 
-	case *command.ActivateWS:
-		n, err := tree.GetNodeByNameOrID(cmd.Node)
-		if err != nil {
-			cmd.AppendError(err)
-			return cmd
-		}
-		if subscriber, ok := n.(*node.Subscriber); ok {
-			subscriber.ActivateWS(cmd)
-		}
-	case *command.DeactivateWS:
-		n, err := tree.GetNodeByNameOrID(cmd.Node)
-		if err != nil {
-			cmd.AppendError(err)
-			return cmd
-		}
-		if subscriber, ok := n.(*node.Subscriber); ok {
-			subscriber.DeactivateWS(cmd)
-		}
+func removeChild(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.RemoveChild)
+	parent, err := tree.GetNodeByNameOrID(cmd.Parent)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("parent"))
+		return
+	}
 
-	//
-	// Mongo
-	//
+	child, err := tree.GetNodeByNameOrID(cmd.Child)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("child"))
+		return
+	}
 
-	case *command.ConnectMongo:
-		n, err := tree.GetNodeByNameOrID(cmd.Node)
-		if err != nil {
+	if !parent.HasChild(child) {
+		cmd.AppendError(command.Errorf(command.NOT_FOUND, "node is not a child of parent").WithField("child").WithNode(child.GetID()))
+		return
+	}
+
+	tree.RemoveEdge(parent, child)
+}
+
+func addErrorChild(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.AddErrorChild)
+	parent, err := tree.GetNodeByNameOrID(cmd.Parent)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("parent"))
+		return
+	}
+
+	child, err := tree.GetNodeByNameOrID(cmd.Child)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("child"))
+		return
+	}
+
+	if parent == child {
+		cmd.AppendError(command.Invalid("child", "node cannot be its own error child").WithNode(child.GetID()))
+		return
+	}
+	if !cmd.AllowCycle && tree.Reaches(child, parent) {
+		cmd.AppendError(command.Errorf(command.FAILED_PRECONDITION, "edge would create a cycle").WithField("child").WithNode(child.GetID()))
+		return
+	}
+	if n := blockingCycle(tree, []node.Node{child}, []node.Node{parent}); n != nil {
+		cmd.AppendError(cycleBlocks(n, "child"))
+		return
+	}
+
+	tree.AddErrorEdge(parent, child)
+}
+
+func removeErrorChild(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.RemoveErrorChild)
+	parent, err := tree.GetNodeByNameOrID(cmd.Parent)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("parent"))
+		return
+	}
+
+	child, err := tree.GetNodeByNameOrID(cmd.Child)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("child"))
+		return
+	}
+
+	if !parent.HasErrorChild(child) {
+		cmd.AppendError(command.Errorf(command.NOT_FOUND, "node is not an error child of parent").WithField("child").WithNode(child.GetID()))
+		return
+	}
+
+	tree.RemoveErrorEdge(parent, child)
+}
+
+func createPipeline(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.CreatePipeline)
+	if found, _ := tree.GetPipelineByNameOrID(cmd.Name); found != nil {
+		cmd.AppendError(command.Errorf(command.ALREADY_EXISTS, "pipeline already exists").WithField("name").WithPipeline(found.GetID()))
+		return
+	}
+
+	p := pipeline.NewPipeline(cmd)
+	if p != nil {
+		if err := tree.AddPipeline(p); err != nil {
 			cmd.AppendError(err)
-			return cmd
+			return
 		}
-		if mongo, ok := n.(*node.Mongo); ok {
-			mongo.Connect(cmd)
-		}
-	case *command.AddMongo:
-		n, err := tree.GetNodeByNameOrID(cmd.Node)
+		cmd.Data = p.GetID()
+	}
+}
+
+//
+// Query
+//
+
+func getTree(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.GetTree)
+	JSON, err := tree.ViewJSON()
+	if err != nil {
+		cmd.AppendError(err)
+		return
+	}
+	cmd.Data = json.RawMessage(JSON)
+}
+
+func getNode(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.GetNode)
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
+	cmd.Data = tree.DescribeNode(n)
+}
+
+func listNodes(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.ListNodes)
+	nodes := tree.ListNodes(func(n node.Node) bool {
+		return (cmd.Type == "" || n.GetType() == cmd.Type) &&
+			(cmd.Active == nil || n.GetActive() == *cmd.Active) &&
+			strings.HasPrefix(n.GetName(), cmd.Prefix)
+	})
+	cmd.Data = tree.DescribeNodes(nodes)
+}
+
+func listPipelines(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.ListPipelines)
+	pipelines := []json.RawMessage{}
+	for _, p := range tree.ListPipelines(func(p pipeline.Pipeline) bool {
+		return cmd.Type == "" || p.GetType() == cmd.Type
+	}) {
+		JSON, err := pipeline.ViewJSON(p)
 		if err != nil {
 			cmd.AppendError(err)
-			return cmd
-		}
-		if mongo, ok := n.(*node.Mongo); ok {
-			mongo.Add(cmd)
+			return
 		}
-	case *command.UpdateMongo:
-		n, err := tree.GetNodeByNameOrID(cmd.Node)
+		pipelines = append(pipelines, JSON)
+	}
+	cmd.Data = pipelines
+}
+
+func getPipeline(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.GetPipeline)
+	p, err := tree.GetPipelineByNameOrID(cmd.Pipeline)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("pipeline"))
+		return
+	}
+	JSON, err := pipeline.ViewJSON(p)
+	if err != nil {
+		cmd.AppendError(err)
+		return
+	}
+	cmd.Data = json.RawMessage(JSON)
+}
+
+func getChildren(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.GetChildren)
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
+	cmd.Data = tree.DescribeEdges(tree.GetChildEdges(n), true)
+}
+
+func getParents(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.GetParents)
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
+	cmd.Data = tree.DescribeEdges(tree.GetParentEdges(n), false)
+}
+
+//
+// Filter Pipeline
+//
+
+func updateFilterPipeline(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.UpdateFilterPipeline)
+	p, err := tree.GetPipelineByNameOrID(cmd.Name)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("name"))
+		return
+	}
+	filter, ok := p.(*pipeline.FilterPipeline)
+	if !ok {
+		cmd.AppendError(pipelineTypeMismatch(cmd, p))
+		return
+	}
+	filter.UpdatePipelineFilter(cmd)
+}
+
+//
+// Predicate Pipeline
+//
+
+func updatePredicatePipeline(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.UpdatePredicatePipeline)
+	p, err := tree.GetPipelineByNameOrID(cmd.Name)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("name"))
+		return
+	}
+	predicate, ok := p.(*pipeline.PredicatePipeline)
+	if !ok {
+		cmd.AppendError(pipelineTypeMismatch(cmd, p))
+		return
+	}
+	predicate.UpdatePredicatePipeline(cmd)
+}
+
+//
+// Map Pipeline
+//
+
+func updateMapPipeline(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.UpdateMapPipeline)
+	p, err := tree.GetPipelineByNameOrID(cmd.Name)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("name"))
+		return
+	}
+	mapping, ok := p.(*pipeline.MapPipeline)
+	if !ok {
+		cmd.AppendError(pipelineTypeMismatch(cmd, p))
+		return
+	}
+	mapping.UpdateMapPipeline(cmd)
+}
+
+//
+// Expression Pipeline
+//
+
+func updateExpressionPipeline(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.UpdateExpressionPipeline)
+	p, err := tree.GetPipelineByNameOrID(cmd.Name)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("name"))
+		return
+	}
+	expr, ok := p.(*pipeline.ExpressionPipeline)
+	if !ok {
+		cmd.AppendError(pipelineTypeMismatch(cmd, p))
+		return
+	}
+	expr.UpdateExpressionPipeline(cmd)
+}
+
+//
+// Wasm Pipeline
+//
+
+func updateWasmPipeline(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.UpdateWasmPipeline)
+	p, err := tree.GetPipelineByNameOrID(cmd.Name)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("name"))
+		return
+	}
+	wasm, ok := p.(*pipeline.WasmPipeline)
+	if !ok {
+		cmd.AppendError(pipelineTypeMismatch(cmd, p))
+		return
+	}
+	wasm.UpdateWasmPipeline(cmd)
+}
+
+//
+// Redact Pipeline
+//
+
+func updateRedactPipeline(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.UpdateRedactPipeline)
+	p, err := tree.GetPipelineByNameOrID(cmd.Name)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("name"))
+		return
+	}
+	redact, ok := p.(*pipeline.RedactPipeline)
+	if !ok {
+		cmd.AppendError(pipelineTypeMismatch(cmd, p))
+		return
+	}
+	redact.UpdateRedactPipeline(cmd)
+}
+
+//
+// Schema Pipeline
+//
+
+func updateSchemaPipeline(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.UpdateSchemaPipeline)
+	p, err := tree.GetPipelineByNameOrID(cmd.Name)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("name"))
+		return
+	}
+	schema, ok := p.(*pipeline.SchemaPipeline)
+	if !ok {
+		cmd.AppendError(pipelineTypeMismatch(cmd, p))
+		return
+	}
+
+	var errorChild node.Node
+	if cmd.ErrorChild != "" {
+		errorChild, err = tree.GetNodeByNameOrID(cmd.ErrorChild)
 		if err != nil {
-			cmd.AppendError(err)
-			return cmd
-		}
-		if mongo, ok := n.(*node.Mongo); ok {
-			mongo.Update(cmd)
+			cmd.AppendError(command.AsError(err).WithField("error_child"))
+			return
 		}
-	case *command.UpdateByIDMongo:
-		n, err := tree.GetNodeByNameOrID(cmd.Node)
-		if err != nil {
-			cmd.AppendError(err)
-			return cmd
+		if !cmd.AllowCycle && routesCycle(tree, []node.Node{errorChild}, tree.GetPipelineUsers(schema)) {
+			cmd.AppendError(command.Errorf(command.FAILED_PRECONDITION, "error child would create a cycle").WithField("error_child").WithNode(errorChild.GetID()))
+			return
 		}
-		if mongo, ok := n.(*node.Mongo); ok {
-			mongo.UpdateByID(cmd)
+		if n := blockingCycle(tree, []node.Node{errorChild}, tree.GetPipelineUsers(schema)); n != nil {
+			cmd.AppendError(cycleBlocks(n, "error_child"))
+			return
 		}
-	case *command.RemoveMongo:
-		n, err := tree.GetNodeByNameOrID(cmd.Node)
+	}
+
+	schema.UpdateSchemaPipeline(cmd)
+	if !cmd.HasErrors() {
+		cmd.AppendError(tree.SetErrorRoute(schema, errorChild))
+	}
+}
+
+//
+// Chain Pipeline
+//
+
+func updateChainPipeline(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.UpdateChainPipeline)
+	chain, err := getChainPipeline(tree, cmd.Name)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("name"))
+		return
+	}
+
+	stages := []pipeline.Pipeline{}
+	for i, name := range cmd.Stages {
+		stage, err := tree.GetPipelineByNameOrID(name)
 		if err != nil {
-			cmd.AppendError(err)
-			return cmd
+			cmd.AppendError(command.AsError(err).WithField(fmt.Sprintf("stages[%d]", i)))
+			return
 		}
-		if mongo, ok := n.(*node.Mongo); ok {
-			mongo.Remove(cmd)
+		if routesCycle(tree, tree.GetErrorRoutes(stage), tree.GetPipelineUsers(chain)) {
+			cmd.AppendError(stageCycle(stage, fmt.Sprintf("stages[%d]", i)))
+			return
 		}
-	case *command.RemoveByIDMongo:
-		n, err := tree.GetNodeByNameOrID(cmd.Node)
-		if err != nil {
-			cmd.AppendError(err)
-			return cmd
-		}
-		if mongo, ok := n.(*node.Mongo); ok {
-			mongo.RemoveByID(cmd)
+		stages = append(stages, stage)
+	}
+	cmd.AppendError(pipelineError(chain.SetStages(stages), "stages", chain))
+}
+
+func insertChainStage(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.InsertChainStage)
+	chain, err := getChainPipeline(tree, cmd.Name)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("name"))
+		return
+	}
+
+	stage, err := tree.GetPipelineByNameOrID(cmd.Stage)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("stage"))
+		return
+	}
+
+	if routesCycle(tree, tree.GetErrorRoutes(stage), tree.GetPipelineUsers(chain)) {
+		cmd.AppendError(stageCycle(stage, "stage"))
+		return
+	}
+
+	index := -1
+	if cmd.Index != nil {
+		index = *cmd.Index
+	}
+	cmd.AppendError(pipelineError(chain.InsertStage(stage, index), "stage", chain))
+}
+
+func removeChainStage(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.RemoveChainStage)
+	chain, err := getChainPipeline(tree, cmd.Name)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("name"))
+		return
+	}
+
+	stage, err := tree.GetPipelineByNameOrID(cmd.Stage)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("stage"))
+		return
+	}
+	cmd.AppendError(pipelineError(chain.RemoveStage(stage), "stage", chain))
+}
+
+func moveChainStage(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.MoveChainStage)
+	chain, err := getChainPipeline(tree, cmd.Name)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("name"))
+		return
+	}
+
+	stage, err := tree.GetPipelineByNameOrID(cmd.Stage)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("stage"))
+		return
+	}
+	cmd.AppendError(pipelineError(chain.MoveStage(stage, *cmd.Index), "index", chain))
+}
+
+//
+// Node
+//
+
+func activateNode(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.ActivateNode)
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
+	n.Activate(cmd)
+}
+
+func deactivateNode(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.DeactivateNode)
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
+	n.Deactivate(cmd)
+}
+
+func updateMailbox(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.UpdateMailbox)
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
+
+	mailbox := n.GetMailbox()
+	if mailbox == nil {
+		cmd.AppendError(command.Errorf(command.TYPE_MISMATCH, "node does not have a mailbox").WithField("node").WithNode(n.GetID()))
+		return
+	}
+
+	capacity, policy := mailbox.Config()
+	if cmd.Capacity != 0 {
+		capacity = cmd.Capacity
+	}
+	if cmd.Policy != "" {
+		policy = cmd.Policy
+	}
+	if policy == node.MAILBOX_BLOCK && onCycle(tree, n) {
+		cmd.AppendError(command.Errorf(command.FAILED_PRECONDITION, "node on a cycle cannot use the block policy").WithField("policy").WithNode(n.GetID()))
+		return
+	}
+	if err := mailbox.Configure(capacity, policy); err != nil {
+		cmd.AppendError(command.Errorf(command.INVALID_ARGUMENT, "%v", err).WithNode(n.GetID()))
+	}
+	cmd.Data = mailbox.ToJSONStruct()
+}
+
+//
+// Dead Letter
+//
+
+func replayDeadLetters(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.ReplayDeadLetters)
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
+
+	deadLetter, ok := n.(*node.DeadLetter)
+	if !ok {
+		cmd.AppendError(typeMismatch(cmd, n))
+		return
+	}
+	cmd.Data = deadLetter.Replay(cmd, tree.GetNodeByNameOrID)
+}
+
+func getDeadLetters(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.GetDeadLetters)
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
+
+	deadLetter, ok := n.(*node.DeadLetter)
+	if !ok {
+		cmd.AppendError(typeMismatch(cmd, n))
+		return
+	}
+
+	letters, total := deadLetter.PageLetters(cmd.Offset, cmd.Limit)
+	cmd.Data = map[string]interface{}{
+		"letters": letters,
+		"offset":  cmd.Offset,
+		"total":   total,
+	}
+}
+
+//
+// Publisher
+//
+
+func addSubscriber(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.AddSubscriber)
+	tree.DispatchMu.RLock()
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	tree.DispatchMu.RUnlock()
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
+	publisher, ok := n.(*node.Publisher)
+	if !ok {
+		cmd.AppendError(typeMismatch(cmd, n))
+		return
+	}
+	publisher.AddSubscriber(cmd)
+}
+
+func updatePublisher(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.UpdatePublisher)
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
+	publisher, ok := n.(*node.Publisher)
+	if !ok {
+		cmd.AppendError(typeMismatch(cmd, n))
+		return
+	}
+	publisher.UpdatePublisher(cmd)
+}
+
+//
+// Subscriber
+//
+
+func updateURL(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.UpdateURL)
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
+	subscriber, ok := n.(*node.Subscriber)
+	if !ok {
+		cmd.AppendError(typeMismatch(cmd, n))
+		return
+	}
+	subscriber.UpdateURL(cmd)
+}
+
+func activateWS(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.ActivateWS)
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
+	subscriber, ok := n.(*node.Subscriber)
+	if !ok {
+		cmd.AppendError(typeMismatch(cmd, n))
+		return
+	}
+	subscriber.ActivateWS(cmd)
+}
+
+func deactivateWS(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.DeactivateWS)
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
+	subscriber, ok := n.(*node.Subscriber)
+	if !ok {
+		cmd.AppendError(typeMismatch(cmd, n))
+		return
+	}
+	subscriber.DeactivateWS(cmd)
+}
+
+//
+// Mongo
+//
+
+func connectMongo(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.ConnectMongo)
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
+	mongo, ok := n.(*node.Mongo)
+	if !ok {
+		cmd.AppendError(typeMismatch(cmd, n))
+		return
+	}
+	mongo.Connect(cmd)
+}
+
+func addMongo(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.AddMongo)
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
+	mongo, ok := n.(*node.Mongo)
+	if !ok {
+		cmd.AppendError(typeMismatch(cmd, n))
+		return
+	}
+	mongo.Add(cmd)
+}
+
+func updateMongo(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.UpdateMongo)
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
+	mongo, ok := n.(*node.Mongo)
+	if !ok {
+		cmd.AppendError(typeMismatch(cmd, n))
+		return
+	}
+	mongo.Update(cmd)
+}
+
+func updateByIDMongo(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.UpdateByIDMongo)
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
+	mongo, ok := n.(*node.Mongo)
+	if !ok {
+		cmd.AppendError(typeMismatch(cmd, n))
+		return
+	}
+	mongo.UpdateByID(cmd)
+}
+
+func removeMongo(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.RemoveMongo)
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
+	mongo, ok := n.(*node.Mongo)
+	if !ok {
+		cmd.AppendError(typeMismatch(cmd, n))
+		return
+	}
+	mongo.Remove(cmd)
+}
+
+func removeByIDMongo(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.RemoveByIDMongo)
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
+	mongo, ok := n.(*node.Mongo)
+	if !ok {
+		cmd.AppendError(typeMismatch(cmd, n))
+		return
+	}
+	mongo.RemoveByID(cmd)
+}
+
+func queryAllMongo(tree *tree.Tree, c command.Command, options ...interface{}) {
+	cmd := c.(*command.QueryAllMongo)
+	n, err := tree.GetNodeByNameOrID(cmd.Node)
+	if err != nil {
+		cmd.AppendError(command.AsError(err).WithField("node"))
+		return
+	}
+	mongo, ok := n.(*node.Mongo)
+	if !ok {
+		cmd.AppendError(typeMismatch(cmd, n))
+		return
+	}
+	mongo.QueryAll(cmd)
+}
+
+func getChainPipeline(tree *tree.Tree, nameOrID string) (*pipeline.ChainPipeline, error) {
+	p, err := tree.GetPipelineByNameOrID(nameOrID)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, ok := p.(*pipeline.ChainPipeline)
+	if !ok {
+		return nil, command.Errorf(command.TYPE_MISMATCH, "pipeline is not a chain pipeline").WithPipeline(p.GetID())
+	}
+	return chain, nil
+}
+
+// typeMismatch reports a node that does not accept the command's
+// action.
+func typeMismatch(cmd command.Command, n node.Node) error {
+	err := command.Errorf(command.TYPE_MISMATCH, "node %s of type %s does not accept %s", n.GetName(), n.GetType(), cmd.GetAction())
+	return err.WithField("node").WithNode(n.GetID())
+}
+
+// routesCycle reports whether routing errors to any of routes from
+// any of senders would close a cycle.
+func routesCycle(tree *tree.Tree, routes []node.Node, senders []node.Node) bool {
+	for _, route := range routes {
+		for _, sender := range senders {
+			if tree.Reaches(route, sender) {
+				return true
+			}
 		}
-	case *command.QueryAllMongo:
-		n, err := tree.GetNodeByNameOrID(cmd.Node)
-		if err != nil {
-			cmd.AppendError(err)
-			return cmd
+	}
+	return false
+}
+
+// blockingCycle returns a node using the block mailbox policy on a
+// cycle that routing to any of routes from any of senders would close.
+// Two blocking workers on a cycle can each wait for room in the other's
+// full mailbox and never resume, so the nodes of an allowed cycle must
+// drop instead.
+func blockingCycle(tree *tree.Tree, routes []node.Node, senders []node.Node) node.Node {
+	for _, sender := range senders {
+		ancestors := map[node.Node]struct{}{sender: {}}
+		for _, n := range tree.GetAncestors(sender) {
+			ancestors[n] = struct{}{}
+		}
+		for _, route := range routes {
+			for _, n := range append([]node.Node{route}, tree.GetDescendants(route)...) {
+				if _, ok := ancestors[n]; ok && blocks(n) {
+					return n
+				}
+			}
 		}
-		if mongo, ok := n.(*node.Mongo); ok {
-			mongo.QueryAll(cmd)
+	}
+	return nil
+}
+
+// onCycle reports whether a node can reach itself.
+func onCycle(tree *tree.Tree, n node.Node) bool {
+	for _, descendant := range tree.GetDescendants(n) {
+		if descendant == n {
+			return true
 		}
 	}
+	return false
+}
 
-	return cmd
+func blocks(n node.Node) bool {
+	mailbox := n.GetMailbox()
+	if mailbox == nil {
+		return false
+	}
+	_, policy := mailbox.Config()
+	return policy == node.MAILBOX_BLOCK
+}
+
+func cycleBlocks(n node.Node, field string) error {
+	err := command.Errorf(command.FAILED_PRECONDITION, "node %s on the cycle uses the block mailbox policy", n.GetName())
+	return err.WithField(field).WithNode(n.GetID())
+}
+
+// stageCycle reports a stage whose error routes would close a cycle
+// through the nodes using the chain.
+func stageCycle(stage pipeline.Pipeline, field string) error {
+	return command.Errorf(command.FAILED_PRECONDITION, "error route of stage would create a cycle").WithField(field).WithPipeline(stage.GetID())
+}
+
+// pipelineTypeMismatch reports a pipeline that does not accept the
+// command's action.
+func pipelineTypeMismatch(cmd command.Command, p pipeline.Pipeline) error {
+	err := command.Errorf(command.TYPE_MISMATCH, "pipeline %s of type %s does not accept %s", p.GetName(), p.GetType(), cmd.GetAction())
+	return err.WithField("name").WithPipeline(p.GetID())
+}
+
+// pipelineError reports a pipeline rejecting an update as an invalid
+// argument.
+func pipelineError(err error, field string, p pipeline.Pipeline) error {
+	if err == nil {
+		return nil
+	}
+	return command.Errorf(command.INVALID_ARGUMENT, "%v", err).WithField(field).WithPipeline(p.GetID())
 }
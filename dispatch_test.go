@@ -8,6 +8,8 @@ import (
 	"testing"
 
 	"github.com/thinksystemio/package-flow/command"
+	"github.com/thinksystemio/package-flow/node"
+	"github.com/thinksystemio/package-flow/pipeline"
 	"github.com/thinksystemio/package-flow/tree"
 )
 
@@ -34,6 +36,25 @@ func AddChild(parent string, child string, pipeline string) []byte {
 	return JSON
 }
 
+func RemoveNode(node string) []byte {
+	data := TestingDoc{
+		"action": command.REMOVE_NODE,
+		"node":   node,
+	}
+	JSON, _ := json.Marshal(data)
+	return JSON
+}
+
+func RemoveChild(parent string, child string) []byte {
+	data := TestingDoc{
+		"action": command.REMOVE_CHILD,
+		"parent": parent,
+		"child":  child,
+	}
+	JSON, _ := json.Marshal(data)
+	return JSON
+}
+
 func CreatePipeline(name string, pipelineType string) []byte {
 	data := TestingDoc{
 		"action": command.CREATE_PIPELINE,
@@ -54,6 +75,17 @@ func UpdateFilterPipeline(name string, filter map[string]struct{}) []byte {
 	return JSON
 }
 
+func ChainStage(action string, name string, stage string, index int) []byte {
+	data := TestingDoc{
+		"action": action,
+		"name":   name,
+		"stage":  stage,
+		"index":  index,
+	}
+	JSON, _ := json.Marshal(data)
+	return JSON
+}
+
 func ActivateNode(node string, pipelineType string) []byte {
 	data := TestingDoc{
 		"action": command.ACTIVATE_NODE,
@@ -188,3 +220,555 @@ func TestTree(t *testing.T) {
 
 	http.ListenAndServe(":8082", mux)
 }
+
+func TestRemoveNode(t *testing.T) {
+	tree := tree.NewTree()
+
+	DispatchFromJSON(tree, CreateNode("node_parent", "base"))
+	DispatchFromJSON(tree, CreateNode("node_child", "base"))
+	DispatchFromJSON(tree, CreateNode("node_grandchild", "publisher"))
+	DispatchFromJSON(tree, CreatePipeline("pipe_base", "base"))
+	DispatchFromJSON(tree, CreatePipeline("pipe_shared", "base"))
+	DispatchFromJSON(tree, AddChild("node_parent", "node_child", "pipe_base"))
+	DispatchFromJSON(tree, AddChild("node_child", "node_grandchild", "pipe_base"))
+	DispatchFromJSON(tree, AddChild("node_parent", "node_grandchild", "pipe_shared"))
+
+	parent, _ := tree.GetNodeByNameOrID("node_parent")
+	child, _ := tree.GetNodeByNameOrID("node_child")
+
+	if cmd := DispatchFromJSON(tree, RemoveChild("node_child", "node_parent")); !cmd.HasErrors() {
+		t.Error("remove_child should fail when the edge does not exist")
+	}
+
+	if cmd := DispatchFromJSON(tree, RemoveNode("node_child")); cmd.HasErrors() {
+		t.Errorf("remove_node returned errors: %v", cmd.GetErrors())
+	}
+
+	if _, err := tree.GetNodeByNameOrID("node_child"); err == nil {
+		t.Error("node_child should no longer be in the tree")
+	}
+	if parent.HasChild(child) {
+		t.Error("node_parent should no longer point at node_child")
+	}
+	if len(child.GetChildren()) != 0 {
+		t.Error("node_child should no longer have children")
+	}
+	if p, _ := tree.GetPipelineByNameOrID("pipe_base"); p != nil {
+		t.Error("pipe_base was only used by node_child and should be removed")
+	}
+	if p, _ := tree.GetPipelineByNameOrID("pipe_shared"); p == nil {
+		t.Error("pipe_shared is still used and should be kept")
+	}
+
+	if cmd := DispatchFromJSON(tree, RemoveNode("node_child")); !cmd.HasErrors() {
+		t.Error("remove_node should fail for a missing node")
+	}
+}
+
+func TestRemoveChild(t *testing.T) {
+	tree := tree.NewTree()
+
+	DispatchFromJSON(tree, CreateNode("node_parent", "base"))
+	DispatchFromJSON(tree, CreateNode("node_child", "base"))
+	DispatchFromJSON(tree, CreatePipeline("pipe_base", "base"))
+	DispatchFromJSON(tree, AddChild("node_parent", "node_child", "pipe_base"))
+
+	if cmd := DispatchFromJSON(tree, RemoveChild("node_parent", "node_child")); cmd.HasErrors() {
+		t.Errorf("remove_child returned errors: %v", cmd.GetErrors())
+	}
+
+	parent, _ := tree.GetNodeByNameOrID("node_parent")
+	child, _ := tree.GetNodeByNameOrID("node_child")
+	if parent.HasChild(child) {
+		t.Error("node_parent should no longer point at node_child")
+	}
+	if child == nil {
+		t.Error("node_child should still be in the tree")
+	}
+}
+
+func TestAddChildSharesPipeline(t *testing.T) {
+	tree := tree.NewTree()
+
+	DispatchFromJSON(tree, CreateNode("node_parent", "base"))
+	DispatchFromJSON(tree, CreateNode("node_first", "base"))
+	DispatchFromJSON(tree, CreateNode("node_second", "base"))
+
+	if cmd := DispatchFromJSON(tree, AddChild("node_parent", "node_first", "pipe_filter")); !cmd.HasErrors() {
+		t.Error("add_child should fail for a pipeline that does not exist")
+	}
+
+	DispatchFromJSON(tree, CreatePipeline("pipe_filter", "filter"))
+	DispatchFromJSON(tree, AddChild("node_parent", "node_first", "pipe_filter"))
+	DispatchFromJSON(tree, AddChild("node_parent", "node_second", "pipe_filter"))
+	DispatchFromJSON(tree, UpdateFilterPipeline("pipe_filter", map[string]struct{}{"a": {}}))
+
+	if len(tree.Pipelines) != 1 {
+		t.Errorf("add_child should not create pipelines, tree has %d", len(tree.Pipelines))
+	}
+
+	parent, _ := tree.GetNodeByNameOrID("node_parent")
+	filter, _ := tree.GetPipelineByNameOrID("pipe_filter")
+	for child, pipe := range parent.GetChildren() {
+		if pipe != filter {
+			t.Errorf("edge to %s should use pipe_filter", child.GetName())
+		}
+	}
+	if paths := filter.(*pipeline.FilterPipeline).Filter; len(paths) != 1 || paths[0] != "a" {
+		t.Error("pipe_filter should have been updated")
+	}
+
+	data := TestingDoc{
+		"action":        command.ADD_CHILD,
+		"parent":        "node_first",
+		"child":         "node_second",
+		"pipeline":      "pipe_created",
+		"create":        true,
+		"pipeline_type": "filter",
+	}
+	JSON, _ := json.Marshal(data)
+	if cmd := DispatchFromJSON(tree, JSON); cmd.HasErrors() {
+		t.Errorf("add_child with create returned errors: %v", cmd.GetErrors())
+	}
+	if p, _ := tree.GetPipelineByNameOrID("pipe_created"); p == nil || p.GetType() != "filter" {
+		t.Error("add_child with create should register a filter pipeline")
+	}
+}
+
+func TestChainPipeline(t *testing.T) {
+	tree := tree.NewTree()
+
+	DispatchFromJSON(tree, CreatePipeline("pipe_chain", "chain"))
+	DispatchFromJSON(tree, CreatePipeline("pipe_a", "filter"))
+	DispatchFromJSON(tree, CreatePipeline("pipe_b", "filter"))
+	DispatchFromJSON(tree, CreatePipeline("pipe_c", "base"))
+	DispatchFromJSON(tree, UpdateFilterPipeline("pipe_a", map[string]struct{}{"a": {}, "b": {}}))
+	DispatchFromJSON(tree, UpdateFilterPipeline("pipe_b", map[string]struct{}{"b": {}}))
+
+	commands := [][]byte{
+		ChainStage(command.INSERT_CHAIN_STAGE, "pipe_chain", "pipe_b", -1),
+		ChainStage(command.INSERT_CHAIN_STAGE, "pipe_chain", "pipe_c", -1),
+		ChainStage(command.INSERT_CHAIN_STAGE, "pipe_chain", "pipe_a", 0),
+		ChainStage(command.MOVE_CHAIN_STAGE, "pipe_chain", "pipe_c", 0),
+		ChainStage(command.REMOVE_CHAIN_STAGE, "pipe_chain", "pipe_c", 0),
+	}
+	for _, JSON := range commands {
+		if cmd := DispatchFromJSON(tree, JSON); cmd.HasErrors() {
+			t.Fatalf("%s returned errors: %v", cmd.GetAction(), cmd.GetErrors())
+		}
+	}
+
+	if cmd := DispatchFromJSON(tree, ChainStage(command.INSERT_CHAIN_STAGE, "pipe_chain", "pipe_chain", 0)); !cmd.HasErrors() {
+		t.Error("a chain should not be a stage of itself")
+	}
+
+	p, _ := tree.GetPipelineByNameOrID("pipe_chain")
+	JSON, _ := p.ToJSON()
+	s := struct {
+		Stages []struct {
+			Name string `json:"name"`
+		} `json:"stages"`
+	}{}
+	json.Unmarshal(JSON, &s)
+	if len(s.Stages) != 2 || s.Stages[0].Name != "pipe_a" || s.Stages[1].Name != "pipe_b" {
+		t.Errorf("chain should serialize stages pipe_a, pipe_b: %s", JSON)
+	}
+
+	cmd := &command.BaseCommand{Data: map[string]interface{}{"a": 1, "b": 2, "c": 3}}
+	p.Apply(cmd)
+	if data := cmd.GetData().(map[string]interface{}); len(data) != 1 || data["b"] != 2 {
+		t.Errorf("chain should apply every stage in order, got %v", data)
+	}
+}
+
+func TestSchemaPipelineErrorChild(t *testing.T) {
+	tree := tree.NewTree()
+
+	for _, JSON := range [][]byte{
+		CreateNode("source", "base"),
+		CreateNode("sink", "base"),
+		CreateNode("dead", "base"),
+		CreatePipeline("schema", "schema"),
+		[]byte(`{"action":"update_schema_pipeline","name":"schema","schema":{"required":["id"]},"error_child":"dead"}`),
+		AddChild("source", "sink", "schema"),
+	} {
+		if cmd := DispatchFromJSON(tree, JSON); cmd.HasErrors() {
+			t.Fatalf("%s returned errors: %v", JSON, cmd.GetErrors())
+		}
+	}
+
+	p, _ := tree.GetPipelineByNameOrID("schema")
+	schema := p.(*pipeline.SchemaPipeline)
+	dead, _ := tree.GetNodeByNameOrID("dead")
+	if schema.GetErrorChild() != dead.GetID() {
+		t.Fatalf("error child is %s", schema.GetErrorChild())
+	}
+
+	// the error child is a child of every node sending through the
+	// pipeline, so edges back to them are cycles
+	source, _ := tree.GetNodeByNameOrID("source")
+	if parents := tree.GetParents(dead); len(parents) != 1 || parents[0] != source {
+		t.Errorf("parents of the error child are %v", parents)
+	}
+	for _, JSON := range [][]byte{
+		AddChild("dead", "source", "pipe"),
+		[]byte(`{"action":"update_schema_pipeline","name":"schema","schema":{},"error_child":"source"}`),
+	} {
+		errs := DispatchFromJSON(tree, JSON).GetErrors()
+		if len(errs) != 1 || errs[0].Code != command.FAILED_PRECONDITION {
+			t.Errorf("%s returned %+v", JSON, errs)
+		}
+	}
+	if err := tree.WalkTopological(func(node.Node) bool { return true }); err != nil {
+		t.Error(err)
+	}
+
+	// removing the error child clears the reference
+	DispatchFromJSON(tree, RemoveNode("dead"))
+	if schema.GetErrorChild() != "" {
+		t.Errorf("error child is still %s", schema.GetErrorChild())
+	}
+
+	cmd := DispatchFromJSON(tree, []byte(`{"action":"update_schema_pipeline","name":"schema","schema":{},"error_child":"missing"}`))
+	if !cmd.HasErrors() {
+		t.Error("expected an error for a missing error child")
+	}
+}
+
+func TestErrorChild(t *testing.T) {
+	tree := tree.NewTree()
+
+	for _, JSON := range [][]byte{
+		CreateNode("source", "base"),
+		CreateNode("dead", "deadletter"),
+		[]byte(`{"action":"add_error_child","parent":"source","child":"dead"}`),
+	} {
+		if cmd := DispatchFromJSON(tree, JSON); cmd.HasErrors() {
+			t.Fatalf("%s returned errors: %v", JSON, cmd.GetErrors())
+		}
+	}
+
+	source, _ := tree.GetNodeByNameOrID("source")
+	dead, _ := tree.GetNodeByNameOrID("dead")
+	if !source.HasErrorChild(dead) {
+		t.Fatal("dead is not an error child of source")
+	}
+
+	cmd := DispatchFromJSON(tree, []byte(`{"action":"replay_dead_letters","node":"source"}`))
+	if !cmd.HasErrors() {
+		t.Error("expected an error replaying a node that is not a dead letter node")
+	}
+
+	DispatchFromJSON(tree, RemoveNode("dead"))
+	if len(source.GetErrorChildren()) != 0 {
+		t.Errorf("source still has error children %v", source.GetErrorChildren())
+	}
+}
+
+func TestGetDeadLetters(t *testing.T) {
+	tree := tree.NewTree()
+
+	if cmd := DispatchFromJSON(tree, CreateNode("dead", "deadletter")); cmd.HasErrors() {
+		t.Fatalf("create returned errors: %v", cmd.GetErrors())
+	}
+	n, _ := tree.GetNodeByNameOrID("dead")
+	dead := n.(*node.DeadLetter)
+	for i := 0; i < 3; i++ {
+		dead.Receive(node.NewDeadLetterCommand("source", "", &command.BaseCommand{Action: "test", Data: fmt.Sprintf("secret-%d", i)}))
+	}
+
+	// client views count the letters without their data
+	for _, JSON := range [][]byte{
+		[]byte(`{"action":"get_node","node":"dead"}`),
+		[]byte(`{"action":"list_nodes"}`),
+		[]byte(`{"action":"get_tree"}`),
+	} {
+		data, _ := json.Marshal(DispatchFromJSON(tree, JSON).GetData())
+		if strings.Contains(string(data), "secret") || !strings.Contains(string(data), `"letter_count":3`) {
+			t.Errorf("%s returned %s", JSON, data)
+		}
+	}
+	if JSON, _ := tree.ToJSON(); !strings.Contains(string(JSON), "secret-2") {
+		t.Error("tree.ToJSON should keep the letters")
+	}
+
+	cmd := DispatchFromJSON(tree, []byte(`{"action":"get_dead_letters","node":"dead","offset":1,"limit":1}`))
+	if cmd.HasErrors() {
+		t.Fatalf("get_dead_letters returned errors: %v", cmd.GetErrors())
+	}
+	data := cmd.GetData().(map[string]interface{})
+	letters := data["letters"].([]node.Letter)
+	if len(letters) != 1 || letters[0].Data != "secret-1" || data["total"] != 3 {
+		t.Errorf("get_dead_letters returned %v", data)
+	}
+
+	errs := DispatchFromJSON(tree, []byte(`{"action":"get_dead_letters","node":"dead","offset":-1}`)).GetErrors()
+	if len(errs) != 1 || errs[0].Field != "offset" {
+		t.Errorf("expected an offset error, got %v", errs)
+	}
+}
+
+func TestAddChildCycle(t *testing.T) {
+	tree := tree.NewTree()
+
+	for _, JSON := range [][]byte{
+		CreateNode("a", "base"),
+		CreateNode("b", "base"),
+		CreateNode("c", "base"),
+		CreatePipeline("pipe", "base"),
+		AddChild("a", "b", "pipe"),
+		AddChild("b", "c", "pipe"),
+	} {
+		if cmd := DispatchFromJSON(tree, JSON); cmd.HasErrors() {
+			t.Fatalf("%s returned errors: %v", JSON, cmd.GetErrors())
+		}
+	}
+
+	for _, JSON := range [][]byte{
+		AddChild("c", "a", "pipe"),
+		AddChild("a", "a", "pipe"),
+		[]byte(`{"action":"add_error_child","parent":"c","child":"a"}`),
+	} {
+		if cmd := DispatchFromJSON(tree, JSON); !cmd.HasErrors() {
+			t.Errorf("%s: expected a cycle error", JSON)
+		}
+	}
+
+	// blocking mailboxes on the cycle could wait on each other
+	cycle := []byte(`{"action":"add_child","parent":"c","child":"a","pipeline":"pipe","allow_cycle":true}`)
+	if errs := DispatchFromJSON(tree, cycle).GetErrors(); len(errs) != 1 || errs[0].Code != command.FAILED_PRECONDITION {
+		t.Errorf("expected a FAILED_PRECONDITION error for blocking nodes, got %v", errs)
+	}
+
+	for _, name := range []string{"a", "b", "c"} {
+		JSON := []byte(`{"action":"update_mailbox","node":"` + name + `","policy":"drop_oldest"}`)
+		if cmd := DispatchFromJSON(tree, JSON); cmd.HasErrors() {
+			t.Fatalf("%s returned errors: %v", JSON, cmd.GetErrors())
+		}
+	}
+	if cmd := DispatchFromJSON(tree, cycle); cmd.HasErrors() {
+		t.Errorf("allowed cycle returned errors: %v", cmd.GetErrors())
+	}
+
+	block := []byte(`{"action":"update_mailbox","node":"b","policy":"block"}`)
+	if errs := DispatchFromJSON(tree, block).GetErrors(); len(errs) != 1 || errs[0].Code != command.FAILED_PRECONDITION || errs[0].Field != "policy" {
+		t.Errorf("expected a FAILED_PRECONDITION policy error, got %v", errs)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	tree := tree.NewTree()
+
+	for _, JSON := range [][]byte{
+		CreateNode("source", "base"),
+		CreateNode("sink", "base"),
+		CreateNode("dead", "deadletter"),
+		CreatePipeline("pipe", "filter"),
+		AddChild("source", "sink", "pipe"),
+		[]byte(`{"action":"add_error_child","parent":"source","child":"dead"}`),
+		DeactivateNode("sink", "base"),
+	} {
+		if cmd := DispatchFromJSON(tree, JSON); cmd.HasErrors() {
+			t.Fatalf("%s returned errors: %v", JSON, cmd.GetErrors())
+		}
+	}
+
+	cmd := DispatchFromJSON(tree, []byte(`{"action":"list_nodes","active":true,"prefix":"s"}`))
+	if cmd.HasErrors() {
+		t.Fatalf("list_nodes returned errors: %v", cmd.GetErrors())
+	}
+	JSON, _ := json.Marshal(cmd.GetData())
+	if !strings.Contains(string(JSON), `"name":"source"`) || strings.Contains(string(JSON), `"name":"sink"`) {
+		t.Errorf("list_nodes returned %s", JSON)
+	}
+
+	cmd = DispatchFromJSON(tree, []byte(`{"action":"get_children","node":"source"}`))
+	JSON, _ = json.Marshal(cmd.GetData())
+	sink, _ := tree.GetNodeByNameOrID("sink")
+	pipe, _ := tree.GetPipelineByNameOrID("pipe")
+	if !strings.Contains(string(JSON), `"name":"dead","type":"deadletter","error":true`) ||
+		!strings.Contains(string(JSON), fmt.Sprintf(`"id":"%s","name":"sink","type":"base","pipeline":"%s"`, sink.GetID(), pipe.GetID())) {
+		t.Errorf("get_children returned %s", JSON)
+	}
+
+	cmd = DispatchFromJSON(tree, []byte(`{"action":"get_parents","node":"dead"}`))
+	JSON, _ = json.Marshal(cmd.GetData())
+	if !strings.Contains(string(JSON), `"name":"source"`) {
+		t.Errorf("get_parents returned %s", JSON)
+	}
+
+	cmd = DispatchFromJSON(tree, []byte(`{"action":"list_pipelines","type":"filter"}`))
+	JSON, _ = json.Marshal(cmd.GetData())
+	if !strings.Contains(string(JSON), `"name":"pipe"`) {
+		t.Errorf("list_pipelines returned %s", JSON)
+	}
+
+	DispatchFromJSON(tree, CreatePipeline("redact", "redact"))
+	DispatchFromJSON(tree, []byte(`{"action":"update_redact_pipeline","name":"redact","rules":[{"op":"hash","path":"email","salt":"pepper"}]}`))
+	for _, JSON := range [][]byte{
+		[]byte(`{"action":"get_pipeline","pipeline":"redact"}`),
+		[]byte(`{"action":"list_pipelines","type":"redact"}`),
+		[]byte(`{"action":"get_tree"}`),
+	} {
+		data, _ := json.Marshal(DispatchFromJSON(tree, JSON).GetData())
+		if !strings.Contains(string(data), `"op":"hash"`) || strings.Contains(string(data), "pepper") {
+			t.Errorf("%s returned %s", JSON, data)
+		}
+	}
+	if snapshot, _ := tree.ToJSON(); !strings.Contains(string(snapshot), `"salt":"pepper"`) {
+		t.Error("snapshot lost the redact salt")
+	}
+
+	for _, JSON := range [][]byte{
+		[]byte(`{"action":"get_node","node":"missing"}`),
+		[]byte(`{"action":"get_pipeline","pipeline":"missing"}`),
+		[]byte(`{"action":"get_children"}`),
+	} {
+		if cmd := DispatchFromJSON(tree, JSON); !cmd.HasErrors() {
+			t.Errorf("%s: expected an error", JSON)
+		}
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	tree := tree.NewTree()
+	DispatchFromJSON(tree, CreateNode("source", "base"))
+	DispatchFromJSON(tree, CreatePipeline("chain", "chain"))
+	DispatchFromJSON(tree, CreateNode("store", "mongo"))
+	source, _ := tree.GetNodeByNameOrID("source")
+	store, _ := tree.GetNodeByNameOrID("store")
+
+	for _, test := range []struct {
+		JSON  []byte
+		Code  string
+		Field string
+		Node  string
+	}{
+		{CreateNode("source", "base"), command.ALREADY_EXISTS, "name", source.GetID()},
+		{[]byte(`{"action":"create_node","name":"sink"}`), command.INVALID_ARGUMENT, "type", ""},
+		{[]byte(`{"action":"create_node","name":1}`), command.INVALID_ARGUMENT, "name", ""},
+		{AddChild("missing", "source", "chain"), command.NOT_FOUND, "parent", ""},
+		{AddChild("source", "source", "chain"), command.FAILED_PRECONDITION, "child", source.GetID()},
+		{[]byte(`{"action":"replay_dead_letters","node":"source"}`), command.TYPE_MISMATCH, "node", source.GetID()},
+		{[]byte(`{"action":"unknown"}`), command.INVALID_ARGUMENT, "action", ""},
+		{AddMongo("store", map[string]interface{}{"a": 1}), command.FAILED_PRECONDITION, "", store.GetID()},
+		{QueryAllMongo("store"), command.FAILED_PRECONDITION, "", store.GetID()},
+	} {
+		errs := DispatchFromJSON(tree, test.JSON).GetErrors()
+		if len(errs) == 0 {
+			t.Errorf("%s: expected an error", test.JSON)
+			continue
+		}
+		if errs[0].Code != test.Code || errs[0].Field != test.Field || errs[0].Node != test.Node {
+			t.Errorf("%s: got %+v", test.JSON, errs[0])
+		}
+	}
+
+	legacy := command.Error{}
+	if err := json.Unmarshal([]byte(`{"errors":"insert failed"}`), &legacy); err != nil || legacy.Message != "insert failed" || legacy.Code != command.UNKNOWN {
+		t.Errorf("legacy error decoded as %+v, %v", legacy, err)
+	}
+}
+
+func TestTypeMismatch(t *testing.T) {
+	tree := tree.NewTree()
+
+	actions := map[string]string{
+		command.CONNECT_MONGO:       `"url":"localhost"`,
+		command.ADD_MONGO:           `"document":{}`,
+		command.UPDATE_MONGO:        `"document":{},"filter":{}`,
+		command.UPDATE_BY_ID_MONGO:  `"id":"1","document":{}`,
+		command.REMOVE_MONGO:        `"filter":{}`,
+		command.REMOVE_BY_ID_MONGO:  `"id":"1"`,
+		command.QUERY_ALL_MONGO:     ``,
+		command.UPDATE_PUBLISHER:    `"include_metadata":true`,
+		command.UPDATE_URL:          `"url":"ws://localhost:8080"`,
+		command.ACTIVATE_WS:         ``,
+		command.DECTIVATE_WS:        ``,
+		command.REPLAY_DEAD_LETTERS: `"limit":0`,
+		command.GET_DEAD_LETTERS:    `"offset":0`,
+	}
+
+	for _, nodeType := range []string{"base", "publisher", "subscriber", "mongo", "deadletter"} {
+		name := "node_" + nodeType
+		if cmd := DispatchFromJSON(tree, CreateNode(name, nodeType)); cmd.HasErrors() {
+			t.Fatalf("create %s returned errors: %v", nodeType, cmd.GetErrors())
+		}
+		n, _ := tree.GetNodeByNameOrID(name)
+
+		accepted := map[string]bool{}
+		for _, action := range n.Capabilities() {
+			accepted[action] = true
+		}
+
+		for action, fields := range actions {
+			if accepted[action] {
+				continue
+			}
+			JSON := fmt.Sprintf(`{"action":"%s","node":"%s"`, action, name)
+			if fields != "" {
+				JSON += "," + fields
+			}
+			JSON += "}"
+			errs := DispatchFromJSON(tree, []byte(JSON)).GetErrors()
+			if len(errs) != 1 || errs[0].Code != command.TYPE_MISMATCH || errs[0].Node != n.GetID() {
+				t.Errorf("%s on %s returned %+v", action, nodeType, errs)
+			}
+		}
+	}
+
+	DispatchFromJSON(tree, CreatePipeline("pipe_base", "base"))
+	p, _ := tree.GetPipelineByNameOrID("pipe_base")
+	errs := DispatchFromJSON(tree, []byte(`{"action":"update_filter_pipeline","name":"pipe_base","filter":["a"]}`)).GetErrors()
+	if len(errs) != 1 || errs[0].Code != command.TYPE_MISMATCH || errs[0].Field != "name" || errs[0].Pipeline != p.GetID() {
+		t.Errorf("update_filter_pipeline on a base pipeline returned %+v", errs)
+	}
+}
+
+func TestClientMetadataIgnored(t *testing.T) {
+	tree := tree.NewTree()
+
+	cmd := DispatchFromJSON(tree, []byte(`{"action":"get_tree","metadata":{"trace_id":"forged","origin":"forged","hops":-100,"max_hops":1000000000}}`))
+	if cmd.HasErrors() {
+		t.Fatalf("get_tree returned errors: %v", cmd.GetErrors())
+	}
+	metadata := cmd.GetMetadata()
+	if metadata.MaxHops != 0 || metadata.Hops != 0 || metadata.TraceID == "forged" || metadata.Origin != "" {
+		t.Errorf("client metadata was kept: %+v", metadata)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	tree := tree.NewTree()
+	DispatchFromJSON(tree, CreateNode("subscriber", "subscriber"))
+
+	for _, test := range []struct {
+		JSON  []byte
+		Field string
+	}{
+		{[]byte(`{"action":"update_url","node":"subscriber"}`), "url"},
+		{[]byte(`{"action":"update_url","url":"ws://localhost:8080"}`), "node"},
+		{UpdateURL("subscriber", "localhost:8080"), "url"},
+		{UpdateURL("subscriber", "ftp://localhost:8080"), "url"},
+		{[]byte(`{"action":"activate_ws"}`), "node"},
+		{ConnectMongo("subscriber", "mongodb://localhost:27017"), "url"},
+		{[]byte(`{"action":"update_wasm_pipeline","name":"pipe","module":"AGFzbQEAAAA=","memory_pages":70000}`), "memory_pages"},
+		{CreateNode("sink", "unknown"), "type"},
+		{CreatePipeline("pipe", "unknown"), "type"},
+		{[]byte(`{"action":"add_child","parent":"a","child":"b","pipeline":"p","pipeline_type":"unknown"}`), "pipeline_type"},
+		{[]byte(`{"action":"update_mailbox","node":"subscriber","policy":"drop_all"}`), "policy"},
+		{[]byte(`{"action":"update_filter_pipeline","name":"pipe","filter":[],"mode":"only"}`), "mode"},
+	} {
+		errs := DispatchFromJSON(tree, test.JSON).GetErrors()
+		if len(errs) != 1 || errs[0].Code != command.INVALID_ARGUMENT || errs[0].Field != test.Field {
+			t.Errorf("%s: got %+v", test.JSON, errs)
+		}
+	}
+
+	if cmd := DispatchFromJSON(tree, UpdateURL("subscriber", "ws://localhost:8080")); cmd.HasErrors() {
+		t.Errorf("valid update_url returned errors: %v", cmd.GetErrors())
+	}
+	if _, err := tree.GetNodeByNameOrID("sink"); err == nil {
+		t.Error("node of an unknown type was created")
+	}
+}
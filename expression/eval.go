@@ -0,0 +1,393 @@
+package expression
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type node interface {
+	eval(lookup func(string) (interface{}, bool)) (interface{}, error)
+}
+
+type literal struct {
+	value interface{}
+}
+
+func (n *literal) eval(lookup func(string) (interface{}, bool)) (interface{}, error) {
+	return n.value, nil
+}
+
+type field struct {
+	path string
+}
+
+func (n *field) eval(lookup func(string) (interface{}, bool)) (interface{}, error) {
+	value, _ := lookup(n.path)
+	return normalize(value), nil
+}
+
+type unary struct {
+	op      string
+	operand node
+}
+
+func (n *unary) eval(lookup func(string) (interface{}, bool)) (interface{}, error) {
+	value, err := n.operand.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.op == "!" {
+		return !truthy(value), nil
+	}
+
+	number, ok := value.(float64)
+	if !ok {
+		return nil, fmt.Errorf("cannot negate %v", value)
+	}
+	return -number, nil
+}
+
+type binary struct {
+	op          string
+	left, right node
+}
+
+func (n *binary) eval(lookup func(string) (interface{}, bool)) (interface{}, error) {
+	left, err := n.left.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	// && and || short circuit and return booleans.
+	switch n.op {
+	case "&&":
+		if !truthy(left) {
+			return false, nil
+		}
+		right, err := n.right.eval(lookup)
+		return truthy(right), err
+	case "||":
+		if truthy(left) {
+			return true, nil
+		}
+		right, err := n.right.eval(lookup)
+		return truthy(right), err
+	}
+
+	right, err := n.right.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "+":
+		_, leftString := left.(string)
+		_, rightString := right.(string)
+		if leftString || rightString {
+			if left == nil || right == nil {
+				return nil, fmt.Errorf("cannot add %v and %v", left, right)
+			}
+			return toString(left) + toString(right), nil
+		}
+	case "<", "<=", ">", ">=":
+		if a, ok := left.(string); ok {
+			b, ok := right.(string)
+			if !ok {
+				return nil, fmt.Errorf("cannot compare %v and %v", left, right)
+			}
+			return compareResult(n.op, strings.Compare(a, b)), nil
+		}
+	}
+
+	a, aok := left.(float64)
+	b, bok := right.(float64)
+	if !aok || !bok {
+		return nil, fmt.Errorf("operator %s needs numbers, got %v and %v", n.op, left, right)
+	}
+
+	switch n.op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return a / b, nil
+	case "%":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return math.Mod(a, b), nil
+	default:
+		result := 0
+		if a < b {
+			result = -1
+		} else if a > b {
+			result = 1
+		}
+		return compareResult(n.op, result), nil
+	}
+}
+
+type conditional struct {
+	cond, then, otherwise node
+}
+
+func (n *conditional) eval(lookup func(string) (interface{}, bool)) (interface{}, error) {
+	cond, err := n.cond.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+	if truthy(cond) {
+		return n.then.eval(lookup)
+	}
+	return n.otherwise.eval(lookup)
+}
+
+type call struct {
+	name string
+	fn   function
+	args []node
+}
+
+func (n *call) eval(lookup func(string) (interface{}, bool)) (interface{}, error) {
+	args := make([]interface{}, 0, len(n.args))
+	for _, arg := range n.args {
+		value, err := arg.eval(lookup)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value)
+	}
+
+	result, err := n.fn.call(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", n.name, err)
+	}
+	return result, nil
+}
+
+//
+// Functions
+//
+
+type function struct {
+	min, max int
+	call     func(args []interface{}) (interface{}, error)
+}
+
+// functions are the only operations an expression can perform beyond
+// arithmetic. None of them have side effects.
+var functions = map[string]function{
+	"upper": {1, 1, stringFunction(strings.ToUpper)},
+	"lower": {1, 1, stringFunction(strings.ToLower)},
+	"trim":  {1, 1, stringFunction(strings.TrimSpace)},
+	"len": {1, 1, func(args []interface{}) (interface{}, error) {
+		switch v := args[0].(type) {
+		case string:
+			return float64(len([]rune(v))), nil
+		case nil:
+			return float64(0), nil
+		}
+		value := reflect.ValueOf(args[0])
+		switch value.Kind() {
+		case reflect.Slice, reflect.Array, reflect.Map:
+			return float64(value.Len()), nil
+		}
+		return nil, fmt.Errorf("cannot take length of %v", args[0])
+	}},
+	"now": {0, 0, func(args []interface{}) (interface{}, error) {
+		return time.Now().UTC().Format(time.RFC3339Nano), nil
+	}},
+	"string": {1, 1, func(args []interface{}) (interface{}, error) {
+		return toString(args[0]), nil
+	}},
+	"number": {1, 1, func(args []interface{}) (interface{}, error) {
+		switch v := args[0].(type) {
+		case float64:
+			return v, nil
+		case string:
+			return strconv.ParseFloat(strings.TrimSpace(v), 64)
+		case bool:
+			if v {
+				return float64(1), nil
+			}
+			return float64(0), nil
+		}
+		return nil, fmt.Errorf("cannot convert %v to a number", args[0])
+	}},
+	"round": {1, 2, func(args []interface{}) (interface{}, error) {
+		x, ok := args[0].(float64)
+		if !ok {
+			return nil, fmt.Errorf("%v is not a number", args[0])
+		}
+		places := float64(0)
+		if len(args) == 2 {
+			if places, ok = args[1].(float64); !ok {
+				return nil, fmt.Errorf("%v is not a number", args[1])
+			}
+		}
+		scale := math.Pow(10, places)
+		return math.Round(x*scale) / scale, nil
+	}},
+	"floor": {1, 1, numberFunction(math.Floor)},
+	"ceil":  {1, 1, numberFunction(math.Ceil)},
+	"abs":   {1, 1, numberFunction(math.Abs)},
+	"min": {1, -1, func(args []interface{}) (interface{}, error) {
+		return reduceNumbers(args, math.Min)
+	}},
+	"max": {1, -1, func(args []interface{}) (interface{}, error) {
+		return reduceNumbers(args, math.Max)
+	}},
+	"coalesce": {1, -1, func(args []interface{}) (interface{}, error) {
+		for _, arg := range args {
+			if arg != nil {
+				return arg, nil
+			}
+		}
+		return nil, nil
+	}},
+	"contains": {2, 2, func(args []interface{}) (interface{}, error) {
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("%v is not a string", args[0])
+		}
+		return strings.Contains(s, toString(args[1])), nil
+	}},
+	"concat": {0, -1, func(args []interface{}) (interface{}, error) {
+		var sb strings.Builder
+		for _, arg := range args {
+			if arg != nil {
+				sb.WriteString(toString(arg))
+			}
+		}
+		return sb.String(), nil
+	}},
+}
+
+func stringFunction(fn func(string) string) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("%v is not a string", args[0])
+		}
+		return fn(s), nil
+	}
+}
+
+func numberFunction(fn func(float64) float64) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		x, ok := args[0].(float64)
+		if !ok {
+			return nil, fmt.Errorf("%v is not a number", args[0])
+		}
+		return fn(x), nil
+	}
+}
+
+func reduceNumbers(args []interface{}, fn func(float64, float64) float64) (interface{}, error) {
+	result, ok := args[0].(float64)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a number", args[0])
+	}
+	for _, arg := range args[1:] {
+		x, ok := arg.(float64)
+		if !ok {
+			return nil, fmt.Errorf("%v is not a number", arg)
+		}
+		result = fn(result, x)
+	}
+	return result, nil
+}
+
+//
+// Values
+//
+
+// normalize converts every Go number type to float64, the only number
+// type expressions work with.
+func normalize(v interface{}) interface{} {
+	switch value := v.(type) {
+	case int:
+		return float64(value)
+	case int8:
+		return float64(value)
+	case int16:
+		return float64(value)
+	case int32:
+		return float64(value)
+	case int64:
+		return float64(value)
+	case uint:
+		return float64(value)
+	case uint8:
+		return float64(value)
+	case uint16:
+		return float64(value)
+	case uint32:
+		return float64(value)
+	case uint64:
+		return float64(value)
+	case float32:
+		return float64(value)
+	}
+	return v
+}
+
+func truthy(v interface{}) bool {
+	switch value := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return value
+	case float64:
+		return value != 0
+	case string:
+		return value != ""
+	}
+	return true
+}
+
+func equal(a, b interface{}) bool {
+	return reflect.DeepEqual(normalize(a), normalize(b))
+}
+
+func toString(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	}
+	return fmt.Sprint(v)
+}
+
+func compareResult(op string, result int) bool {
+	switch op {
+	case "<":
+		return result < 0
+	case "<=":
+		return result <= 0
+	case ">":
+		return result > 0
+	default:
+		return result >= 0
+	}
+}
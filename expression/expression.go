@@ -0,0 +1,306 @@
+// Package expression is a small, sandboxed expression language for
+// computing fields from command data, for example
+//
+//	total = price * qty
+//	name = upper(first) + " " + last
+//	ts = now()
+//
+// Expressions can only read the data they are given and call the
+// built in functions, and they have no loops, so evaluation always
+// terminates. Source length and nesting depth are bounded at compile
+// time.
+package expression
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	MaxLength = 4096
+	MaxDepth  = 64
+)
+
+// Assignment is a compiled "target = expression" statement.
+type Assignment struct {
+	Source string
+	Target string
+	expr   node
+}
+
+// Compile parses a "target = expression" statement. The target is a
+// dot separated field path.
+func Compile(src string) (*Assignment, error) {
+	if len(src) > MaxLength {
+		return nil, fmt.Errorf("expression is longer than %d characters", MaxLength)
+	}
+
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) < 3 || tokens[0].kind != tokenIdent || tokens[1].text != "=" || tokens[1].kind != tokenOperator {
+		return nil, fmt.Errorf("expression must have the form field = expression")
+	}
+
+	p := &parser{tokens: tokens[2:]}
+	expr, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Assignment{Source: src, Target: tokens[0].text, expr: expr}, nil
+}
+
+// CompileExpression parses an expression without a target.
+func CompileExpression(src string) (*Assignment, error) {
+	if len(src) > MaxLength {
+		return nil, fmt.Errorf("expression is longer than %d characters", MaxLength)
+	}
+
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	expr, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Assignment{Source: src, expr: expr}, nil
+}
+
+// Eval evaluates the expression. Field paths are looked up with the
+// given function; a missing field evaluates to nil.
+func (assignment *Assignment) Eval(lookup func(path string) (interface{}, bool)) (interface{}, error) {
+	return assignment.expr.eval(lookup)
+}
+
+//
+// Parser
+//
+
+type parser struct {
+	tokens []token
+	pos    int
+	depth  int
+}
+
+func (p *parser) parse() (node, error) {
+	expr, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at %d", t.text, t.pos)
+	}
+	return expr, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokenOperator && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		return fmt.Errorf("expected %s at %d", op, t.pos)
+	}
+	return nil
+}
+
+func (p *parser) enter() error {
+	p.depth++
+	if p.depth > MaxDepth {
+		return fmt.Errorf("expression is nested deeper than %d", MaxDepth)
+	}
+	return nil
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+func (p *parser) ternary() (node, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	cond, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.accept("?") {
+		return cond, nil
+	}
+
+	then, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+
+	return &conditional{cond, then, otherwise}, nil
+}
+
+// precedence lists binary operators from loosest to tightest.
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *parser) binary(level int) (node, error) {
+	if level == len(precedence) {
+		return p.unary()
+	}
+
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t.kind != tokenOperator || !contains(precedence[level], t.text) {
+			return left, nil
+		}
+		p.next()
+
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{t.text, left, right}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	if p.accept("!") {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{"!", operand}, nil
+	}
+	if p.accept("-") {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{"-", operand}, nil
+	}
+
+	return p.primary()
+}
+
+func (p *parser) primary() (node, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokenNumber, tokenString:
+		return &literal{t.value}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return &literal{true}, nil
+		case "false":
+			return &literal{false}, nil
+		case "null", "nil":
+			return &literal{nil}, nil
+		}
+
+		if !p.accept("(") {
+			return &field{t.text}, nil
+		}
+
+		name := strings.ToLower(t.text)
+		fn, ok := functions[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown function %s at %d", t.text, t.pos)
+		}
+
+		args := []node{}
+		if !p.accept(")") {
+			for {
+				arg, err := p.ternary()
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, arg)
+
+				if p.accept(")") {
+					break
+				}
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if len(args) < fn.min || fn.max >= 0 && len(args) > fn.max {
+			return nil, fmt.Errorf("function %s called with %d arguments", name, len(args))
+		}
+		return &call{name, fn, args}, nil
+	case tokenOperator:
+		if t.text == "(" {
+			expr, err := p.ternary()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return expr, nil
+		}
+	case tokenEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	return nil, fmt.Errorf("unexpected %s at %d", t.text, t.pos)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package expression
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	data := map[string]interface{}{
+		"price": 2.5,
+		"qty":   4,
+		"first": "ada",
+		"last":  "Lovelace",
+		"tags":  []interface{}{"a", "b"},
+	}
+	lookup := func(path string) (interface{}, bool) {
+		v, ok := data[path]
+		return v, ok
+	}
+
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		{"price * qty", 10.0},
+		{"1 + 2 * 3", 7.0},
+		{"(1 + 2) * 3", 9.0},
+		{"-qty % 3", -1.0},
+		{`upper(first) + " " + last`, "ADA Lovelace"},
+		{"qty > 3 && price < 3", true},
+		{"!(qty == 4)", false},
+		{`qty >= 10 ? "bulk" : "single"`, "single"},
+		{"len(tags)", 2.0},
+		{"coalesce(missing, 'none')", "none"},
+		{"round(price / 3, 2)", 0.83},
+		{"max(qty, price, 1)", 4.0},
+		{`number("12") + 1`, 13.0},
+		{"missing == null", true},
+	}
+
+	for _, test := range tests {
+		expr, err := CompileExpression(test.src)
+		if err != nil {
+			t.Errorf("%s: %v", test.src, err)
+			continue
+		}
+		got, err := expr.Eval(lookup)
+		if err != nil {
+			t.Errorf("%s: %v", test.src, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s = %v, want %v", test.src, got, test.want)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	lookup := func(string) (interface{}, bool) { return nil, false }
+
+	for _, src := range []string{"1 / 0", "missing * 2", `upper(1)`, `"a" < 1`} {
+		expr, err := CompileExpression(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if _, err := expr.Eval(lookup); err == nil {
+			t.Errorf("%s: expected an error", src)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	assignment, err := Compile("order.total = price * qty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assignment.Target != "order.total" {
+		t.Errorf("target is %s", assignment.Target)
+	}
+
+	invalid := []string{
+		"price * qty",
+		"total = ",
+		"total = price *",
+		"total = (price",
+		"total = unknown(price)",
+		"total = upper(a, b)",
+		"total = 'open",
+		"total = price $ qty",
+		"total = " + strings.Repeat("(", MaxDepth+1) + "1" + strings.Repeat(")", MaxDepth+1),
+		"total = " + strings.Repeat("1+", MaxLength),
+	}
+	for _, src := range invalid {
+		if _, err := Compile(src); err == nil {
+			t.Errorf("%.40s: expected an error", src)
+		}
+	}
+}
@@ -11,44 +11,81 @@ import (
 )
 
 type BaseNode struct {
-	ID        string `json:"id"`
-	Name      string `json:"name"`
-	Active    bool   `json:"activate"`
-	Type      string `json:"type"`
-	Children  map[Node]pipeline.Pipeline
-	SyncMutex sync.Mutex
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Active   bool   `json:"activate"`
+	Type     string `json:"type"`
+	Children map[Node]pipeline.Pipeline
+	// ErrorChildren receive the commands that fail in this node.
+	ErrorChildren map[Node]struct{}
+	Mailbox       *Mailbox `json:"-"`
+	SyncMutex     sync.Mutex
 }
 
 func NewBaseNode(command *command.CreateNode) *BaseNode {
-	return &BaseNode{
-		ID:        primitive.NewObjectID().Hex(),
-		Name:      command.Name,
-		Active:    true,
-		Children:  map[Node]pipeline.Pipeline{},
-		SyncMutex: sync.Mutex{},
+	node := &BaseNode{
+		ID:            primitive.NewObjectID().Hex(),
+		Name:          command.Name,
+		Active:        true,
+		Type:          "base",
+		Children:      map[Node]pipeline.Pipeline{},
+		ErrorChildren: map[Node]struct{}{},
+		SyncMutex:     sync.Mutex{},
 	}
+	node.Mailbox = NewMailbox(node.Receive)
+	return node
 }
 
 func (node *BaseNode) GetID() string {
 	return node.ID
 }
 
+// SetID replaces the generated ID. It is used when restoring a
+// node from a snapshot.
+func (node *BaseNode) SetID(id string) {
+	node.ID = id
+}
+
 func (node *BaseNode) GetName() string {
 	return node.Name
 }
 
+// GetActive is read by the mailbox worker while commands change it,
+// so Active is guarded by SyncMutex once the node is created.
 func (node *BaseNode) GetActive() bool {
+	node.SyncMutex.Lock()
+	defer node.SyncMutex.Unlock()
 	return node.Active
 }
 
 func (node *BaseNode) SetActive(active bool) {
+	node.SyncMutex.Lock()
 	node.Active = active
+	node.SyncMutex.Unlock()
 }
 
 func (node *BaseNode) GetType() string {
 	return node.Type
 }
 
+// Capabilities lists the actions every node accepts. Node types that
+// accept more add theirs to it.
+func (node *BaseNode) Capabilities() []string {
+	return []string{
+		command.REMOVE_NODE,
+		command.ADD_CHILD,
+		command.REMOVE_CHILD,
+		command.ADD_ERROR_CHILD,
+		command.REMOVE_ERROR_CHILD,
+		command.ACTIVATE_NODE,
+		command.DEACTIVATE_NODE,
+		command.UPDATE_MAILBOX,
+		command.GET_NODE,
+		command.GET_CHILDREN,
+		command.GET_PARENTS,
+	}
+}
+
 func (node *BaseNode) GetChildren() map[Node]pipeline.Pipeline {
 	return node.Children
 }
@@ -66,6 +103,44 @@ func (node *BaseNode) RemoveChild(child Node) {
 	node.RemovePipeline(child)
 }
 
+// GetErrorChildren returns a snapshot of the error children.
+func (node *BaseNode) GetErrorChildren() []Node {
+	node.SyncMutex.Lock()
+	defer node.SyncMutex.Unlock()
+
+	children := make([]Node, 0, len(node.ErrorChildren))
+	for child := range node.ErrorChildren {
+		children = append(children, child)
+	}
+	return children
+}
+
+func (node *BaseNode) AddErrorChild(child Node) {
+	node.SyncMutex.Lock()
+	if node.ErrorChildren == nil {
+		node.ErrorChildren = map[Node]struct{}{}
+	}
+	node.ErrorChildren[child] = struct{}{}
+	node.SyncMutex.Unlock()
+}
+
+func (node *BaseNode) RemoveErrorChild(child Node) {
+	node.SyncMutex.Lock()
+	delete(node.ErrorChildren, child)
+	node.SyncMutex.Unlock()
+}
+
+func (node *BaseNode) HasErrorChild(child Node) bool {
+	node.SyncMutex.Lock()
+	defer node.SyncMutex.Unlock()
+	_, exists := node.ErrorChildren[child]
+	return exists
+}
+
+func (node *BaseNode) GetMailbox() *Mailbox {
+	return node.Mailbox
+}
+
 func (node *BaseNode) HasChild(child Node) bool {
 	_, exists := node.GetChildren()[child]
 	return exists
@@ -88,7 +163,7 @@ func (node *BaseNode) RemovePipeline(child Node) {
 }
 
 func (node *BaseNode) Receive(cmd command.Command) {
-	log.Printf("base receive - %v", cmd.GetData())
+	log.Printf("base receive - %s %s", node.ID, cmd.GetAction())
 	if !node.GetActive() {
 		return
 	}
@@ -97,23 +172,64 @@ func (node *BaseNode) Receive(cmd command.Command) {
 }
 
 func (node *BaseNode) Send(cmd command.Command) {
-	log.Printf("base send - %v", cmd.GetData())
+	log.Printf("base send - %s %s", node.ID, cmd.GetAction())
 	if !node.GetActive() {
 		return
 	}
 
 	if cmd.HasErrors() {
+		node.SendErrors(cmd)
 		return
 	}
 
-	for child := range node.Children {
-		log.Printf("base send before - %v", cmd.GetData())
-		pipeline := node.Children[child]
-		if pipeline != nil {
-			pipeline.Apply(cmd)
-		}
-		log.Printf("base send after - %v", cmd.GetData())
-		child.Receive(cmd)
+	cmd.GetMetadata().Visit(node.ID)
+
+	node.SyncMutex.Lock()
+	children := make(map[Node]pipeline.Pipeline, len(node.Children))
+	for child, pipeline := range node.Children {
+		children[child] = pipeline
+	}
+	node.SyncMutex.Unlock()
+
+	// Every edge gets its own command so that a pipeline on one edge
+	// cannot change what a sibling sees.
+	for child, pipeline := range children {
+		node.sendEdge(child, pipeline, cmd)
+	}
+}
+
+// Redeliver sends a command that already left the node again over the
+// edge to one child only, such as a dead letter that failed on that
+// edge. It fails if child is no longer a child of the node.
+func (node *BaseNode) Redeliver(child Node, cmd command.Command) error {
+	node.SyncMutex.Lock()
+	pipeline, ok := node.Children[child]
+	node.SyncMutex.Unlock()
+	if !ok {
+		return command.Errorf(command.FAILED_PRECONDITION, "%s is not a child of %s", child.GetName(), node.Name).WithNode(child.GetID())
+	}
+
+	node.sendEdge(child, pipeline, cmd)
+	return nil
+}
+
+// SendErrors delivers a failed command to every error child as a dead
+// letter. Error edges have no pipelines. Without error children the
+// command is only logged.
+func (node *BaseNode) SendErrors(cmd command.Command) {
+	node.sendErrors(nil, cmd)
+}
+
+// Enqueue queues a command in the node's mailbox. The mailbox worker
+// hands it to Receive. Nodes without a mailbox receive synchronously.
+func (node *BaseNode) Enqueue(cmd command.Command) {
+	if node.Mailbox == nil {
+		node.Receive(cmd)
+		return
+	}
+
+	if err := node.Mailbox.Push(cmd); err != nil {
+		log.Printf("base enqueue - %v", err)
 	}
 }
 
@@ -125,10 +241,22 @@ func (node *BaseNode) Deactivate(cmd command.Command) {
 	node.SetActive(false)
 }
 
+// Delete stops any background work owned by the node, which for the
+// base node is its mailbox worker.
+func (node *BaseNode) Delete() error {
+	if node.Mailbox != nil {
+		node.Mailbox.Stop()
+	}
+	return nil
+}
+
 func (node *BaseNode) ToJSON() ([]byte, error) {
 	children := map[string]string{}
-	for key, child := range node.Children {
-		pipelineID := node.Children[key].GetID()
+	for child, pipeline := range node.Children {
+		pipelineID := ""
+		if pipeline != nil {
+			pipelineID = pipeline.GetID()
+		}
 		children[child.GetID()] = pipelineID
 	}
 
@@ -141,7 +269,7 @@ func (node *BaseNode) ToJSON() ([]byte, error) {
 	}{
 		node.ID,
 		node.Name,
-		node.Active,
+		node.GetActive(),
 		node.Type,
 		children,
 	}
@@ -155,5 +283,58 @@ func (node *BaseNode) ToJSON() ([]byte, error) {
 
 func (node *BaseNode) ToJSONStruct() map[string]interface{} {
 	m := map[string]interface{}{}
+	if node.Mailbox != nil {
+		m["mailbox"] = node.Mailbox.ToJSONStruct()
+	}
 	return m
 }
+
+// FromJSONStruct restores the props produced by ToJSONStruct.
+func (node *BaseNode) FromJSONStruct(m map[string]interface{}) {
+	if mailbox, ok := m["mailbox"].(map[string]interface{}); ok && node.Mailbox != nil {
+		node.Mailbox.FromJSONStruct(mailbox)
+	}
+}
+
+// sendEdge delivers a copy of the command to one child. The data is
+// only deep copied for pipelines that modify it in place. A pipeline
+// that rejects the command stops it from reaching the child; one that
+// fails it with an error sends it to the error children instead, as
+// does crossing more edges than the message allows.
+func (node *BaseNode) sendEdge(child Node, pipeline pipeline.Pipeline, cmd command.Command) {
+	copied := CopyCommand(cmd, pipeline != nil && pipeline.Mutates())
+	if err := copied.GetMetadata().Hop(); err != nil {
+		copied.AppendError(command.Errorf(command.FAILED_PRECONDITION, "%v", err).WithNode(node.ID))
+		node.sendErrors(child, copied)
+		return
+	}
+	if pipeline != nil && !pipeline.Apply(copied) {
+		log.Printf("base send dropped - %s %s -> %s", copied.GetAction(), node.ID, child.GetID())
+		return
+	}
+	if copied.HasErrors() {
+		node.sendErrors(child, copied)
+		return
+	}
+	log.Printf("base send - %s %s -> %s", copied.GetAction(), node.ID, child.GetID())
+	child.Enqueue(copied)
+}
+
+// sendErrors delivers a dead letter for a command that failed in the
+// node, or on the edge to child when child is set.
+func (node *BaseNode) sendErrors(child Node, cmd command.Command) {
+	children := node.GetErrorChildren()
+	if len(children) == 0 {
+		log.Printf("base send failed - %v", cmd.GetErrors())
+		return
+	}
+
+	childID := ""
+	if child != nil {
+		childID = child.GetID()
+	}
+	letter := NewDeadLetterCommand(node.ID, childID, cmd)
+	for _, errorChild := range children {
+		errorChild.Enqueue(CopyCommand(letter, true))
+	}
+}
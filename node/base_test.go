@@ -0,0 +1,187 @@
+package node
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/thinksystemio/package-flow/command"
+	"github.com/thinksystemio/package-flow/pipeline"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type recordingNode struct {
+	BaseNode
+	received chan command.Command
+}
+
+func newRecordingNode(name string) *recordingNode {
+	node := &recordingNode{received: make(chan command.Command, 10)}
+	node.BaseNode = *NewBaseNode(&command.CreateNode{Name: name})
+	node.Mailbox = NewMailbox(node.Receive)
+	return node
+}
+
+func (node *recordingNode) Receive(cmd command.Command) {
+	node.received <- cmd
+}
+
+func (node *recordingNode) next(t *testing.T) command.Command {
+	select {
+	case cmd := <-node.received:
+		return cmd
+	case <-time.After(time.Second):
+		t.Fatalf("%s did not receive a command", node.Name)
+		return nil
+	}
+}
+
+func createFilter(keys ...string) pipeline.Pipeline {
+	filter := pipeline.NewFilterPipeline(&command.CreatePipeline{Name: "filter"}).(*pipeline.FilterPipeline)
+	filter.UpdatePipelineFilter(&command.UpdateFilterPipeline{Filter: keys})
+	return filter
+}
+
+func TestSendFanout(t *testing.T) {
+	parent := NewBaseNode(&command.CreateNode{Name: "parent"})
+	first := newRecordingNode("first")
+	second := newRecordingNode("second")
+	parent.AddPipeline(first, createFilter("a"))
+	parent.AddPipeline(second, createFilter("b"))
+
+	data := map[string]interface{}{"a": 1, "b": 2}
+	cmd := &command.BaseCommand{Action: "test", Data: data}
+	parent.Send(cmd)
+
+	if got := first.next(t).GetData(); !reflect.DeepEqual(got, map[string]interface{}{"a": 1}) {
+		t.Errorf("first received %v", got)
+	}
+	if got := second.next(t).GetData(); !reflect.DeepEqual(got, map[string]interface{}{"b": 2}) {
+		t.Errorf("second received %v", got)
+	}
+	if !reflect.DeepEqual(cmd.GetData(), map[string]interface{}{"a": 1, "b": 2}) {
+		t.Errorf("sent command was modified to %v", cmd.GetData())
+	}
+}
+
+func TestDeepCopy(t *testing.T) {
+	original := map[string]interface{}{
+		"map":   map[string]interface{}{"a": 1},
+		"slice": []interface{}{map[string]interface{}{"b": 2}},
+		"bson":  primitive.D{{Key: "c", Value: primitive.M{"d": 3}}},
+	}
+
+	copied := DeepCopy(original).(map[string]interface{})
+	if !reflect.DeepEqual(original, copied) {
+		t.Fatalf("copy %v differs from %v", copied, original)
+	}
+
+	copied["map"].(map[string]interface{})["a"] = 0
+	copied["slice"].([]interface{})[0].(map[string]interface{})["b"] = 0
+	copied["bson"].(primitive.D)[0].Value.(primitive.M)["d"] = 0
+
+	if original["map"].(map[string]interface{})["a"] != 1 ||
+		original["slice"].([]interface{})[0].(map[string]interface{})["b"] != 2 ||
+		original["bson"].(primitive.D)[0].Value.(primitive.M)["d"] != 3 {
+		t.Errorf("modifying the copy changed the original: %v", original)
+	}
+}
+
+func TestSendPredicate(t *testing.T) {
+	parent := NewBaseNode(&command.CreateNode{Name: "parent"})
+	child := newRecordingNode("child")
+
+	predicate := pipeline.NewPredicatePipeline(&command.CreatePipeline{Name: "predicate"}).(*pipeline.PredicatePipeline)
+	predicate.UpdatePredicatePipeline(&command.UpdatePredicatePipeline{
+		Condition: &command.Condition{Op: "eq", Field: "keep", Value: true},
+	})
+	parent.AddPipeline(child, predicate)
+
+	parent.Send(&command.BaseCommand{Action: "test", Data: map[string]interface{}{"keep": false}})
+	parent.Send(&command.BaseCommand{Action: "test", Data: map[string]interface{}{"keep": true}})
+
+	if got := child.next(t).GetData(); !reflect.DeepEqual(got, map[string]interface{}{"keep": true}) {
+		t.Errorf("child should only receive matching data, received %v", got)
+	}
+}
+
+func TestSendMetadata(t *testing.T) {
+	parent := NewBaseNode(&command.CreateNode{Name: "parent"})
+	middle := NewBaseNode(&command.CreateNode{Name: "middle"})
+	child := newRecordingNode("child")
+	defer middle.Delete()
+	parent.AddChild(middle)
+	middle.AddChild(child)
+
+	cmd := &command.BaseCommand{Action: "test", Metadata: command.NewMetadata("trace")}
+	parent.Send(cmd)
+
+	metadata := child.next(t).GetMetadata()
+	if metadata.TraceID != "trace" || metadata.MessageID != cmd.Metadata.MessageID {
+		t.Errorf("metadata is %+v", metadata)
+	}
+	if metadata.Origin != parent.ID || metadata.Hops != 2 {
+		t.Errorf("origin is %s after %d hops", metadata.Origin, metadata.Hops)
+	}
+	if !reflect.DeepEqual(metadata.Visited, []string{parent.ID, middle.ID}) {
+		t.Errorf("visited %v", metadata.Visited)
+	}
+	if len(cmd.Metadata.Visited) != 1 {
+		t.Errorf("copies share visited with the sent command: %v", cmd.Metadata.Visited)
+	}
+}
+
+func TestSendHopLimit(t *testing.T) {
+	a := NewBaseNode(&command.CreateNode{Name: "a"})
+	b := NewBaseNode(&command.CreateNode{Name: "b"})
+	failures := newRecordingNode("failures")
+	defer a.Delete()
+	defer b.Delete()
+	a.AddChild(b)
+	b.AddChild(a)
+	a.AddErrorChild(failures)
+	b.AddErrorChild(failures)
+
+	metadata := command.NewMetadata("")
+	metadata.MaxHops = 3
+	a.Send(&command.BaseCommand{Action: "test", Metadata: metadata})
+
+	letter := failures.next(t).GetData().(map[string]interface{})
+	failed := letter["metadata"].(*command.Metadata)
+	if failed.Hops != 4 || len(failed.Visited) != 4 {
+		t.Errorf("message stopped after %d hops, visiting %v", failed.Hops, failed.Visited)
+	}
+	if errs := letter["errors"].([]command.Error); len(errs) != 1 {
+		t.Errorf("letter errors are %v", errs)
+	}
+
+	select {
+	case cmd := <-failures.received:
+		t.Errorf("unexpected command %v", cmd.GetData())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestActiveConcurrent(t *testing.T) {
+	parent := NewBaseNode(&command.CreateNode{Name: "parent"})
+	child := newRecordingNode("child")
+	parent.AddChild(child)
+	defer parent.Delete()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			parent.SetActive(i%2 == 0)
+		}
+		parent.SetActive(true)
+	}()
+	for i := 0; i < 5; i++ {
+		parent.Enqueue(&command.BaseCommand{Action: "test", Data: i})
+	}
+	<-done
+
+	parent.Enqueue(&command.BaseCommand{Action: "test", Data: "last"})
+	for cmd := child.next(t); cmd.GetData() != "last"; cmd = child.next(t) {
+	}
+}
@@ -0,0 +1,267 @@
+package node
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/thinksystemio/package-flow/command"
+	"github.com/thinksystemio/package-flow/pipeline"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	DefaultDeadLetterCapacity = 1000
+	DefaultDeadLetterPage     = 100
+)
+
+// Letter is a command that failed in a node. Node is the ID of that
+// node and Child the ID of the child it failed on the way to, which is
+// empty when the node itself failed it. Action, Data and Metadata are
+// the command as it was when it failed.
+type Letter struct {
+	Node     string            `json:"node"`
+	Child    string            `json:"child,omitempty"`
+	Action   string            `json:"action"`
+	Errors   []command.Error   `json:"errors"`
+	Data     interface{}       `json:"data"`
+	Metadata *command.Metadata `json:"metadata,omitempty"`
+	Time     time.Time         `json:"time"`
+}
+
+// DeadLetter retains the failed commands sent to it as an error child
+// so that they can be inspected and replayed. When Capacity letters
+// are retained the oldest is dropped.
+type DeadLetter struct {
+	BaseNode
+	Capacity int
+	Letters  []Letter
+	Mu       sync.Mutex
+}
+
+//
+// DeadLetter Base
+//
+
+func NewDeadLetterNode(cmd *command.CreateNode) *DeadLetter {
+	node := &DeadLetter{
+		Capacity: DefaultDeadLetterCapacity,
+		Letters:  []Letter{},
+	}
+	node.ID = primitive.NewObjectID().Hex()
+	node.Name = cmd.Name
+	node.Active = true
+	node.Type = "deadletter"
+	node.Children = map[Node]pipeline.Pipeline{}
+	node.ErrorChildren = map[Node]struct{}{}
+	node.Mailbox = NewMailbox(node.Receive)
+	return node
+}
+
+// NewDeadLetterCommand wraps a failed command for an error child. The
+// errors and metadata move into the data, so the letter itself carries
+// no errors and error children handle it like any other command. The
+// letter is a new message in the same trace, so it is not held to the
+// hops the failed command already crossed. childID is the child whose
+// edge failed the command, or empty when the node failed it.
+func NewDeadLetterCommand(nodeID string, childID string, cmd command.Command) command.Command {
+	letter := &command.BaseCommand{Action: cmd.GetAction(), Metadata: command.DeriveMetadata(cmd)}
+	data := map[string]interface{}{
+		"node":     nodeID,
+		"action":   cmd.GetAction(),
+		"errors":   append([]command.Error{}, cmd.GetErrors()...),
+		"data":     cmd.GetData(),
+		"metadata": cmd.GetMetadata().Copy(),
+	}
+	if childID != "" {
+		data["child"] = childID
+	}
+	letter.Data = data
+	return letter
+}
+
+// Receive retains the letter and passes it on to the children.
+func (node *DeadLetter) Receive(cmd command.Command) {
+	log.Printf("dead letter receive - %s %s", node.ID, cmd.GetAction())
+	if !node.GetActive() {
+		return
+	}
+
+	letter := Letter{
+		Action:   cmd.GetAction(),
+		Data:     cmd.GetData(),
+		Metadata: cmd.GetMetadata().Copy(),
+		Time:     time.Now().UTC(),
+	}
+	if m, ok := cmd.GetData().(map[string]interface{}); ok {
+		letter.Node, _ = m["node"].(string)
+		letter.Child, _ = m["child"].(string)
+		letter.Errors, _ = m["errors"].([]command.Error)
+		if action, ok := m["action"].(string); ok {
+			letter.Action = action
+		}
+		if data, ok := m["data"]; ok {
+			letter.Data = data
+		}
+		if metadata, ok := m["metadata"].(*command.Metadata); ok {
+			letter.Metadata = metadata
+		}
+	}
+
+	node.Mu.Lock()
+	node.Letters = append(node.Letters, letter)
+	if node.Capacity > 0 && len(node.Letters) > node.Capacity {
+		node.Letters = node.Letters[len(node.Letters)-node.Capacity:]
+	}
+	node.Mu.Unlock()
+
+	node.Send(cmd)
+}
+
+//
+// DeadLetter Command API
+//
+
+// Replay retries the oldest limit letters, or every letter when limit
+// is zero. A letter that failed on an edge is sent over that edge
+// again, through its pipeline; one that failed in its node goes back
+// to the node's mailbox. Either way no other child receives it twice.
+// Letters whose node or edge cannot be found are kept. It returns the
+// number of letters replayed.
+func (node *DeadLetter) Replay(cmd *command.ReplayDeadLetters, lookup func(string) (Node, error)) int {
+	node.Mu.Lock()
+	limit := cmd.Limit
+	if limit <= 0 || limit > len(node.Letters) {
+		limit = len(node.Letters)
+	}
+	letters := append([]Letter{}, node.Letters[:limit]...)
+	node.Letters = append([]Letter{}, node.Letters[limit:]...)
+	node.Mu.Unlock()
+
+	kept := []Letter{}
+	replayed := 0
+	for _, letter := range letters {
+		if err := replayLetter(letter, lookup); err != nil {
+			cmd.AppendError(err)
+			kept = append(kept, letter)
+			continue
+		}
+		replayed++
+	}
+
+	if len(kept) > 0 {
+		node.Mu.Lock()
+		node.Letters = append(kept, node.Letters...)
+		node.Mu.Unlock()
+	}
+	return replayed
+}
+
+//
+// DeadLetter Utils
+//
+
+// replayLetter sends a letter again from where it failed. The replay
+// keeps the letter's metadata, including its hop limit, but starts
+// counting hops again.
+func replayLetter(letter Letter, lookup func(string) (Node, error)) error {
+	origin, err := lookup(letter.Node)
+	if err != nil {
+		return command.AsError(err).WithNode(letter.Node)
+	}
+
+	replay := &command.BaseCommand{Action: letter.Action, Data: DeepCopy(letter.Data)}
+	if letter.Metadata != nil {
+		replay.Metadata = letter.Metadata.Copy()
+		replay.Metadata.Hops = 0
+	}
+
+	if letter.Child == "" {
+		origin.Enqueue(replay)
+		return nil
+	}
+
+	child, err := lookup(letter.Child)
+	if err != nil {
+		return command.AsError(err).WithNode(letter.Child)
+	}
+	return origin.Redeliver(child, replay)
+}
+
+func (node *DeadLetter) GetLetters() []Letter {
+	node.Mu.Lock()
+	defer node.Mu.Unlock()
+	return append([]Letter{}, node.Letters...)
+}
+
+// PageLetters returns up to limit letters starting at offset, oldest
+// first, and the number of letters retained. A limit of zero or less
+// returns DefaultDeadLetterPage letters.
+func (node *DeadLetter) PageLetters(offset int, limit int) ([]Letter, int) {
+	node.Mu.Lock()
+	defer node.Mu.Unlock()
+
+	total := len(node.Letters)
+	if limit <= 0 {
+		limit = DefaultDeadLetterPage
+	}
+	if offset < 0 || offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return append([]Letter{}, node.Letters[offset:end]...), total
+}
+
+func (node *DeadLetter) Capabilities() []string {
+	return append(node.BaseNode.Capabilities(), command.REPLAY_DEAD_LETTERS, command.GET_DEAD_LETTERS)
+}
+
+// ToJSONStruct keeps every letter so that snapshots restore them.
+func (node *DeadLetter) ToJSONStruct() map[string]interface{} {
+	m := node.BaseNode.ToJSONStruct()
+	m["capacity"] = node.Capacity
+	m["letters"] = node.GetLetters()
+	return m
+}
+
+// ViewJSONStruct leaves the letters out, as they hold the raw data of
+// failed commands; get_dead_letters pages through them instead.
+func (node *DeadLetter) ViewJSONStruct() map[string]interface{} {
+	m := node.BaseNode.ToJSONStruct()
+	m["capacity"] = node.Capacity
+	node.Mu.Lock()
+	m["letter_count"] = len(node.Letters)
+	node.Mu.Unlock()
+	return m
+}
+
+// FromJSONStruct restores the retained letters. They arrive decoded
+// from JSON, so they are decoded again into letters.
+func (node *DeadLetter) FromJSONStruct(m map[string]interface{}) {
+	node.BaseNode.FromJSONStruct(m)
+
+	if capacity, ok := m["capacity"].(float64); ok {
+		node.Capacity = int(capacity)
+	}
+
+	if m["letters"] == nil {
+		return
+	}
+	JSON, err := json.Marshal(m["letters"])
+	if err != nil {
+		return
+	}
+	letters := []Letter{}
+	if err := json.Unmarshal(JSON, &letters); err != nil {
+		log.Printf("dead letter restore - %v", err)
+		return
+	}
+
+	node.Mu.Lock()
+	node.Letters = letters
+	node.Mu.Unlock()
+}
@@ -0,0 +1,124 @@
+package node
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/thinksystemio/package-flow/command"
+	"github.com/thinksystemio/package-flow/pipeline"
+)
+
+func TestDeadLetter(t *testing.T) {
+	parent := NewBaseNode(&command.CreateNode{Name: "parent"})
+	child := newRecordingNode("child")
+	observer := newRecordingNode("observer")
+	dead := NewDeadLetterNode(&command.CreateNode{Name: "dead"})
+	defer dead.Delete()
+
+	double := pipeline.NewExpressionPipeline(&command.CreatePipeline{Name: "double"}).(*pipeline.ExpressionPipeline)
+	double.UpdateExpressionPipeline(&command.UpdateExpressionPipeline{Expressions: []string{"x = a * 2"}})
+	parent.AddPipeline(child, double)
+	parent.AddErrorChild(dead)
+	dead.AddChild(observer)
+
+	// a command that arrives with errors
+	failed := &command.BaseCommand{Action: "test", Data: map[string]interface{}{"a": 2}}
+	failed.AppendError(errors.New("insert failed"))
+	parent.Send(failed)
+	observer.next(t)
+
+	// a command that fails in the edge's pipeline
+	parent.Send(&command.BaseCommand{Action: "test", Data: map[string]interface{}{"a": "text"}})
+	observer.next(t)
+
+	letters := dead.GetLetters()
+	if len(letters) != 2 {
+		t.Fatalf("expected 2 letters, got %v", letters)
+	}
+	if letters[0].Node != parent.ID || letters[0].Action != "test" || letters[0].Errors[0].Message != "insert failed" {
+		t.Errorf("first letter is %+v", letters[0])
+	}
+	if !reflect.DeepEqual(letters[0].Data, map[string]interface{}{"a": 2}) {
+		t.Errorf("first letter data is %v", letters[0].Data)
+	}
+	if len(letters[1].Errors) != 1 {
+		t.Errorf("second letter errors are %v", letters[1].Errors)
+	}
+
+	// replaying the first letter delivers it without its errors
+	lookup := func(id string) (Node, error) {
+		if id == parent.ID {
+			return parent, nil
+		}
+		return nil, errors.New("not found")
+	}
+	replay := &command.ReplayDeadLetters{Limit: 1}
+	if n := dead.Replay(replay, lookup); n != 1 || replay.HasErrors() {
+		t.Fatalf("replayed %d letters with errors %v", n, replay.GetErrors())
+	}
+	want := map[string]interface{}{"a": 2, "x": 4.0}
+	if got := child.next(t).GetData(); !reflect.DeepEqual(got, want) {
+		t.Errorf("child received %v, want %v", got, want)
+	}
+	if len(dead.GetLetters()) != 1 {
+		t.Errorf("expected 1 letter left, got %v", dead.GetLetters())
+	}
+}
+
+func TestDeadLetterReplayEdge(t *testing.T) {
+	parent := NewBaseNode(&command.CreateNode{Name: "parent"})
+	child := newRecordingNode("child")
+	sibling := newRecordingNode("sibling")
+	observer := newRecordingNode("observer")
+	dead := NewDeadLetterNode(&command.CreateNode{Name: "dead"})
+	defer dead.Delete()
+
+	double := pipeline.NewExpressionPipeline(&command.CreatePipeline{Name: "double"}).(*pipeline.ExpressionPipeline)
+	double.UpdateExpressionPipeline(&command.UpdateExpressionPipeline{Expressions: []string{"x = a * 2"}})
+	parent.AddPipeline(child, double)
+	parent.AddChild(sibling)
+	parent.AddErrorChild(dead)
+	dead.AddChild(observer)
+
+	failed := &command.BaseCommand{Action: "test", Data: map[string]interface{}{"a": "text"}, Metadata: command.NewMetadata("")}
+	failed.Metadata.MaxHops = 5
+	parent.Send(failed)
+	sibling.next(t)
+	observer.next(t)
+
+	letters := dead.GetLetters()
+	if len(letters) != 1 || letters[0].Child != child.ID {
+		t.Fatalf("expected a letter for the child's edge, got %+v", letters)
+	}
+
+	// once the pipeline is fixed the replay reaches the child only
+	double.UpdateExpressionPipeline(&command.UpdateExpressionPipeline{Expressions: []string{"x = 1"}})
+	lookup := func(id string) (Node, error) {
+		switch id {
+		case parent.ID:
+			return parent, nil
+		case child.ID:
+			return child, nil
+		}
+		return nil, errors.New("not found")
+	}
+	replay := &command.ReplayDeadLetters{}
+	if n := dead.Replay(replay, lookup); n != 1 || replay.HasErrors() {
+		t.Fatalf("replayed %d letters with errors %v", n, replay.GetErrors())
+	}
+
+	received := child.next(t)
+	if got := received.GetData(); !reflect.DeepEqual(got, map[string]interface{}{"a": "text", "x": 1.0}) {
+		t.Errorf("child received %v", got)
+	}
+	if metadata := received.GetMetadata(); metadata.MaxHops != 5 || metadata.Hops != 1 || metadata.TraceID != failed.Metadata.TraceID {
+		t.Errorf("replay metadata is %+v", metadata)
+	}
+	select {
+	case cmd := <-sibling.received:
+		t.Errorf("sibling received the replay %v", cmd.GetData())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,213 @@
+package node
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/thinksystemio/package-flow/command"
+)
+
+const (
+	MAILBOX_BLOCK       = "block"
+	MAILBOX_DROP_OLDEST = "drop_oldest"
+	MAILBOX_DROP_NEWEST = "drop_newest"
+
+	DefaultMailboxCapacity = 64
+)
+
+var (
+	ErrMailboxFull    = errors.New("mailbox is full")
+	ErrMailboxStopped = errors.New("mailbox is stopped")
+)
+
+// Mailbox is a bounded FIFO inbox owned by a node. A single worker
+// goroutine hands each command to the node's Receive in the order it
+// was pushed, so a slow node only delays its own inbox instead of the
+// node that sent to it. The worker is started on the first push.
+type Mailbox struct {
+	Capacity int
+	Policy   string
+
+	queue   []command.Command
+	dropped int
+	running bool
+	stopped bool
+	handler func(command.Command)
+
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+}
+
+// NewMailbox creates a mailbox with the default capacity and the
+// block overflow policy. The handler is called by the worker for
+// every command.
+func NewMailbox(handler func(command.Command)) *Mailbox {
+	mailbox := &Mailbox{
+		Capacity: DefaultMailboxCapacity,
+		Policy:   MAILBOX_BLOCK,
+		handler:  handler,
+	}
+	mailbox.notEmpty = sync.NewCond(&mailbox.mu)
+	mailbox.notFull = sync.NewCond(&mailbox.mu)
+	return mailbox
+}
+
+// Push queues a command. When the mailbox is full the policy decides
+// what happens: block waits for room, drop_oldest discards the head
+// of the queue and drop_newest discards the pushed command and
+// returns ErrMailboxFull.
+//
+// Blocking waits for a worker to make room, so nodes on a cycle must
+// not use the block policy: a node whose sends come back round to its
+// own full mailbox waits on its own worker, or on a worker that is
+// waiting on it, and never resumes. The tree rejects cycles through
+// blocking nodes and the block policy on nodes in a cycle.
+func (mailbox *Mailbox) Push(cmd command.Command) error {
+	mailbox.mu.Lock()
+	defer mailbox.mu.Unlock()
+
+	if mailbox.stopped {
+		return ErrMailboxStopped
+	}
+
+	if !mailbox.running {
+		mailbox.running = true
+		go mailbox.work()
+	}
+
+	for len(mailbox.queue) >= mailbox.Capacity {
+		switch mailbox.Policy {
+		case MAILBOX_DROP_OLDEST:
+			mailbox.queue[0] = nil
+			mailbox.queue = mailbox.queue[1:]
+			mailbox.dropped++
+		case MAILBOX_DROP_NEWEST:
+			mailbox.dropped++
+			return ErrMailboxFull
+		default:
+			mailbox.notFull.Wait()
+			if mailbox.stopped {
+				return ErrMailboxStopped
+			}
+		}
+	}
+
+	mailbox.queue = append(mailbox.queue, cmd)
+	mailbox.notEmpty.Signal()
+	return nil
+}
+
+// Configure changes the capacity and overflow policy. Commands already
+// queued beyond a reduced capacity are kept.
+func (mailbox *Mailbox) Configure(capacity int, policy string) error {
+	if capacity < 1 {
+		return errors.New("mailbox capacity must be at least 1")
+	}
+
+	switch policy {
+	case MAILBOX_BLOCK, MAILBOX_DROP_OLDEST, MAILBOX_DROP_NEWEST:
+	default:
+		return errors.New("mailbox policy must be block, drop_oldest or drop_newest")
+	}
+
+	mailbox.mu.Lock()
+	mailbox.Capacity = capacity
+	mailbox.Policy = policy
+	mailbox.notFull.Broadcast()
+	mailbox.mu.Unlock()
+
+	return nil
+}
+
+// Stop discards every queued command and stops the worker. Pushes
+// after Stop return ErrMailboxStopped.
+func (mailbox *Mailbox) Stop() {
+	mailbox.mu.Lock()
+	mailbox.stopped = true
+	mailbox.queue = nil
+	mailbox.notEmpty.Broadcast()
+	mailbox.notFull.Broadcast()
+	mailbox.mu.Unlock()
+}
+
+// Len returns the number of queued commands.
+func (mailbox *Mailbox) Len() int {
+	mailbox.mu.Lock()
+	defer mailbox.mu.Unlock()
+	return len(mailbox.queue)
+}
+
+// Config returns the capacity and overflow policy.
+func (mailbox *Mailbox) Config() (int, string) {
+	mailbox.mu.Lock()
+	defer mailbox.mu.Unlock()
+	return mailbox.Capacity, mailbox.Policy
+}
+
+func (mailbox *Mailbox) ToJSONStruct() map[string]interface{} {
+	mailbox.mu.Lock()
+	defer mailbox.mu.Unlock()
+
+	return map[string]interface{}{
+		"capacity": mailbox.Capacity,
+		"policy":   mailbox.Policy,
+		"depth":    len(mailbox.queue),
+		"dropped":  mailbox.dropped,
+	}
+}
+
+// FromJSONStruct restores the capacity and policy produced by
+// ToJSONStruct.
+func (mailbox *Mailbox) FromJSONStruct(m map[string]interface{}) {
+	capacity, policy := mailbox.Config()
+	if value, ok := m["capacity"].(float64); ok {
+		capacity = int(value)
+	}
+
+	if value, ok := m["policy"].(string); ok {
+		policy = value
+	}
+
+	if err := mailbox.Configure(capacity, policy); err != nil {
+		log.Printf("mailbox restore - %v", err)
+	}
+}
+
+//
+// Mailbox Utils
+//
+
+func (mailbox *Mailbox) work() {
+	for {
+		mailbox.mu.Lock()
+		for len(mailbox.queue) == 0 && !mailbox.stopped {
+			mailbox.notEmpty.Wait()
+		}
+		if mailbox.stopped {
+			mailbox.running = false
+			mailbox.mu.Unlock()
+			return
+		}
+
+		cmd := mailbox.queue[0]
+		mailbox.queue[0] = nil
+		mailbox.queue = mailbox.queue[1:]
+		mailbox.notFull.Signal()
+		mailbox.mu.Unlock()
+
+		mailbox.deliver(cmd)
+	}
+}
+
+// deliver calls the handler, keeping the worker alive if it panics.
+func (mailbox *Mailbox) deliver(cmd command.Command) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("mailbox receive - %v", err)
+		}
+	}()
+
+	mailbox.handler(cmd)
+}
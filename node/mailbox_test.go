@@ -0,0 +1,121 @@
+package node
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thinksystemio/package-flow/command"
+)
+
+type recorder struct {
+	mu       sync.Mutex
+	received []interface{}
+	started  chan struct{}
+	release  chan struct{}
+}
+
+func newRecorder() *recorder {
+	return &recorder{started: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (r *recorder) handle(cmd command.Command) {
+	select {
+	case r.started <- struct{}{}:
+	default:
+	}
+	<-r.release
+	r.mu.Lock()
+	r.received = append(r.received, cmd.GetData())
+	r.mu.Unlock()
+}
+
+func (r *recorder) wait(t *testing.T, count int) []interface{} {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		r.mu.Lock()
+		received := append([]interface{}{}, r.received...)
+		r.mu.Unlock()
+		if len(received) >= count {
+			return received
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d commands", count)
+	return nil
+}
+
+func createCommand(data interface{}) command.Command {
+	return &command.BaseCommand{Action: "test", Data: data}
+}
+
+func TestMailboxOrder(t *testing.T) {
+	r := newRecorder()
+	close(r.release)
+	mailbox := NewMailbox(r.handle)
+	defer mailbox.Stop()
+
+	for i := 0; i < 200; i++ {
+		mailbox.Push(createCommand(i))
+	}
+
+	received := r.wait(t, 200)
+	for i, data := range received {
+		if data != i {
+			t.Fatalf("received %v at position %d", data, i)
+		}
+	}
+}
+
+func TestMailboxDropNewest(t *testing.T) {
+	r := newRecorder()
+	mailbox := NewMailbox(r.handle)
+	defer mailbox.Stop()
+	mailbox.Configure(1, MAILBOX_DROP_NEWEST)
+
+	mailbox.Push(createCommand(1))
+	<-r.started
+	mailbox.Push(createCommand(2))
+	if err := mailbox.Push(createCommand(3)); err != ErrMailboxFull {
+		t.Errorf("push should report a full mailbox, got %v", err)
+	}
+	close(r.release)
+
+	received := r.wait(t, 2)
+	if received[0] != 1 || received[1] != 2 {
+		t.Errorf("received %v, want [1 2]", received)
+	}
+	if dropped := mailbox.ToJSONStruct()["dropped"]; dropped != 1 {
+		t.Errorf("dropped should be 1, got %v", dropped)
+	}
+}
+
+func TestMailboxDropOldest(t *testing.T) {
+	r := newRecorder()
+	mailbox := NewMailbox(r.handle)
+	defer mailbox.Stop()
+	mailbox.Configure(1, MAILBOX_DROP_OLDEST)
+
+	mailbox.Push(createCommand(1))
+	<-r.started
+	mailbox.Push(createCommand(2))
+	mailbox.Push(createCommand(3))
+	if depth := mailbox.Len(); depth != 1 {
+		t.Errorf("depth should be 1, got %d", depth)
+	}
+	close(r.release)
+
+	received := r.wait(t, 2)
+	if received[0] != 1 || received[1] != 3 {
+		t.Errorf("received %v, want [1 3]", received)
+	}
+}
+
+func TestMailboxStop(t *testing.T) {
+	mailbox := NewMailbox(func(command.Command) {})
+	mailbox.Stop()
+
+	if err := mailbox.Push(createCommand(1)); err != ErrMailboxStopped {
+		t.Errorf("push after stop should fail, got %v", err)
+	}
+}
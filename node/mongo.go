@@ -2,6 +2,7 @@ package node
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/thinksystemio/package-flow/command"
@@ -27,13 +28,23 @@ func NewMongoNode(cmd *command.CreateNode) *Mongo {
 	node.Active = true
 	node.Type = "mongo"
 	node.Children = map[Node]pipeline.Pipeline{}
+	node.ErrorChildren = map[Node]struct{}{}
+	node.Mailbox = NewMailbox(node.Receive)
 	return node
 }
 
+// Delete stops the mailbox and disconnects the mongo client if one
+// was connected.
 func (node *Mongo) Delete() error {
+	node.BaseNode.Delete()
+	if node.client == nil {
+		return nil
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	err := node.client.Disconnect(ctx)
+	node.client = nil
 	return err
 }
 
@@ -44,7 +55,7 @@ func (node *Mongo) Delete() error {
 func (node *Mongo) Connect(cmd *command.ConnectMongo) {
 	client, err := gomongo.CreateMongoClient(cmd.URL)
 	if err != nil {
-		cmd.AppendError(err)
+		cmd.AppendError(command.Errorf(command.UPSTREAM_FAILURE, "%v", err).WithField("url").WithNode(node.ID))
 		return
 	}
 
@@ -52,61 +63,116 @@ func (node *Mongo) Connect(cmd *command.ConnectMongo) {
 }
 
 func (node *Mongo) Add(cmd *command.AddMongo) {
-	collection := node.client.Database("data").Collection(node.Name)
-	data, err := gomongo.Add(collection, cmd.Document)
-	cmd.SetData(data)
-	cmd.AppendError(err)
-	node.Send(cmd)
+	collection, err := node.collection()
+	if err != nil {
+		cmd.AppendError(err)
+		return
+	}
+	data, err := insert(collection, cmd.Document)
+	node.sendResult(cmd, data, cmd.Document, err)
 }
 
 func (node *Mongo) Update(cmd *command.UpdateMongo) {
-	collection := node.client.Database("data").Collection(node.Name)
+	collection, err := node.collection()
+	if err != nil {
+		cmd.AppendError(err)
+		return
+	}
 	data, err := gomongo.Update(collection, cmd.Filter, cmd.Document)
-	cmd.SetData(data)
-	cmd.AppendError(err)
-	node.Send(cmd)
+	node.sendResult(cmd, data, cmd.Document, err)
 }
 
 func (node *Mongo) UpdateByID(cmd *command.UpdateByIDMongo) {
-	collection := node.client.Database("data").Collection(node.Name)
+	collection, err := node.collection()
+	if err != nil {
+		cmd.AppendError(err)
+		return
+	}
 	data, err := gomongo.UpdateByID(collection, cmd.ID, cmd.Document)
-	cmd.SetData(data)
-	cmd.AppendError(err)
-	node.Send(cmd)
+	node.sendResult(cmd, data, cmd.Document, err)
 }
 
 func (node *Mongo) Remove(cmd *command.RemoveMongo) {
-	collection := node.client.Database("data").Collection(node.Name)
+	collection, err := node.collection()
+	if err != nil {
+		cmd.AppendError(err)
+		return
+	}
 	data, err := gomongo.Remove(collection, cmd.Filter)
-	cmd.SetData(data)
-	cmd.AppendError(err)
-	node.Send(cmd)
+	node.sendResult(cmd, data, cmd.Filter, err)
 }
 
 func (node *Mongo) RemoveByID(cmd *command.RemoveByIDMongo) {
-	collection := node.client.Database("data").Collection(node.Name)
+	collection, err := node.collection()
+	if err != nil {
+		cmd.AppendError(err)
+		return
+	}
 	data, err := gomongo.RemoveByID(collection, cmd.ID)
-	cmd.SetData(data)
-	cmd.AppendError(err)
-	node.Send(cmd)
+	node.sendResult(cmd, data, cmd.ID, err)
 }
 
 func (node *Mongo) QueryAll(cmd *command.QueryAllMongo) {
-	collection := node.client.Database("data").Collection(node.Name)
-	data, err := gomongo.GetAll(collection)
+	collection, err := node.collection()
 	if err != nil {
 		cmd.AppendError(err)
 		return
 	}
-	cmd.SetData(data)
-	node.Send(cmd)
+	data, err := gomongo.GetAll(collection)
+	node.sendResult(cmd, data, nil, err)
 }
 
 //
 // Mongo Utils
 //
 
+// collection returns the node's collection, failing until connect_mongo
+// has succeeded.
+func (node *Mongo) collection() (*mongo.Collection, error) {
+	if node.client == nil {
+		return nil, command.Errorf(command.FAILED_PRECONDITION, "mongo node %s is not connected", node.Name).WithNode(node.ID)
+	}
+	return node.client.Database("data").Collection(node.Name), nil
+}
+
+// insert adds a document. gomongo.Add reads the result of the insert
+// before checking its error, so a failed insert panics instead of
+// returning the error.
+func insert(collection *mongo.Collection, document map[string]interface{}) (id string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("insert failed: %v", r)
+		}
+	}()
+	return gomongo.Add(collection, document)
+}
+
+// sendResult sends the result of an operation to the children. A
+// failed operation keeps its input as the data instead, so that the
+// error children receive what could not be written.
+func (node *Mongo) sendResult(cmd command.Command, data interface{}, input interface{}, err error) {
+	if err != nil {
+		cmd.AppendError(command.Errorf(command.UPSTREAM_FAILURE, "%v", err).WithNode(node.ID))
+		cmd.SetData(input)
+	} else {
+		cmd.SetData(data)
+	}
+	node.Send(cmd)
+}
+
+func (node *Mongo) Capabilities() []string {
+	return append(node.BaseNode.Capabilities(),
+		command.CONNECT_MONGO,
+		command.ADD_MONGO,
+		command.UPDATE_MONGO,
+		command.UPDATE_BY_ID_MONGO,
+		command.REMOVE_MONGO,
+		command.REMOVE_BY_ID_MONGO,
+		command.QUERY_ALL_MONGO,
+	)
+}
+
 func (node *Mongo) ToJSONStruct() map[string]interface{} {
-	m := map[string]interface{}{}
+	m := node.BaseNode.ToJSONStruct()
 	return m
 }
@@ -1,9 +1,6 @@
 package node
 
 import (
-	"errors"
-	"strings"
-
 	"github.com/thinksystemio/package-flow/command"
 	"github.com/thinksystemio/package-flow/pipeline"
 )
@@ -11,16 +8,23 @@ import (
 // Node is an interface for all nodes in the flow tree.
 type Node interface {
 	GetID() string
+	SetID(string)
 	GetName() string
 	GetActive() bool
 	SetActive(bool)
 	GetType() string
 
+	// Capabilities lists the actions the node accepts.
+	Capabilities() []string
+
 	Activate(command.Command)
 	Deactivate(command.Command)
 
 	Send(command.Command)
+	Redeliver(Node, command.Command) error
 	Receive(command.Command)
+	Enqueue(command.Command)
+	GetMailbox() *Mailbox
 
 	GetChildren() map[Node]pipeline.Pipeline
 	AddChild(Node)
@@ -30,26 +34,42 @@ type Node interface {
 	AddPipeline(Node, pipeline.Pipeline)
 	RemovePipeline(Node)
 
+	GetErrorChildren() []Node
+	AddErrorChild(Node)
+	RemoveErrorChild(Node)
+	HasErrorChild(Node) bool
+
 	ToJSON() ([]byte, error)
 	ToJSONStruct() map[string]interface{}
+	FromJSONStruct(map[string]interface{})
+
+	Delete() error
+}
+
+// Viewer is implemented by nodes whose props are too large or too
+// sensitive to send to clients. ViewJSONStruct is ToJSONStruct for
+// clients; ToJSONStruct keeps everything so that snapshots restore the
+// node.
+type Viewer interface {
+	ViewJSONStruct() map[string]interface{}
+}
+
+// ViewJSONStruct returns the props of a node that can be sent to
+// clients.
+func ViewJSONStruct(n Node) map[string]interface{} {
+	if viewer, ok := n.(Viewer); ok {
+		return viewer.ViewJSONStruct()
+	}
+	return n.ToJSONStruct()
 }
 
-func NewNode(command *command.CreateNode) Node {
-	nodeType := strings.ToLower(command.Type)
-
-	switch nodeType {
-	case "base":
-		return NewBaseNode(command)
-	case "publisher":
-		return NewPublisherNode(command)
-	case "subscriber":
-		return NewSubscriberNode(command)
-	case "mongo":
-		return NewMongoNode(command)
-	default:
-		err := errors.New("Node.New - invalid node type")
-		command.AppendError(err)
+func NewNode(cmd *command.CreateNode) Node {
+	factory, ok := lookupFactory(cmd.Type)
+	if !ok {
+		err := command.Invalid("type", "Node.New - invalid node type")
+		cmd.AppendError(err)
+		return nil
 	}
 
-	return nil
+	return factory(cmd)
 }
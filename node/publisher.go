@@ -15,8 +15,9 @@ import (
 
 type Publisher struct {
 	BaseNode
-	Subscribers map[*websocket.Conn]struct{}
-	Mu          sync.Mutex
+	Subscribers     map[*websocket.Conn]struct{}
+	IncludeMetadata bool
+	Mu              sync.Mutex
 }
 
 //
@@ -30,6 +31,8 @@ func NewPublisherNode(cmd *command.CreateNode) *Publisher {
 	node.Active = true
 	node.Type = "publisher"
 	node.Children = map[Node]pipeline.Pipeline{}
+	node.ErrorChildren = map[Node]struct{}{}
+	node.Mailbox = NewMailbox(node.Receive)
 	return node
 }
 
@@ -39,12 +42,27 @@ func (node *Publisher) Receive(cmd command.Command) {
 		return
 	}
 
-	JSON, err := json.Marshal(cmd.GetData())
+	var message interface{} = cmd.GetData()
+	if node.IncludeMetadata {
+		message = map[string]interface{}{
+			"data":     cmd.GetData(),
+			"metadata": cmd.GetMetadata(),
+		}
+	}
+
+	JSON, err := json.Marshal(message)
 	if err != nil {
 		return
 	}
 
+	node.Mu.Lock()
+	subscribers := make([]*websocket.Conn, 0, len(node.Subscribers))
 	for subscriber := range node.Subscribers {
+		subscribers = append(subscribers, subscriber)
+	}
+	node.Mu.Unlock()
+
+	for _, subscriber := range subscribers {
 		log.Printf("publisher send - %v", cmd.GetData())
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
@@ -60,9 +78,6 @@ func (node *Publisher) Receive(cmd command.Command) {
 //
 
 func (node *Publisher) AddSubscriber(cmd *command.AddSubscriber) error {
-	node.Mu.Lock()
-	defer node.Mu.Unlock()
-
 	subscriber, err := websocket.Accept(cmd.W, cmd.R, nil)
 	if err != nil {
 		return err
@@ -70,12 +85,18 @@ func (node *Publisher) AddSubscriber(cmd *command.AddSubscriber) error {
 	defer node.RemoveSubscriber(subscriber)
 	ctx := subscriber.CloseRead(cmd.R.Context())
 
+	node.Mu.Lock()
 	node.Subscribers[subscriber] = struct{}{}
+	node.Mu.Unlock()
 
 	<-ctx.Done()
 	return nil
 }
 
+func (node *Publisher) UpdatePublisher(cmd *command.UpdatePublisher) {
+	node.IncludeMetadata = cmd.IncludeMetadata
+}
+
 //
 // Publisher Utils
 //
@@ -92,7 +113,35 @@ func (node *Publisher) RemoveSubscriber(subscriber *websocket.Conn) {
 	delete(node.Subscribers, subscriber)
 }
 
+// Delete stops the mailbox and closes every subscriber connection
+// held by the publisher.
+func (node *Publisher) Delete() error {
+	node.BaseNode.Delete()
+
+	node.Mu.Lock()
+	defer node.Mu.Unlock()
+
+	for subscriber := range node.Subscribers {
+		subscriber.Close(websocket.StatusGoingAway, "node removed")
+		delete(node.Subscribers, subscriber)
+	}
+
+	return nil
+}
+
+func (node *Publisher) Capabilities() []string {
+	return append(node.BaseNode.Capabilities(), command.ADD_SUBSCRIBER, command.UPDATE_PUBLISHER)
+}
+
 func (node *Publisher) ToJSONStruct() map[string]interface{} {
-	m := map[string]interface{}{}
+	m := node.BaseNode.ToJSONStruct()
+	m["include_metadata"] = node.IncludeMetadata
 	return m
 }
+
+func (node *Publisher) FromJSONStruct(m map[string]interface{}) {
+	node.BaseNode.FromJSONStruct(m)
+	if include, ok := m["include_metadata"].(bool); ok {
+		node.IncludeMetadata = include
+	}
+}
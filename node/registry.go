@@ -0,0 +1,62 @@
+package node
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/thinksystemio/package-flow/command"
+)
+
+// Factory creates a node of a registered type.
+type Factory func(cmd *command.CreateNode) Node
+
+var (
+	factories   = map[string]Factory{}
+	factoriesMu sync.RWMutex
+)
+
+// RegisterNodeType makes NewNode create nodes of a type with factory.
+// Types are case insensitive. It panics if the type is empty or
+// already registered, so it is meant to be called from init.
+func RegisterNodeType(name string, factory Factory) {
+	name = strings.ToLower(name)
+	if name == "" || factory == nil {
+		panic("node: RegisterNodeType needs a name and a factory")
+	}
+
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("node: type %s is already registered", name))
+	}
+	factories[name] = factory
+}
+
+func lookupFactory(name string) (Factory, bool) {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	factory, ok := factories[strings.ToLower(name)]
+	return factory, ok
+}
+
+// validType is the node_type validation rule for command fields that
+// name a node type.
+func validType(value interface{}) error {
+	if _, ok := lookupFactory(fmt.Sprint(value)); !ok {
+		return fmt.Errorf("unknown node type %v", value)
+	}
+	return nil
+}
+
+func init() {
+	command.RegisterRule("node_type", validType)
+
+	RegisterNodeType("base", func(cmd *command.CreateNode) Node { return NewBaseNode(cmd) })
+	RegisterNodeType("publisher", func(cmd *command.CreateNode) Node { return NewPublisherNode(cmd) })
+	RegisterNodeType("subscriber", func(cmd *command.CreateNode) Node { return NewSubscriberNode(cmd) })
+	RegisterNodeType("mongo", func(cmd *command.CreateNode) Node { return NewMongoNode(cmd) })
+	RegisterNodeType("deadletter", func(cmd *command.CreateNode) Node { return NewDeadLetterNode(cmd) })
+}
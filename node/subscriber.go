@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/thinksystemio/package-flow/command"
@@ -18,6 +19,10 @@ type Subscriber struct {
 	WSActive bool            `json:"wsactive"`
 	Signal   chan bool       `json:"-"`
 	Client   *websocket.Conn `json:"-"`
+
+	// wsMu guards WSActive, Signal and Client, which the listener
+	// goroutines share with the commands that change them.
+	wsMu sync.Mutex
 }
 
 //
@@ -31,6 +36,8 @@ func NewSubscriberNode(cmd *command.CreateNode) *Subscriber {
 	node.Active = true
 	node.Type = "subscriber"
 	node.Children = map[Node]pipeline.Pipeline{}
+	node.ErrorChildren = map[Node]struct{}{}
+	node.Mailbox = NewMailbox(node.Receive)
 	return node
 }
 
@@ -41,20 +48,27 @@ func NewSubscriberNode(cmd *command.CreateNode) *Subscriber {
 func (node *Subscriber) ActivateWS(cmd *command.ActivateWS) {
 	node.Close()
 
+	node.wsMu.Lock()
 	node.WSActive = true
 	node.Signal = make(chan bool)
+	node.wsMu.Unlock()
+
+	// Messages are traced back to the activating command. Its metadata
+	// is created here, before Listen reads it from another goroutine.
+	cmd.GetMetadata()
 
 	go func() {
-		for node.WSActive {
+		for node.wsActive() {
+			signal := node.signal()
 			go node.Listen(cmd)
-			<-node.Signal
+			<-signal
 			time.Sleep(5 * time.Second)
 		}
 	}()
 }
 
 func (node *Subscriber) DeactivateWS(cmd *command.DeactivateWS) {
-	node.WSActive = false
+	node.setWSActive(false)
 	node.Close()
 }
 
@@ -66,42 +80,63 @@ func (node *Subscriber) UpdateURL(cmd *command.UpdateURL) {
 // Subscriber Utils
 //
 
+// Delete stops the websocket listener, closes the current
+// connection and stops the mailbox.
+func (node *Subscriber) Delete() error {
+	node.setWSActive(false)
+	node.Close()
+	return node.BaseNode.Delete()
+}
+
 func (node *Subscriber) Close() {
-	if node.Client != nil {
-		node.Client.Close(websocket.StatusNormalClosure, "closing current connection")
+	node.wsMu.Lock()
+	client := node.Client
+	node.wsMu.Unlock()
+
+	if client != nil {
+		client.Close(websocket.StatusNormalClosure, "closing current connection")
 	}
 }
 
 func (node *Subscriber) Listen(cmd command.Command) {
-	defer func() { node.Signal <- true }()
+	signal := node.signal()
+	defer func() { signal <- true }()
 
 	ctx := context.Background()
 	client, _, err := websocket.Dial(ctx, node.URL, nil)
 	if err != nil {
-		cmd.AppendError(err)
+		cmd.AppendError(command.Errorf(command.UPSTREAM_FAILURE, "%v", err).WithNode(node.ID))
 		return
 	}
 
+	node.wsMu.Lock()
 	node.Client = client
+	node.wsMu.Unlock()
 	defer node.Close()
 
-	for node.WSActive {
+	for node.wsActive() {
 		_, msg, err := client.Read(ctx)
 		if err != nil {
-			cmd.AppendError(err)
+			cmd.AppendError(command.Errorf(command.UPSTREAM_FAILURE, "%v", err).WithNode(node.ID))
 			return
 		}
 
+		// A message that cannot be decoded is sent on as text with the
+		// error, which routes it to the error children.
 		data := map[string]interface{}{}
 		if err := json.Unmarshal(msg, &data); err != nil {
-			cmd.AppendError(err)
-			return
+			failed := &command.BaseCommand{Action: cmd.GetAction(), Data: string(msg)}
+			failed.Metadata = command.DeriveMetadata(cmd)
+			failed.AppendError(command.Errorf(command.INVALID_ARGUMENT, "%v", err).WithNode(node.ID))
+			node.Send(failed)
+			continue
 		}
 		log.Println("original data")
 		log.Println(data)
 
 		copied := &command.UpdateURL{URL: node.URL}
 		copied.Action = cmd.GetAction()
+		copied.Metadata = command.DeriveMetadata(cmd)
 
 		// copy errors
 		copied.Errors = make([]command.Error, len(cmd.GetErrors()))
@@ -117,9 +152,47 @@ func (node *Subscriber) Listen(cmd command.Command) {
 	}
 }
 
+func (node *Subscriber) Capabilities() []string {
+	return append(node.BaseNode.Capabilities(), command.UPDATE_URL, command.ACTIVATE_WS, command.DECTIVATE_WS)
+}
+
 func (node *Subscriber) ToJSONStruct() map[string]interface{} {
-	m := map[string]interface{}{}
+	m := node.BaseNode.ToJSONStruct()
 	m["url"] = node.URL
-	m["wsactive"] = node.WSActive
+	m["wsactive"] = node.wsActive()
 	return m
 }
+
+func (node *Subscriber) wsActive() bool {
+	node.wsMu.Lock()
+	defer node.wsMu.Unlock()
+	return node.WSActive
+}
+
+func (node *Subscriber) setWSActive(active bool) {
+	node.wsMu.Lock()
+	node.WSActive = active
+	node.wsMu.Unlock()
+}
+
+func (node *Subscriber) signal() chan bool {
+	node.wsMu.Lock()
+	defer node.wsMu.Unlock()
+	return node.Signal
+}
+
+// FromJSONStruct restores the URL and reconnects the websocket if
+// it was active when the snapshot was taken.
+func (node *Subscriber) FromJSONStruct(m map[string]interface{}) {
+	node.BaseNode.FromJSONStruct(m)
+
+	if url, ok := m["url"].(string); ok {
+		node.URL = url
+	}
+
+	if active, ok := m["wsactive"].(bool); ok && active {
+		cmd := &command.ActivateWS{Node: node.ID}
+		cmd.Action = command.ACTIVATE_WS
+		node.ActivateWS(cmd)
+	}
+}
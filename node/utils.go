@@ -1,49 +1,76 @@
 package node
 
-func DeepCopyMap(m map[string]interface{}) map[string]interface{} {
-	result := map[string]interface{}{}
+import (
+	"github.com/thinksystemio/package-flow/command"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
-	for k, v := range m {
-		// Handle maps
-		mapValue, isMap := v.(map[string]interface{})
-		if isMap {
-			result[k] = DeepCopyMap(mapValue)
-			continue
+// DeepCopy copies maps, slices and bson documents recursively. Any
+// other value is returned as is.
+func DeepCopy(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		return DeepCopyMap(value)
+	case primitive.M:
+		return primitive.M(DeepCopyMap(value))
+	case []interface{}:
+		return DeepCopySlice(value)
+	case primitive.A:
+		return primitive.A(DeepCopySlice(value))
+	case []map[string]interface{}:
+		result := make([]map[string]interface{}, 0, len(value))
+		for _, item := range value {
+			result = append(result, DeepCopyMap(item))
 		}
-
-		// Handle slices
-		sliceValue, isSlice := v.([]interface{})
-		if isSlice {
-			result[k] = DeepCopySlice(sliceValue)
-			continue
+		return result
+	case primitive.D:
+		result := make(primitive.D, 0, len(value))
+		for _, item := range value {
+			result = append(result, primitive.E{Key: item.Key, Value: DeepCopy(item.Value)})
 		}
+		return result
+	default:
+		return v
+	}
+}
+
+func DeepCopyMap(m map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(m))
 
-		result[k] = v
+	for k, v := range m {
+		result[k] = DeepCopy(v)
 	}
 
 	return result
 }
 
 func DeepCopySlice(s []interface{}) []interface{} {
-	result := []interface{}{}
+	result := make([]interface{}, 0, len(s))
 
 	for _, v := range s {
-		// Handle maps
-		mapValue, isMap := v.(map[string]interface{})
-		if isMap {
-			result = append(result, DeepCopyMap(mapValue))
-			continue
-		}
+		result = append(result, DeepCopy(v))
+	}
 
-		// Handle slices
-		sliceValue, isSlice := v.([]interface{})
-		if isSlice {
-			result = append(result, DeepCopySlice(sliceValue))
-			continue
-		}
+	return result
+}
+
+// CopyCommand creates an independent command carrying the action,
+// data, errors and metadata of cmd. The data is only deep copied when
+// deep is true; otherwise the copy shares it, which is safe as long as
+// nothing downstream modifies it in place.
+func CopyCommand(cmd command.Command, deep bool) command.Command {
+	copied := &command.BaseCommand{Action: cmd.GetAction()}
+	copied.Metadata = cmd.GetMetadata().Copy()
 
-		result = append(result, v)
+	// copy errors
+	copied.Errors = make([]command.Error, len(cmd.GetErrors()))
+	copy(copied.Errors, cmd.GetErrors())
+
+	// copy data
+	copied.Data = cmd.GetData()
+	if deep {
+		copied.Data = DeepCopy(copied.Data)
 	}
 
-	return result
+	return copied
 }
@@ -17,6 +17,7 @@ func NewBasePipelineDefault(name string) Pipeline {
 	return &BasePipeline{
 		ID:   primitive.NewObjectID().Hex(),
 		Name: name,
+		Type: "base",
 	}
 }
 
@@ -24,6 +25,7 @@ func NewBasePipeline(cmd *flowcommand.CreatePipeline) Pipeline {
 	return &BasePipeline{
 		ID:   primitive.NewObjectID().Hex(),
 		Name: cmd.Name,
+		Type: "base",
 	}
 }
 
@@ -39,7 +41,16 @@ func (pipeline *BasePipeline) GetType() string {
 	return pipeline.Type
 }
 
-func (pipeline *BasePipeline) Apply(cmd flowcommand.Command) {}
+func (pipeline *BasePipeline) Apply(cmd flowcommand.Command) bool {
+	return true
+}
+
+// Mutates reports whether Apply modifies the command data in place.
+// When it does, each edge using the pipeline receives a deep copy of
+// the data.
+func (pipeline *BasePipeline) Mutates() bool {
+	return false
+}
 
 func (pipeline *BasePipeline) ToJSON() ([]byte, error) {
 	return json.Marshal(pipeline)
@@ -0,0 +1,256 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/thinksystemio/package-flow/command"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ChainPipeline runs an ordered list of registered pipelines on a
+// single edge. Stages are shared with the tree, so updating a stage
+// pipeline changes every chain that uses it.
+type ChainPipeline struct {
+	BasePipeline
+	Stages []Pipeline
+
+	unresolved []string
+	mu         sync.RWMutex
+}
+
+// chainStage is how a stage is serialized. Only the ID is needed to
+// restore a chain; the name and type are there for clients.
+type chainStage struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+//
+// ChainPipeline Base
+//
+
+func NewChainPipeline(cmd *command.CreatePipeline) Pipeline {
+	pipeline := &ChainPipeline{
+		Stages: []Pipeline{},
+	}
+
+	pipeline.ID = primitive.NewObjectID().Hex()
+	pipeline.Name = cmd.Name
+	pipeline.Type = "chain"
+	return pipeline
+}
+
+//
+// ChainPipeline Command API
+//
+
+// InsertStage inserts a stage at index. A negative index or one past
+// the end appends the stage.
+func (pipeline *ChainPipeline) InsertStage(stage Pipeline, index int) error {
+	if err := pipeline.validStage(stage); err != nil {
+		return err
+	}
+
+	pipeline.mu.Lock()
+	defer pipeline.mu.Unlock()
+
+	if index < 0 || index > len(pipeline.Stages) {
+		index = len(pipeline.Stages)
+	}
+
+	stages := make([]Pipeline, 0, len(pipeline.Stages)+1)
+	stages = append(stages, pipeline.Stages[:index]...)
+	stages = append(stages, stage)
+	stages = append(stages, pipeline.Stages[index:]...)
+	pipeline.Stages = stages
+	return nil
+}
+
+// RemoveStage removes the first occurrence of a stage.
+func (pipeline *ChainPipeline) RemoveStage(stage Pipeline) error {
+	pipeline.mu.Lock()
+	defer pipeline.mu.Unlock()
+
+	index := pipeline.indexOf(stage)
+	if index == -1 {
+		return fmt.Errorf("pipeline %s is not a stage of %s", stage.GetName(), pipeline.Name)
+	}
+
+	stages := make([]Pipeline, 0, len(pipeline.Stages)-1)
+	stages = append(stages, pipeline.Stages[:index]...)
+	stages = append(stages, pipeline.Stages[index+1:]...)
+	pipeline.Stages = stages
+	return nil
+}
+
+// MoveStage moves the first occurrence of a stage to index.
+func (pipeline *ChainPipeline) MoveStage(stage Pipeline, index int) error {
+	pipeline.mu.Lock()
+	defer pipeline.mu.Unlock()
+
+	from := pipeline.indexOf(stage)
+	if from == -1 {
+		return fmt.Errorf("pipeline %s is not a stage of %s", stage.GetName(), pipeline.Name)
+	}
+	if index < 0 || index >= len(pipeline.Stages) {
+		return fmt.Errorf("stage index %d is out of range", index)
+	}
+
+	stages := make([]Pipeline, 0, len(pipeline.Stages))
+	stages = append(stages, pipeline.Stages[:from]...)
+	stages = append(stages, pipeline.Stages[from+1:]...)
+	stages = append(stages[:index], append([]Pipeline{stage}, stages[index:]...)...)
+	pipeline.Stages = stages
+	return nil
+}
+
+// SetStages replaces every stage.
+func (pipeline *ChainPipeline) SetStages(stages []Pipeline) error {
+	for _, stage := range stages {
+		if err := pipeline.validStage(stage); err != nil {
+			return err
+		}
+	}
+
+	pipeline.mu.Lock()
+	pipeline.Stages = append([]Pipeline{}, stages...)
+	pipeline.mu.Unlock()
+	return nil
+}
+
+//
+// ChainPipeline Utils
+//
+
+func (pipeline *ChainPipeline) GetStages() []Pipeline {
+	pipeline.mu.RLock()
+	defer pipeline.mu.RUnlock()
+	return append([]Pipeline{}, pipeline.Stages...)
+}
+
+// Apply runs every stage in order and stops at the first stage that
+// drops the command.
+func (pipeline *ChainPipeline) Apply(cmd command.Command) bool {
+	for _, stage := range pipeline.GetStages() {
+		if !stage.Apply(cmd) {
+			return false
+		}
+	}
+	return true
+}
+
+// Mutates reports whether any stage modifies the data in place.
+func (pipeline *ChainPipeline) Mutates() bool {
+	for _, stage := range pipeline.GetStages() {
+		if stage.Mutates() {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve looks up the stages of a chain restored by FromJSON.
+func (pipeline *ChainPipeline) Resolve(lookup func(string) (Pipeline, error)) error {
+	stages := make([]Pipeline, 0, len(pipeline.unresolved))
+	for _, id := range pipeline.unresolved {
+		stage, err := lookup(id)
+		if err != nil {
+			return err
+		}
+		stages = append(stages, stage)
+	}
+
+	if err := pipeline.SetStages(stages); err != nil {
+		return err
+	}
+	pipeline.unresolved = nil
+	return nil
+}
+
+func (pipeline *ChainPipeline) ToJSON() ([]byte, error) {
+	return json.Marshal(pipeline)
+}
+
+func (pipeline *ChainPipeline) MarshalJSON() ([]byte, error) {
+	stages := []chainStage{}
+	for _, stage := range pipeline.GetStages() {
+		stages = append(stages, chainStage{stage.GetID(), stage.GetName(), stage.GetType()})
+	}
+
+	return json.Marshal(&struct {
+		ID     string       `json:"id"`
+		Name   string       `json:"name"`
+		Type   string       `json:"type"`
+		Stages []chainStage `json:"stages"`
+	}{
+		pipeline.ID,
+		pipeline.Name,
+		pipeline.Type,
+		stages,
+	})
+}
+
+// UnmarshalJSON restores the stage IDs. Resolve must be called once
+// the stage pipelines exist.
+func (pipeline *ChainPipeline) UnmarshalJSON(data []byte) error {
+	s := &struct {
+		ID     string       `json:"id"`
+		Name   string       `json:"name"`
+		Type   string       `json:"type"`
+		Stages []chainStage `json:"stages"`
+	}{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return err
+	}
+
+	pipeline.ID = s.ID
+	pipeline.Name = s.Name
+	pipeline.Type = s.Type
+	pipeline.unresolved = []string{}
+	for _, stage := range s.Stages {
+		pipeline.unresolved = append(pipeline.unresolved, stage.ID)
+	}
+	return nil
+}
+
+// validStage rejects stages that would make the chain run itself.
+func (pipeline *ChainPipeline) validStage(stage Pipeline) error {
+	if stage == nil {
+		return errors.New("stage must not be nil")
+	}
+	if chainContains(stage, pipeline) {
+		return fmt.Errorf("pipeline %s cannot be a stage of itself", pipeline.Name)
+	}
+	return nil
+}
+
+func (pipeline *ChainPipeline) indexOf(stage Pipeline) int {
+	for i, s := range pipeline.Stages {
+		if s == stage {
+			return i
+		}
+	}
+	return -1
+}
+
+func chainContains(stage Pipeline, target Pipeline) bool {
+	if stage == target {
+		return true
+	}
+
+	chain, ok := stage.(*ChainPipeline)
+	if !ok {
+		return false
+	}
+
+	for _, s := range chain.GetStages() {
+		if chainContains(s, target) {
+			return true
+		}
+	}
+	return false
+}
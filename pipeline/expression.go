@@ -0,0 +1,155 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/thinksystemio/package-flow/command"
+	"github.com/thinksystemio/package-flow/expression"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ExpressionPipeline computes fields from command data. Each
+// expression has the form "target = expression" and is evaluated in
+// order, so later expressions can use fields set by earlier ones.
+// Arrays of objects have the expressions applied to every element.
+type ExpressionPipeline struct {
+	BasePipeline
+	Expressions []string `json:"expressions"`
+
+	compiled []*expression.Assignment
+	mu       sync.RWMutex
+}
+
+//
+// ExpressionPipeline Base
+//
+
+func NewExpressionPipeline(cmd *command.CreatePipeline) Pipeline {
+	pipeline := &ExpressionPipeline{
+		Expressions: []string{},
+		compiled:    []*expression.Assignment{},
+	}
+
+	pipeline.ID = primitive.NewObjectID().Hex()
+	pipeline.Name = cmd.Name
+	pipeline.Type = "expression"
+	return pipeline
+}
+
+//
+// ExpressionPipeline Command API
+//
+
+// UpdateExpressionPipeline compiles and replaces the expressions. An
+// invalid expression leaves the pipeline unchanged.
+func (pipeline *ExpressionPipeline) UpdateExpressionPipeline(cmd *command.UpdateExpressionPipeline) {
+	compiled, err := compileExpressions(cmd.Expressions)
+	if err != nil {
+		cmd.AppendError(command.Invalid("expressions", "%v", err).WithPipeline(pipeline.ID))
+		return
+	}
+
+	pipeline.mu.Lock()
+	pipeline.Expressions = cmd.Expressions
+	pipeline.compiled = compiled
+	pipeline.mu.Unlock()
+}
+
+//
+// ExpressionPipeline Utils
+//
+
+// Apply evaluates the expressions. A failed evaluation is appended to
+// the command's errors, which stops it from being delivered.
+func (pipeline *ExpressionPipeline) Apply(cmd command.Command) bool {
+	pipeline.mu.RLock()
+	compiled := pipeline.compiled
+	pipeline.mu.RUnlock()
+
+	data, err := applyExpressions(cmd.GetData(), compiled)
+	if err != nil {
+		cmd.AppendError(command.Errorf(command.INVALID_ARGUMENT, "%v", err).WithPipeline(pipeline.ID))
+	}
+	cmd.SetData(data)
+	return true
+}
+
+func (pipeline *ExpressionPipeline) Mutates() bool {
+	return true
+}
+
+func (pipeline *ExpressionPipeline) ToJSON() ([]byte, error) {
+	pipeline.mu.RLock()
+	defer pipeline.mu.RUnlock()
+	return json.Marshal(pipeline)
+}
+
+func (pipeline *ExpressionPipeline) restore() error {
+	compiled, err := compileExpressions(pipeline.Expressions)
+	if err != nil {
+		return err
+	}
+	pipeline.compiled = compiled
+	return nil
+}
+
+func compileExpressions(sources []string) ([]*expression.Assignment, error) {
+	compiled := make([]*expression.Assignment, 0, len(sources))
+	for i, src := range sources {
+		assignment, err := expression.Compile(src)
+		if err != nil {
+			return nil, fmt.Errorf("expression %d: %v", i, err)
+		}
+		compiled = append(compiled, assignment)
+	}
+	return compiled, nil
+}
+
+func applyExpressions(data interface{}, compiled []*expression.Assignment) (interface{}, error) {
+	switch v := data.(type) {
+	case []interface{}:
+		for i, item := range v {
+			result, err := applyExpressions(item, compiled)
+			if err != nil {
+				return v, err
+			}
+			v[i] = result
+		}
+		return v, nil
+	case primitive.A:
+		for i, item := range v {
+			result, err := applyExpressions(item, compiled)
+			if err != nil {
+				return v, err
+			}
+			v[i] = result
+		}
+		return v, nil
+	case []map[string]interface{}:
+		for i, item := range v {
+			result, err := applyExpressions(item, compiled)
+			if err != nil {
+				return v, err
+			}
+			v[i] = result.(map[string]interface{})
+		}
+		return v, nil
+	}
+
+	if !isObject(data) {
+		return data, nil
+	}
+
+	for _, assignment := range compiled {
+		value, err := assignment.Eval(func(path string) (interface{}, bool) {
+			return lookupPath(data, path)
+		})
+		if err != nil {
+			return data, fmt.Errorf("%s: %v", assignment.Source, err)
+		}
+		data = setPath(data, splitPath(assignment.Target), value)
+	}
+	return data, nil
+}
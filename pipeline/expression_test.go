@@ -0,0 +1,86 @@
+package pipeline
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/thinksystemio/package-flow/command"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func createExpressionPipeline(t *testing.T, expressions ...string) *ExpressionPipeline {
+	p := NewExpressionPipeline(&command.CreatePipeline{Name: "expression"}).(*ExpressionPipeline)
+	cmd := &command.UpdateExpressionPipeline{Expressions: expressions}
+
+	p.UpdateExpressionPipeline(cmd)
+	if cmd.HasErrors() {
+		t.Fatalf("expressions %v returned errors: %v", expressions, cmd.GetErrors())
+	}
+	return p
+}
+
+func TestExpressionPipeline(t *testing.T) {
+	p := createExpressionPipeline(t,
+		"total = price * qty",
+		`name = upper(first) + " " + last`,
+		"order.discounted = total > 10",
+	)
+
+	cmd := &command.BaseCommand{Data: []interface{}{
+		map[string]interface{}{"price": 2.5, "qty": 4, "first": "ada", "last": "Lovelace"},
+		primitive.D{{Key: "price", Value: int32(3)}, {Key: "qty", Value: int64(5)}, {Key: "first", Value: "alan"}, {Key: "last", Value: "Turing"}},
+	}}
+	if !p.Apply(cmd) || cmd.HasErrors() {
+		t.Fatalf("apply failed: %v", cmd.GetErrors())
+	}
+
+	want := []interface{}{
+		map[string]interface{}{
+			"price": 2.5, "qty": 4, "first": "ada", "last": "Lovelace",
+			"total": 10.0, "name": "ADA Lovelace", "order": map[string]interface{}{"discounted": false},
+		},
+		primitive.D{
+			{Key: "price", Value: int32(3)}, {Key: "qty", Value: int64(5)}, {Key: "first", Value: "alan"}, {Key: "last", Value: "Turing"},
+			{Key: "total", Value: 15.0}, {Key: "name", Value: "ALAN Turing"}, {Key: "order", Value: primitive.D{{Key: "discounted", Value: true}}},
+		},
+	}
+	if !reflect.DeepEqual(cmd.GetData(), want) {
+		t.Errorf("got %v, want %v", cmd.GetData(), want)
+	}
+}
+
+func TestExpressionPipelineErrors(t *testing.T) {
+	p := createExpressionPipeline(t, "total = price * qty")
+
+	// an invalid expression is rejected and the old ones are kept
+	update := &command.UpdateExpressionPipeline{Expressions: []string{"total = price *"}}
+	p.UpdateExpressionPipeline(update)
+	if !update.HasErrors() {
+		t.Error("expected a compile error")
+	}
+	if !reflect.DeepEqual(p.Expressions, []string{"total = price * qty"}) {
+		t.Errorf("expressions changed to %v", p.Expressions)
+	}
+
+	// an evaluation error fails the command
+	cmd := &command.BaseCommand{Data: map[string]interface{}{"price": "free"}}
+	p.Apply(cmd)
+	if !cmd.HasErrors() {
+		t.Error("expected an evaluation error")
+	}
+
+	// restored pipelines are compiled again
+	JSON, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := FromJSON(JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd = &command.BaseCommand{Data: map[string]interface{}{"price": 2, "qty": 3}}
+	restored.Apply(cmd)
+	if total, _ := lookupPath(cmd.GetData(), "total"); total != 6.0 {
+		t.Errorf("restored pipeline computed %v", total)
+	}
+}
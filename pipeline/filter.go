@@ -1,13 +1,24 @@
 package pipeline
 
 import (
+	"encoding/json"
+	"sync"
+
 	"github.com/thinksystemio/package-flow/command"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// FilterPipeline projects command data onto a list of paths. In
+// include mode only the listed paths are kept, in exclude mode they
+// are removed and everything else is kept. Nested objects keep their
+// structure and arrays are filtered element by element.
 type FilterPipeline struct {
 	BasePipeline
-	Filter map[string]struct{}
+	Filter command.Paths `json:"filter"`
+	Mode   string        `json:"mode"`
+
+	paths *pathTree
+	mu    sync.RWMutex
 }
 
 //
@@ -16,7 +27,9 @@ type FilterPipeline struct {
 
 func NewFilterPipeline(cmd *command.CreatePipeline) Pipeline {
 	pipeline := &FilterPipeline{
-		Filter: map[string]struct{}{},
+		Filter: command.Paths{},
+		Mode:   command.FILTER_INCLUDE,
+		paths:  newPathTree(nil),
 	}
 
 	pipeline.ID = primitive.NewObjectID().Hex()
@@ -30,37 +43,50 @@ func NewFilterPipeline(cmd *command.CreatePipeline) Pipeline {
 //
 
 func (pipeline *FilterPipeline) UpdatePipelineFilter(cmd *command.UpdateFilterPipeline) {
+	mode := cmd.Mode
+	if mode == "" {
+		mode = command.FILTER_INCLUDE
+	}
+
+	pipeline.mu.Lock()
 	pipeline.Filter = cmd.Filter
+	pipeline.Mode = mode
+	pipeline.paths = newPathTree(cmd.Filter)
+	pipeline.mu.Unlock()
 }
 
 //
 // FilterPipeline Utils
 //
 
-func (pipeline *FilterPipeline) Apply(cmd command.Command) {
-	if data, ok := cmd.GetData().(map[string]interface{}); ok {
-		transformed := make(map[string]interface{}, len(data))
-		for k := range pipeline.Filter {
-			if value, ok := data[k]; ok {
-				transformed[k] = value
-			}
-		}
-		cmd.SetData(transformed)
-		return
+func (pipeline *FilterPipeline) ToJSON() ([]byte, error) {
+	pipeline.mu.RLock()
+	defer pipeline.mu.RUnlock()
+	return json.Marshal(pipeline)
+}
+
+func (pipeline *FilterPipeline) restore() error {
+	if pipeline.Mode == "" {
+		pipeline.Mode = command.FILTER_INCLUDE
+	}
+	pipeline.paths = newPathTree(pipeline.Filter)
+	return nil
+}
+
+// Apply projects objects and arrays of objects, including bson
+// documents and nested arrays. Any other data is left untouched.
+func (pipeline *FilterPipeline) Apply(cmd command.Command) bool {
+	pipeline.mu.RLock()
+	paths, mode := pipeline.paths, pipeline.Mode
+	pipeline.mu.RUnlock()
+
+	if mode == command.FILTER_EXCLUDE {
+		cmd.SetData(paths.exclude(cmd.GetData()))
+		return true
 	}
 
-	if data, ok := cmd.GetData().([]map[string]interface{}); ok {
-		transformed := make([]map[string]interface{}, len(data))
-		for _, item := range data {
-			copied := make(map[string]interface{}, len(item))
-			for k := range pipeline.Filter {
-				if value, ok := item[k]; ok {
-					copied[k] = value
-				}
-			}
-			transformed = append(transformed, copied)
-		}
+	if transformed, _ := paths.include(cmd.GetData()); transformed != nil {
 		cmd.SetData(transformed)
-		return
 	}
+	return true
 }
@@ -1,5 +1,14 @@
 package pipeline
 
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/thinksystemio/package-flow/command"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
 // func createTree() (Node, Node) {
 // 	parent := CreateBaseNode("parent", "parent")
 // 	child := CreateBaseNode("child", "child")
@@ -38,3 +47,174 @@ package pipeline
 // 	command.Payload = data
 // 	parent.Send(command)
 // }
+
+func createFilterPipeline(t *testing.T, JSON string) *FilterPipeline {
+	p := NewFilterPipeline(&command.CreatePipeline{Name: "filter"}).(*FilterPipeline)
+	cmd := &command.UpdateFilterPipeline{}
+	if err := json.Unmarshal([]byte(JSON), cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	p.UpdatePipelineFilter(cmd)
+	return p
+}
+
+func createNestedData() map[string]interface{} {
+	return map[string]interface{}{
+		"name": "alice",
+		"user": map[string]interface{}{
+			"address": map[string]interface{}{"city": "Paris", "zip": "75001"},
+			"email":   "alice@example.com",
+		},
+		"items": []interface{}{
+			map[string]interface{}{"sku": "a", "qty": 1, "price": 10},
+			map[string]interface{}{"sku": "b", "qty": 2, "price": 20},
+		},
+	}
+}
+
+func TestFilterPipelinePaths(t *testing.T) {
+	p := createFilterPipeline(t, `{"filter":["name","user.address.city","items[].sku"]}`)
+	cmd := &command.BaseCommand{Data: createNestedData()}
+	p.Apply(cmd)
+
+	want := map[string]interface{}{
+		"name": "alice",
+		"user": map[string]interface{}{
+			"address": map[string]interface{}{"city": "Paris"},
+		},
+		"items": []interface{}{
+			map[string]interface{}{"sku": "a"},
+			map[string]interface{}{"sku": "b"},
+		},
+	}
+	if !reflect.DeepEqual(cmd.GetData(), want) {
+		t.Errorf("got %v, want %v", cmd.GetData(), want)
+	}
+}
+
+func TestFilterPipelineExclude(t *testing.T) {
+	p := createFilterPipeline(t, `{"filter":["user.email","items[].price"],"mode":"exclude"}`)
+	data := createNestedData()
+	cmd := &command.BaseCommand{Data: data}
+	p.Apply(cmd)
+
+	want := createNestedData()
+	delete(want["user"].(map[string]interface{}), "email")
+	for _, item := range want["items"].([]interface{}) {
+		delete(item.(map[string]interface{}), "price")
+	}
+	if !reflect.DeepEqual(cmd.GetData(), want) {
+		t.Errorf("got %v, want %v", cmd.GetData(), want)
+	}
+	if !reflect.DeepEqual(data, createNestedData()) {
+		t.Error("exclude should not modify the original data")
+	}
+}
+
+func TestFilterPipelineSetForm(t *testing.T) {
+	p := createFilterPipeline(t, `{"filter":{"name":{},"user.email":{}}}`)
+	cmd := &command.BaseCommand{Data: createNestedData()}
+	p.Apply(cmd)
+
+	want := map[string]interface{}{
+		"name": "alice",
+		"user": map[string]interface{}{"email": "alice@example.com"},
+	}
+	if !reflect.DeepEqual(cmd.GetData(), want) {
+		t.Errorf("got %v, want %v", cmd.GetData(), want)
+	}
+}
+
+func TestFilterPipelineShapes(t *testing.T) {
+	p := createFilterPipeline(t, `{"filter":["a","n.b"]}`)
+
+	tests := []struct {
+		name string
+		data interface{}
+		want interface{}
+	}{
+		{
+			"map",
+			map[string]interface{}{"a": 1, "c": 3},
+			map[string]interface{}{"a": 1},
+		},
+		{
+			"slice of maps",
+			[]map[string]interface{}{{"a": 1, "c": 3}, {"c": 3}},
+			[]map[string]interface{}{{"a": 1}, {}},
+		},
+		{
+			"slice of interfaces",
+			[]interface{}{map[string]interface{}{"a": 1, "c": 3}, "scalar"},
+			[]interface{}{map[string]interface{}{"a": 1}},
+		},
+		{
+			"nested arrays",
+			[]interface{}{[]interface{}{map[string]interface{}{"a": 1, "c": 3}}},
+			[]interface{}{[]interface{}{map[string]interface{}{"a": 1}}},
+		},
+		{
+			"bson.M",
+			primitive.M{"a": 1, "n": primitive.M{"b": 2, "c": 3}},
+			primitive.M{"a": 1, "n": primitive.M{"b": 2}},
+		},
+		{
+			"bson.D",
+			primitive.D{{Key: "c", Value: 3}, {Key: "n", Value: primitive.D{{Key: "b", Value: 2}}}, {Key: "a", Value: 1}},
+			primitive.D{{Key: "n", Value: primitive.D{{Key: "b", Value: 2}}}, {Key: "a", Value: 1}},
+		},
+		{
+			"bson.A",
+			primitive.A{primitive.D{{Key: "a", Value: 1}, {Key: "c", Value: 3}}},
+			primitive.A{primitive.D{{Key: "a", Value: 1}}},
+		},
+		{
+			"nested array of objects",
+			map[string]interface{}{"n": []interface{}{map[string]interface{}{"b": 2, "c": 3}}},
+			map[string]interface{}{"n": []interface{}{map[string]interface{}{"b": 2}}},
+		},
+		{
+			"scalar",
+			"scalar",
+			"scalar",
+		},
+	}
+
+	for _, test := range tests {
+		cmd := &command.BaseCommand{Data: test.data}
+		p.Apply(cmd)
+		if !reflect.DeepEqual(cmd.GetData(), test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.name, cmd.GetData(), test.want)
+		}
+	}
+}
+
+func TestFilterPipelineExcludeShapes(t *testing.T) {
+	p := createFilterPipeline(t, `{"filter":["c","n.c"],"mode":"exclude"}`)
+
+	tests := []struct {
+		name string
+		data interface{}
+		want interface{}
+	}{
+		{
+			"slice of maps",
+			[]map[string]interface{}{{"a": 1, "c": 3}},
+			[]map[string]interface{}{{"a": 1}},
+		},
+		{
+			"bson.D",
+			primitive.D{{Key: "c", Value: 3}, {Key: "n", Value: primitive.A{primitive.M{"b": 2, "c": 3}}}},
+			primitive.D{{Key: "n", Value: primitive.A{primitive.M{"b": 2}}}},
+		},
+	}
+
+	for _, test := range tests {
+		cmd := &command.BaseCommand{Data: test.data}
+		p.Apply(cmd)
+		if !reflect.DeepEqual(cmd.GetData(), test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.name, cmd.GetData(), test.want)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/thinksystemio/package-flow/command"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MapPipeline reshapes command data by applying its rules in order.
+// Arrays of objects have the rules applied to every element. The data
+// is changed in place, so every edge using the pipeline receives its
+// own copy.
+type MapPipeline struct {
+	BasePipeline
+	Rules []command.MapRule `json:"rules"`
+
+	mu sync.RWMutex
+}
+
+//
+// MapPipeline Base
+//
+
+func NewMapPipeline(cmd *command.CreatePipeline) Pipeline {
+	pipeline := &MapPipeline{
+		Rules: []command.MapRule{},
+	}
+
+	pipeline.ID = primitive.NewObjectID().Hex()
+	pipeline.Name = cmd.Name
+	pipeline.Type = "map"
+	return pipeline
+}
+
+//
+// MapPipeline Command API
+//
+
+// UpdateMapPipeline replaces the rules. Invalid rules leave the
+// pipeline unchanged.
+func (pipeline *MapPipeline) UpdateMapPipeline(cmd *command.UpdateMapPipeline) {
+	for i, rule := range cmd.Rules {
+		if err := validMapRule(rule); err != nil {
+			cmd.AppendError(command.Invalid(fmt.Sprintf("rules[%d]", i), "rule %d: %v", i, err).WithPipeline(pipeline.ID))
+			return
+		}
+	}
+
+	pipeline.mu.Lock()
+	pipeline.Rules = cmd.Rules
+	pipeline.mu.Unlock()
+}
+
+//
+// MapPipeline Utils
+//
+
+func (pipeline *MapPipeline) Apply(cmd command.Command) bool {
+	pipeline.mu.RLock()
+	rules := pipeline.Rules
+	pipeline.mu.RUnlock()
+
+	cmd.SetData(applyMapRules(cmd.GetData(), rules))
+	return true
+}
+
+func (pipeline *MapPipeline) Mutates() bool {
+	return true
+}
+
+func (pipeline *MapPipeline) ToJSON() ([]byte, error) {
+	pipeline.mu.RLock()
+	defer pipeline.mu.RUnlock()
+	return json.Marshal(pipeline)
+}
+
+func (pipeline *MapPipeline) restore() error {
+	for i, rule := range pipeline.Rules {
+		if err := validMapRule(rule); err != nil {
+			return fmt.Errorf("rule %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func validMapRule(rule command.MapRule) error {
+	switch strings.ToLower(rule.Op) {
+	case command.MAP_RENAME, command.MAP_MOVE, command.MAP_COPY:
+		if len(splitPath(rule.From)) == 0 || len(splitPath(rule.To)) == 0 {
+			return fmt.Errorf("%s rule must have from and to", rule.Op)
+		}
+	case command.MAP_SET:
+		if len(splitPath(rule.To)) == 0 {
+			return fmt.Errorf("set rule must have to")
+		}
+	case command.MAP_DELETE:
+		if len(splitPath(rule.From)) == 0 {
+			return fmt.Errorf("delete rule must have from")
+		}
+	default:
+		return fmt.Errorf("invalid rule operator %s", rule.Op)
+	}
+	return nil
+}
+
+func applyMapRules(data interface{}, rules []command.MapRule) interface{} {
+	switch v := data.(type) {
+	case []interface{}:
+		for i, item := range v {
+			v[i] = applyMapRules(item, rules)
+		}
+		return v
+	case primitive.A:
+		for i, item := range v {
+			v[i] = applyMapRules(item, rules)
+		}
+		return v
+	case []map[string]interface{}:
+		for i, item := range v {
+			v[i] = applyMapRules(item, rules).(map[string]interface{})
+		}
+		return v
+	}
+
+	if !isObject(data) {
+		return data
+	}
+
+	for _, rule := range rules {
+		switch strings.ToLower(rule.Op) {
+		case command.MAP_RENAME, command.MAP_MOVE:
+			var value interface{}
+			var ok bool
+			data, value, ok = removePath(data, splitPath(rule.From))
+			if ok {
+				data = setPath(data, splitPath(rule.To), value)
+			}
+		case command.MAP_COPY:
+			if value, ok := lookupPath(data, strings.Join(splitPath(rule.From), ".")); ok {
+				data = setPath(data, splitPath(rule.To), copyValue(value))
+			}
+		case command.MAP_SET:
+			data = setPath(data, splitPath(rule.To), copyValue(rule.Value))
+		case command.MAP_DELETE:
+			data, _, _ = removePath(data, splitPath(rule.From))
+		}
+	}
+	return data
+}
+
+func isObject(data interface{}) bool {
+	switch data.(type) {
+	case map[string]interface{}, primitive.M, primitive.D:
+		return true
+	}
+	return false
+}
+
+// setPath puts a value at a path, creating objects of the parent's
+// kind along the way and replacing anything that is not an object. It
+// returns the object, which is only a new value for bson.D.
+func setPath(data interface{}, keys []string, value interface{}) interface{} {
+	key := keys[0]
+	if len(keys) > 1 {
+		child, ok := lookupKey(data, key)
+		if !ok || !isObject(child) {
+			child = emptyObject(data)
+		}
+		value = setPath(child, keys[1:], value)
+	}
+
+	switch object := data.(type) {
+	case map[string]interface{}:
+		object[key] = value
+	case primitive.M:
+		object[key] = value
+	case primitive.D:
+		for i, e := range object {
+			if e.Key == key {
+				object[i].Value = value
+				return object
+			}
+		}
+		return append(object, primitive.E{Key: key, Value: value})
+	}
+	return data
+}
+
+// removePath removes and returns the value at a path.
+func removePath(data interface{}, keys []string) (interface{}, interface{}, bool) {
+	key := keys[0]
+	if len(keys) > 1 {
+		child, ok := lookupKey(data, key)
+		if !ok || !isObject(child) {
+			return data, nil, false
+		}
+
+		child, value, ok := removePath(child, keys[1:])
+		if ok {
+			data = setPath(data, keys[:1], child)
+		}
+		return data, value, ok
+	}
+
+	value, ok := lookupKey(data, key)
+	if !ok {
+		return data, nil, false
+	}
+
+	switch object := data.(type) {
+	case map[string]interface{}:
+		delete(object, key)
+	case primitive.M:
+		delete(object, key)
+	case primitive.D:
+		result := make(primitive.D, 0, len(object)-1)
+		for _, e := range object {
+			if e.Key != key {
+				result = append(result, e)
+			}
+		}
+		return result, value, true
+	}
+	return data, value, true
+}
+
+func emptyObject(parent interface{}) interface{} {
+	switch parent.(type) {
+	case primitive.M:
+		return primitive.M{}
+	case primitive.D:
+		return primitive.D{}
+	}
+	return map[string]interface{}{}
+}
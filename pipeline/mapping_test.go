@@ -0,0 +1,101 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/thinksystemio/package-flow/command"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func createMapPipeline(t *testing.T, rules string) *MapPipeline {
+	p := NewMapPipeline(&command.CreatePipeline{Name: "map"}).(*MapPipeline)
+	cmd := &command.UpdateMapPipeline{}
+	if err := json.Unmarshal([]byte(rules), &cmd.Rules); err != nil {
+		t.Fatal(err)
+	}
+
+	p.UpdateMapPipeline(cmd)
+	if cmd.HasErrors() {
+		t.Fatalf("rules %s returned errors: %v", rules, cmd.GetErrors())
+	}
+	return p
+}
+
+func TestMapPipeline(t *testing.T) {
+	p := createMapPipeline(t, `[
+		{"op":"rename","from":"first_name","to":"firstName"},
+		{"op":"move","from":"address.city","to":"city"},
+		{"op":"move","from":"zip","to":"location.zip"},
+		{"op":"copy","from":"city","to":"location.city"},
+		{"op":"set","to":"source","value":"feed"},
+		{"op":"delete","from":"internal"}
+	]`)
+
+	cmd := &command.BaseCommand{Data: map[string]interface{}{
+		"first_name": "alice",
+		"address":    map[string]interface{}{"city": "Paris", "street": "Rivoli"},
+		"zip":        "75001",
+		"internal":   true,
+	}}
+	p.Apply(cmd)
+
+	want := map[string]interface{}{
+		"firstName": "alice",
+		"address":   map[string]interface{}{"street": "Rivoli"},
+		"city":      "Paris",
+		"location":  map[string]interface{}{"zip": "75001", "city": "Paris"},
+		"source":    "feed",
+	}
+	if !reflect.DeepEqual(cmd.GetData(), want) {
+		t.Errorf("got %v, want %v", cmd.GetData(), want)
+	}
+}
+
+func TestMapPipelineSetIsCopied(t *testing.T) {
+	p := createMapPipeline(t, `[
+		{"op":"set","to":"meta","value":{"source":"feed"}},
+		{"op":"move","from":"user","to":"meta.user"}
+	]`)
+
+	first := &command.BaseCommand{Data: map[string]interface{}{"user": "alice"}}
+	p.Apply(first)
+	second := &command.BaseCommand{Data: map[string]interface{}{}}
+	p.Apply(second)
+
+	want := map[string]interface{}{"meta": map[string]interface{}{"source": "feed"}}
+	if !reflect.DeepEqual(second.GetData(), want) {
+		t.Errorf("got %v, want %v", second.GetData(), want)
+	}
+	if !reflect.DeepEqual(p.Rules[0].Value, map[string]interface{}{"source": "feed"}) {
+		t.Errorf("rule value changed to %v", p.Rules[0].Value)
+	}
+}
+
+func TestMapPipelineShapes(t *testing.T) {
+	p := createMapPipeline(t, `[{"op":"rename","from":"a","to":"n.b"}]`)
+
+	cmd := &command.BaseCommand{Data: []interface{}{
+		primitive.D{{Key: "a", Value: 1}, {Key: "c", Value: 3}},
+		primitive.M{"a": 2},
+	}}
+	p.Apply(cmd)
+
+	want := []interface{}{
+		primitive.D{{Key: "c", Value: 3}, {Key: "n", Value: primitive.D{{Key: "b", Value: 1}}}},
+		primitive.M{"n": primitive.M{"b": 2}},
+	}
+	if !reflect.DeepEqual(cmd.GetData(), want) {
+		t.Errorf("got %#v, want %#v", cmd.GetData(), want)
+	}
+}
+
+func TestMapPipelineInvalid(t *testing.T) {
+	p := NewMapPipeline(&command.CreatePipeline{Name: "map"}).(*MapPipeline)
+	cmd := &command.UpdateMapPipeline{Rules: []command.MapRule{{Op: "rename", From: "a"}}}
+	p.UpdateMapPipeline(cmd)
+	if !cmd.HasErrors() {
+		t.Error("rename without to should be rejected")
+	}
+}
@@ -0,0 +1,225 @@
+package pipeline
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// lookupPath reads a dot separated path such as "user.address.city"
+// from nested objects.
+func lookupPath(data interface{}, path string) (interface{}, bool) {
+	current := data
+	for _, key := range strings.Split(path, ".") {
+		value, ok := lookupKey(current, key)
+		if !ok {
+			return nil, false
+		}
+		current = value
+	}
+	return current, true
+}
+
+// lookupKey reads a single key from any of the object shapes a
+// command can carry.
+func lookupKey(data interface{}, key string) (interface{}, bool) {
+	switch object := data.(type) {
+	case map[string]interface{}:
+		value, ok := object[key]
+		return value, ok
+	case primitive.M:
+		value, ok := object[key]
+		return value, ok
+	case primitive.D:
+		for _, e := range object {
+			if e.Key == key {
+				return e.Value, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// copyValue copies objects and arrays recursively so that a value put
+// into command data shares nothing with where it came from.
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[key] = copyValue(item)
+		}
+		return result
+	case primitive.M:
+		return primitive.M(copyValue(map[string]interface{}(v)).(map[string]interface{}))
+	case primitive.D:
+		result := make(primitive.D, 0, len(v))
+		for _, e := range v {
+			result = append(result, primitive.E{Key: e.Key, Value: copyValue(e.Value)})
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			result = append(result, copyValue(item))
+		}
+		return result
+	case primitive.A:
+		return primitive.A(copyValue([]interface{}(v)).([]interface{}))
+	}
+	return value
+}
+
+// pathTree merges a list of paths into a tree so that a projection
+// walks the data once. "items[].sku" and "items.sku" are the same
+// path; arrays are always traversed element by element.
+type pathTree struct {
+	leaf     bool
+	children map[string]*pathTree
+}
+
+func newPathTree(paths []string) *pathTree {
+	root := &pathTree{children: map[string]*pathTree{}}
+	for _, path := range paths {
+		current := root
+		for _, key := range splitPath(path) {
+			child, ok := current.children[key]
+			if !ok {
+				child = &pathTree{children: map[string]*pathTree{}}
+				current.children[key] = child
+			}
+			current = child
+		}
+		current.leaf = true
+	}
+	return root
+}
+
+// splitPath splits a path on dots and drops the "[]" array markers.
+func splitPath(path string) []string {
+	keys := []string{}
+	for _, key := range strings.Split(path, ".") {
+		key = strings.TrimSuffix(key, "[]")
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// include keeps only the values on the tree's paths. Objects keep
+// their type and arrays keep one entry per object or array element.
+// It reports false when none of the paths exist in the value, in
+// which case a scalar yields nil and an object an empty object.
+func (tree *pathTree) include(value interface{}) (interface{}, bool) {
+	if tree.leaf {
+		return value, true
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := map[string]interface{}{}
+		for key, child := range tree.children {
+			if item, ok := v[key]; ok {
+				if projected, ok := child.include(item); ok {
+					result[key] = projected
+				}
+			}
+		}
+		return result, len(result) != 0
+	case primitive.M:
+		result, ok := tree.include(map[string]interface{}(v))
+		return primitive.M(result.(map[string]interface{})), ok
+	case primitive.D:
+		result := primitive.D{}
+		for _, e := range v {
+			if child, ok := tree.children[e.Key]; ok {
+				if projected, ok := child.include(e.Value); ok {
+					result = append(result, primitive.E{Key: e.Key, Value: projected})
+				}
+			}
+		}
+		return result, len(result) != 0
+	case []map[string]interface{}:
+		result := make([]map[string]interface{}, 0, len(v))
+		found := false
+		for _, item := range v {
+			projected, ok := tree.include(item)
+			result = append(result, projected.(map[string]interface{}))
+			found = found || ok
+		}
+		return result, found
+	case []interface{}:
+		result := make([]interface{}, 0, len(v))
+		found := false
+		for _, item := range v {
+			projected, ok := tree.include(item)
+			if projected != nil {
+				result = append(result, projected)
+			}
+			found = found || ok
+		}
+		return result, found
+	case primitive.A:
+		result, ok := tree.include([]interface{}(v))
+		return primitive.A(result.([]interface{})), ok
+	}
+
+	return nil, false
+}
+
+// exclude removes the values on the tree's paths. Objects and arrays
+// on the way to a removed value are copied; everything else is shared
+// with the original.
+func (tree *pathTree) exclude(value interface{}) interface{} {
+	if len(tree.children) == 0 {
+		return value
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			child, ok := tree.children[key]
+			if !ok {
+				result[key] = item
+				continue
+			}
+			if !child.leaf {
+				result[key] = child.exclude(item)
+			}
+		}
+		return result
+	case primitive.M:
+		return primitive.M(tree.exclude(map[string]interface{}(v)).(map[string]interface{}))
+	case primitive.D:
+		result := make(primitive.D, 0, len(v))
+		for _, e := range v {
+			child, ok := tree.children[e.Key]
+			if !ok {
+				result = append(result, e)
+				continue
+			}
+			if !child.leaf {
+				result = append(result, primitive.E{Key: e.Key, Value: child.exclude(e.Value)})
+			}
+		}
+		return result
+	case []map[string]interface{}:
+		result := make([]map[string]interface{}, 0, len(v))
+		for _, item := range v {
+			result = append(result, tree.exclude(item).(map[string]interface{}))
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			result = append(result, tree.exclude(item))
+		}
+		return result
+	case primitive.A:
+		return primitive.A(tree.exclude([]interface{}(v)).([]interface{}))
+	}
+
+	return value
+}
@@ -1,8 +1,8 @@
 package pipeline
 
 import (
+	"encoding/json"
 	"errors"
-	"strings"
 
 	"github.com/thinksystemio/package-flow/command"
 )
@@ -12,24 +12,111 @@ type Pipeline interface {
 	GetName() string
 	GetType() string
 
-	Apply(command.Command)
+	// Apply transforms the command and reports whether it should
+	// still be delivered to the child.
+	Apply(command.Command) bool
+	Mutates() bool
 
 	ToJSON() ([]byte, error)
 }
 
-func NewPipeline(command *command.CreatePipeline) Pipeline {
-	pipelineType := strings.ToLower(command.Type)
-
-	switch pipelineType {
-	case "base":
-		p := NewBasePipeline(command)
-		return p
-	case "filter":
-		p := NewFilterPipeline(command)
-		return p
-	default:
-		err := errors.New("Pipeline.New - invalid pipeline type")
-		command.AppendError(err)
+func NewPipeline(cmd *command.CreatePipeline) Pipeline {
+	factory, ok := lookupFactory(cmd.Type)
+	if !ok {
+		err := command.Invalid("type", "Pipeline.New - invalid pipeline type")
+		cmd.AppendError(err)
 		return nil
 	}
+
+	return factory(cmd)
+}
+
+// Resolver is implemented by pipelines that reference other
+// pipelines. After FromJSON, Resolve must be called once every
+// referenced pipeline can be looked up by ID.
+type Resolver interface {
+	Resolve(lookup func(string) (Pipeline, error)) error
+}
+
+// Receiver is a node a pipeline can deliver commands to directly.
+type Receiver interface {
+	GetID() string
+	Enqueue(command.Command)
+}
+
+// ErrorRouter is implemented by pipelines that deliver rejected
+// commands to an error child. GetErrorChild returns the child's ID,
+// which must be set again with SetErrorChild after FromJSON.
+type ErrorRouter interface {
+	GetErrorChild() string
+	SetErrorChild(Receiver)
+}
+
+// Viewer is implemented by pipelines whose config holds secrets.
+// ViewJSON is ToJSON without them, for sending to clients; ToJSON keeps
+// them so that snapshots restore the pipeline.
+type Viewer interface {
+	ViewJSON() ([]byte, error)
+}
+
+// ViewJSON returns the JSON of a pipeline that can be sent to clients.
+func ViewJSON(p Pipeline) ([]byte, error) {
+	if viewer, ok := p.(Viewer); ok {
+		return viewer.ViewJSON()
+	}
+	return p.ToJSON()
+}
+
+// Closer is implemented by pipelines that hold resources, such as a
+// compiled wasm runtime, which must be released once the tree drops
+// the pipeline.
+type Closer interface {
+	Close() error
+}
+
+// Close releases the resources of a pipeline, if it holds any. A
+// closed pipeline must not be applied again.
+func Close(p Pipeline) error {
+	if closer, ok := p.(Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// restorer is implemented by pipelines that derive unexported state,
+// such as compiled expressions, from their serialized config.
+type restorer interface {
+	restore() error
+}
+
+// FromJSON rebuilds a pipeline from the output of its ToJSON method,
+// keeping the original ID.
+func FromJSON(data []byte) (Pipeline, error) {
+	header := &BasePipeline{}
+	if err := json.Unmarshal(data, header); err != nil {
+		return nil, err
+	}
+
+	pipelineType := header.Type
+	if pipelineType == "" {
+		pipelineType = "base"
+	}
+
+	factory, ok := lookupFactory(pipelineType)
+	if !ok {
+		return nil, errors.New("Pipeline.FromJSON - invalid pipeline type")
+	}
+	p := factory(&command.CreatePipeline{Name: header.Name, Type: pipelineType})
+
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+
+	if r, ok := p.(restorer); ok {
+		if err := r.restore(); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
 }
@@ -0,0 +1,284 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/thinksystemio/package-flow/command"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PredicatePipeline drops every command whose data does not satisfy
+// its condition. Without a condition every command is delivered.
+type PredicatePipeline struct {
+	BasePipeline
+	Condition *command.Condition `json:"condition"`
+
+	predicate predicate
+	mu        sync.RWMutex
+}
+
+type predicate func(data interface{}) bool
+
+//
+// PredicatePipeline Base
+//
+
+func NewPredicatePipeline(cmd *command.CreatePipeline) Pipeline {
+	pipeline := &PredicatePipeline{}
+
+	pipeline.ID = primitive.NewObjectID().Hex()
+	pipeline.Name = cmd.Name
+	pipeline.Type = "predicate"
+	return pipeline
+}
+
+//
+// PredicatePipeline Command API
+//
+
+// UpdatePredicatePipeline compiles the condition and replaces the
+// current one. An invalid condition leaves the pipeline unchanged.
+func (pipeline *PredicatePipeline) UpdatePredicatePipeline(cmd *command.UpdatePredicatePipeline) {
+	compiled, err := compileCondition(cmd.Condition)
+	if err != nil {
+		cmd.AppendError(command.Invalid("condition", "%v", err).WithPipeline(pipeline.ID))
+		return
+	}
+
+	pipeline.mu.Lock()
+	pipeline.Condition = cmd.Condition
+	pipeline.predicate = compiled
+	pipeline.mu.Unlock()
+}
+
+//
+// PredicatePipeline Utils
+//
+
+func (pipeline *PredicatePipeline) Apply(cmd command.Command) bool {
+	pipeline.mu.RLock()
+	predicate := pipeline.predicate
+	pipeline.mu.RUnlock()
+
+	if predicate == nil {
+		return true
+	}
+	return predicate(cmd.GetData())
+}
+
+func (pipeline *PredicatePipeline) ToJSON() ([]byte, error) {
+	pipeline.mu.RLock()
+	defer pipeline.mu.RUnlock()
+	return json.Marshal(pipeline)
+}
+
+func (pipeline *PredicatePipeline) restore() error {
+	if pipeline.Condition == nil {
+		return nil
+	}
+
+	compiled, err := compileCondition(pipeline.Condition)
+	if err != nil {
+		return err
+	}
+	pipeline.predicate = compiled
+	return nil
+}
+
+func compileCondition(condition *command.Condition) (predicate, error) {
+	if condition == nil {
+		return nil, fmt.Errorf("condition must not be empty")
+	}
+
+	op := strings.ToLower(condition.Op)
+	switch op {
+	case "and", "or":
+		if len(condition.Conditions) == 0 {
+			return nil, fmt.Errorf("%s condition must have conditions", op)
+		}
+
+		compiled := []predicate{}
+		for i := range condition.Conditions {
+			p, err := compileCondition(&condition.Conditions[i])
+			if err != nil {
+				return nil, err
+			}
+			compiled = append(compiled, p)
+		}
+
+		if op == "and" {
+			return func(data interface{}) bool {
+				for _, p := range compiled {
+					if !p(data) {
+						return false
+					}
+				}
+				return true
+			}, nil
+		}
+		return func(data interface{}) bool {
+			for _, p := range compiled {
+				if p(data) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "not":
+		if len(condition.Conditions) != 1 {
+			return nil, fmt.Errorf("not condition must have exactly one condition")
+		}
+
+		p, err := compileCondition(&condition.Conditions[0])
+		if err != nil {
+			return nil, err
+		}
+		return func(data interface{}) bool { return !p(data) }, nil
+	}
+
+	if condition.Field == "" {
+		return nil, fmt.Errorf("%s condition must have a field", op)
+	}
+	field := condition.Field
+	want := condition.Value
+
+	switch op {
+	case "exists":
+		return func(data interface{}) bool {
+			_, ok := lookupPath(data, field)
+			return ok
+		}, nil
+	case "eq", "ne":
+		return func(data interface{}) bool {
+			value, ok := lookupPath(data, field)
+			return ok && equal(value, want) == (op == "eq")
+		}, nil
+	case "gt", "gte", "lt", "lte":
+		if _, ok := normalizeValue(want); !ok {
+			return nil, fmt.Errorf("%s condition value must be a number or string", op)
+		}
+		return func(data interface{}) bool {
+			value, ok := lookupPath(data, field)
+			if !ok {
+				return false
+			}
+			result, ok := compare(value, want)
+			if !ok {
+				return false
+			}
+			switch op {
+			case "gt":
+				return result > 0
+			case "gte":
+				return result >= 0
+			case "lt":
+				return result < 0
+			default:
+				return result <= 0
+			}
+		}, nil
+	case "in":
+		values := condition.Values
+		return func(data interface{}) bool {
+			value, ok := lookupPath(data, field)
+			if !ok {
+				return false
+			}
+			for _, v := range values {
+				if equal(value, v) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "regex":
+		pattern, ok := want.(string)
+		if !ok {
+			return nil, fmt.Errorf("regex condition value must be a string")
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return func(data interface{}) bool {
+			value, ok := lookupPath(data, field)
+			if !ok {
+				return false
+			}
+			s, ok := value.(string)
+			return ok && re.MatchString(s)
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid condition operator %s", condition.Op)
+	}
+}
+
+// normalizeValue converts numbers to float64 so that values decoded from
+// JSON, bson and Go literals compare equal.
+func normalizeValue(v interface{}) (interface{}, bool) {
+	switch value := v.(type) {
+	case string:
+		return value, true
+	case float64:
+		return value, true
+	case float32:
+		return float64(value), true
+	case int:
+		return float64(value), true
+	case int32:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case uint:
+		return float64(value), true
+	case uint32:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	}
+	return nil, false
+}
+
+// compare returns -1, 0 or 1. It fails when the values are not both
+// numbers or both strings.
+func compare(a, b interface{}) (int, bool) {
+	a, aok := normalizeValue(a)
+	b, bok := normalizeValue(b)
+	if !aok || !bok {
+		return 0, false
+	}
+
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		if x < y {
+			return -1, true
+		}
+		if x > y {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	}
+	return 0, false
+}
+
+func equal(a, b interface{}) bool {
+	if result, ok := compare(a, b); ok {
+		return result == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,92 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/thinksystemio/package-flow/command"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func createPredicate(t *testing.T, condition string) *PredicatePipeline {
+	p := NewPredicatePipeline(&command.CreatePipeline{Name: "predicate"}).(*PredicatePipeline)
+	cmd := &command.UpdatePredicatePipeline{Condition: &command.Condition{}}
+	if err := json.Unmarshal([]byte(condition), cmd.Condition); err != nil {
+		t.Fatal(err)
+	}
+
+	p.UpdatePredicatePipeline(cmd)
+	if cmd.HasErrors() {
+		t.Fatalf("condition %s returned errors: %v", condition, cmd.GetErrors())
+	}
+	return p
+}
+
+func TestPredicatePipeline(t *testing.T) {
+	data := map[string]interface{}{
+		"name":  "alice@example.com",
+		"age":   float64(30),
+		"user":  map[string]interface{}{"role": "admin"},
+		"count": 3,
+		"doc":   primitive.D{{Key: "status", Value: "open"}},
+	}
+
+	tests := []struct {
+		condition string
+		want      bool
+	}{
+		{`{"op":"eq","field":"user.role","value":"admin"}`, true},
+		{`{"op":"ne","field":"user.role","value":"admin"}`, false},
+		{`{"op":"eq","field":"count","value":3}`, true},
+		{`{"op":"gt","field":"age","value":18}`, true},
+		{`{"op":"lte","field":"age","value":18}`, false},
+		{`{"op":"exists","field":"user.role"}`, true},
+		{`{"op":"exists","field":"user.missing"}`, false},
+		{`{"op":"regex","field":"name","value":"@example\\.com$"}`, true},
+		{`{"op":"in","field":"doc.status","values":["open","pending"]}`, true},
+		{`{"op":"in","field":"doc.status","values":["closed"]}`, false},
+		{`{"op":"and","conditions":[{"op":"exists","field":"name"},{"op":"gt","field":"age","value":40}]}`, false},
+		{`{"op":"or","conditions":[{"op":"exists","field":"missing"},{"op":"gt","field":"age","value":20}]}`, true},
+		{`{"op":"not","conditions":[{"op":"exists","field":"missing"}]}`, true},
+	}
+
+	for _, test := range tests {
+		p := createPredicate(t, test.condition)
+		if got := p.Apply(&command.BaseCommand{Data: data}); got != test.want {
+			t.Errorf("%s returned %v, want %v", test.condition, got, test.want)
+		}
+	}
+}
+
+func TestPredicatePipelineInvalid(t *testing.T) {
+	conditions := []string{
+		`{"op":"unknown","field":"a"}`,
+		`{"op":"eq"}`,
+		`{"op":"regex","field":"a","value":"("}`,
+		`{"op":"not","conditions":[]}`,
+		`{"op":"gt","field":"a","value":true}`,
+	}
+
+	for _, condition := range conditions {
+		p := NewPredicatePipeline(&command.CreatePipeline{Name: "predicate"}).(*PredicatePipeline)
+		cmd := &command.UpdatePredicatePipeline{Condition: &command.Condition{}}
+		json.Unmarshal([]byte(condition), cmd.Condition)
+		p.UpdatePredicatePipeline(cmd)
+		if !cmd.HasErrors() {
+			t.Errorf("condition %s should be rejected", condition)
+		}
+	}
+}
+
+func TestPredicatePipelineFromJSON(t *testing.T) {
+	p := createPredicate(t, `{"op":"eq","field":"a","value":1}`)
+	JSON, _ := p.ToJSON()
+
+	restored, err := FromJSON(JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Apply(&command.BaseCommand{Data: map[string]interface{}{"a": 2}}) {
+		t.Error("restored predicate should drop non matching data")
+	}
+}
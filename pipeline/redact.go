@@ -0,0 +1,266 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/thinksystemio/package-flow/command"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// redactPatterns are the built in patterns a rule can use by name.
+var redactPatterns = map[string]string{
+	"email": `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	"card":  `\b(?:\d[ -]?){12,18}\d\b`,
+	"phone": `\+?\d[\d\s().-]{6,}\d`,
+}
+
+// RedactPipeline strips or masks sensitive values before data leaves
+// the tree. Rules are applied in order, so a path rule that removes a
+// field stops later pattern rules from seeing it.
+type RedactPipeline struct {
+	BasePipeline
+	Rules []command.RedactRule `json:"rules"`
+
+	patterns []*regexp.Regexp
+	mu       sync.RWMutex
+}
+
+//
+// RedactPipeline Base
+//
+
+func NewRedactPipeline(cmd *command.CreatePipeline) Pipeline {
+	pipeline := &RedactPipeline{
+		Rules:    []command.RedactRule{},
+		patterns: []*regexp.Regexp{},
+	}
+
+	pipeline.ID = primitive.NewObjectID().Hex()
+	pipeline.Name = cmd.Name
+	pipeline.Type = "redact"
+	return pipeline
+}
+
+//
+// RedactPipeline Command API
+//
+
+// UpdateRedactPipeline replaces the rules. Invalid rules leave the
+// pipeline unchanged.
+func (pipeline *RedactPipeline) UpdateRedactPipeline(cmd *command.UpdateRedactPipeline) {
+	patterns, err := compileRedactRules(cmd.Rules)
+	if err != nil {
+		cmd.AppendError(command.Invalid("rules", "%v", err).WithPipeline(pipeline.ID))
+		return
+	}
+
+	pipeline.mu.Lock()
+	pipeline.Rules = cmd.Rules
+	pipeline.patterns = patterns
+	pipeline.mu.Unlock()
+}
+
+//
+// RedactPipeline Utils
+//
+
+func (pipeline *RedactPipeline) Apply(cmd command.Command) bool {
+	pipeline.mu.RLock()
+	rules := pipeline.Rules
+	patterns := pipeline.patterns
+	pipeline.mu.RUnlock()
+
+	data := cmd.GetData()
+	for i, rule := range rules {
+		if patterns[i] != nil {
+			data = redactStrings(data, patterns[i], rule)
+		} else {
+			data = redactPath(data, splitPath(rule.Path), rule)
+		}
+	}
+	cmd.SetData(data)
+	return true
+}
+
+func (pipeline *RedactPipeline) Mutates() bool {
+	return true
+}
+
+func (pipeline *RedactPipeline) ToJSON() ([]byte, error) {
+	pipeline.mu.RLock()
+	defer pipeline.mu.RUnlock()
+	return json.Marshal(pipeline)
+}
+
+// ViewJSON leaves out the salts, which would let clients brute-force
+// hashed values.
+func (pipeline *RedactPipeline) ViewJSON() ([]byte, error) {
+	pipeline.mu.RLock()
+	defer pipeline.mu.RUnlock()
+
+	rules := make([]command.RedactRule, len(pipeline.Rules))
+	for i, rule := range pipeline.Rules {
+		rule.Salt = ""
+		rules[i] = rule
+	}
+	return json.Marshal(struct {
+		BasePipeline
+		Rules []command.RedactRule `json:"rules"`
+	}{pipeline.BasePipeline, rules})
+}
+
+func (pipeline *RedactPipeline) restore() error {
+	patterns, err := compileRedactRules(pipeline.Rules)
+	if err != nil {
+		return err
+	}
+	pipeline.patterns = patterns
+	return nil
+}
+
+// compileRedactRules validates the rules and compiles their patterns.
+// Path rules have a nil pattern.
+func compileRedactRules(rules []command.RedactRule) ([]*regexp.Regexp, error) {
+	patterns := make([]*regexp.Regexp, 0, len(rules))
+	for i, rule := range rules {
+		pattern, err := compileRedactRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+func compileRedactRule(rule command.RedactRule) (*regexp.Regexp, error) {
+	switch strings.ToLower(rule.Op) {
+	case command.REDACT_REMOVE, command.REDACT_REPLACE:
+	case command.REDACT_HASH:
+		if rule.Salt == "" {
+			return nil, errors.New("hash rule must have a salt")
+		}
+	case command.REDACT_MASK:
+		if rule.Keep < 0 {
+			return nil, errors.New("mask rule must keep 0 or more characters")
+		}
+	default:
+		return nil, fmt.Errorf("invalid rule operator %s", rule.Op)
+	}
+
+	hasPath := len(splitPath(rule.Path)) > 0
+	if hasPath == (rule.Pattern != "") {
+		return nil, errors.New("rule must have either a path or a pattern")
+	}
+	if hasPath {
+		return nil, nil
+	}
+
+	pattern := rule.Pattern
+	if builtin, ok := redactPatterns[strings.ToLower(pattern)]; ok {
+		pattern = builtin
+	}
+	return regexp.Compile(pattern)
+}
+
+// redactPath applies a rule to the value at a path. Arrays are
+// traversed element by element.
+func redactPath(data interface{}, keys []string, rule command.RedactRule) interface{} {
+	switch v := data.(type) {
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactPath(item, keys, rule)
+		}
+		return v
+	case primitive.A:
+		for i, item := range v {
+			v[i] = redactPath(item, keys, rule)
+		}
+		return v
+	case []map[string]interface{}:
+		for i, item := range v {
+			v[i] = redactPath(item, keys, rule).(map[string]interface{})
+		}
+		return v
+	}
+
+	if !isObject(data) {
+		return data
+	}
+
+	value, ok := lookupKey(data, keys[0])
+	if !ok {
+		return data
+	}
+
+	if len(keys) > 1 {
+		return setPath(data, keys[:1], redactPath(value, keys[1:], rule))
+	}
+	if strings.ToLower(rule.Op) == command.REDACT_REMOVE {
+		data, _, _ = removePath(data, keys)
+		return data
+	}
+	return setPath(data, keys, redactValue(value, rule))
+}
+
+// redactStrings applies a rule to every match of pattern in every
+// string of the data, including strings nested in objects and arrays.
+func redactStrings(data interface{}, pattern *regexp.Regexp, rule command.RedactRule) interface{} {
+	switch v := data.(type) {
+	case string:
+		return pattern.ReplaceAllStringFunc(v, func(match string) string {
+			if strings.ToLower(rule.Op) == command.REDACT_REMOVE {
+				return ""
+			}
+			return fmt.Sprint(redactValue(match, rule))
+		})
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = redactStrings(value, pattern, rule)
+		}
+	case primitive.M:
+		for key, value := range v {
+			v[key] = redactStrings(value, pattern, rule)
+		}
+	case primitive.D:
+		for i, e := range v {
+			v[i].Value = redactStrings(e.Value, pattern, rule)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactStrings(item, pattern, rule)
+		}
+	case primitive.A:
+		for i, item := range v {
+			v[i] = redactStrings(item, pattern, rule)
+		}
+	case []map[string]interface{}:
+		for i, item := range v {
+			v[i] = redactStrings(item, pattern, rule).(map[string]interface{})
+		}
+	}
+	return data
+}
+
+func redactValue(value interface{}, rule command.RedactRule) interface{} {
+	switch strings.ToLower(rule.Op) {
+	case command.REDACT_HASH:
+		sum := sha256.Sum256([]byte(rule.Salt + fmt.Sprint(value)))
+		return hex.EncodeToString(sum[:])
+	case command.REDACT_MASK:
+		runes := []rune(fmt.Sprint(value))
+		for i := 0; i < len(runes)-rule.Keep; i++ {
+			runes[i] = '*'
+		}
+		return string(runes)
+	case command.REDACT_REPLACE:
+		return rule.Value
+	}
+	return value
+}
@@ -0,0 +1,78 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/thinksystemio/package-flow/command"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func createRedactPipeline(t *testing.T, rules string) *RedactPipeline {
+	p := NewRedactPipeline(&command.CreatePipeline{Name: "redact"}).(*RedactPipeline)
+	cmd := &command.UpdateRedactPipeline{}
+	if err := json.Unmarshal([]byte(rules), &cmd.Rules); err != nil {
+		t.Fatal(err)
+	}
+
+	p.UpdateRedactPipeline(cmd)
+	if cmd.HasErrors() {
+		t.Fatalf("rules %s returned errors: %v", rules, cmd.GetErrors())
+	}
+	return p
+}
+
+func TestRedactPipeline(t *testing.T) {
+	p := createRedactPipeline(t, `[
+		{"op":"remove","path":"password"},
+		{"op":"hash","path":"user.id","salt":"s"},
+		{"op":"mask","path":"accounts[].iban","keep":4},
+		{"op":"replace","path":"ssn","value":"[hidden]"},
+		{"op":"mask","pattern":"email"},
+		{"op":"replace","pattern":"card","value":"[card]"}
+	]`)
+
+	cmd := &command.BaseCommand{Data: primitive.D{
+		{Key: "password", Value: "secret"},
+		{Key: "user", Value: primitive.M{"id": 42}},
+		{Key: "accounts", Value: primitive.A{primitive.M{"iban": "FR7630006000"}}},
+		{Key: "ssn", Value: "123-45-6789"},
+		{Key: "notes", Value: []interface{}{"mail a@b.io", "paid with 4111 1111 1111 1111"}},
+	}}
+	p.Apply(cmd)
+
+	sum := sha256.Sum256([]byte("s42"))
+	want := primitive.D{
+		{Key: "user", Value: primitive.M{"id": hex.EncodeToString(sum[:])}},
+		{Key: "accounts", Value: primitive.A{primitive.M{"iban": "********6000"}}},
+		{Key: "ssn", Value: "[hidden]"},
+		{Key: "notes", Value: []interface{}{"mail ******", "paid with [card]"}},
+	}
+	if !reflect.DeepEqual(cmd.GetData(), want) {
+		t.Errorf("got %v, want %v", cmd.GetData(), want)
+	}
+}
+
+func TestRedactPipelineInvalid(t *testing.T) {
+	invalid := []string{
+		`[{"op":"scramble","path":"a"}]`,
+		`[{"op":"remove"}]`,
+		`[{"op":"remove","path":"a","pattern":"email"}]`,
+		`[{"op":"hash","path":"a"}]`,
+		`[{"op":"mask","pattern":"("}]`,
+	}
+
+	for _, rules := range invalid {
+		cmd := &command.UpdateRedactPipeline{}
+		if err := json.Unmarshal([]byte(rules), &cmd.Rules); err != nil {
+			t.Fatal(err)
+		}
+		NewRedactPipeline(&command.CreatePipeline{}).(*RedactPipeline).UpdateRedactPipeline(cmd)
+		if !cmd.HasErrors() {
+			t.Errorf("rules %s: expected an error", rules)
+		}
+	}
+}
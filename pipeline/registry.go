@@ -0,0 +1,68 @@
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/thinksystemio/package-flow/command"
+)
+
+// Factory creates a pipeline of a registered type. FromJSON also uses
+// it to create the pipeline a serialized one is decoded into.
+type Factory func(cmd *command.CreatePipeline) Pipeline
+
+var (
+	factories   = map[string]Factory{}
+	factoriesMu sync.RWMutex
+)
+
+// RegisterPipelineType makes NewPipeline and FromJSON create pipelines
+// of a type with factory. Types are case insensitive. It panics if the
+// type is empty or already registered, so it is meant to be called
+// from init.
+func RegisterPipelineType(name string, factory Factory) {
+	name = strings.ToLower(name)
+	if name == "" || factory == nil {
+		panic("pipeline: RegisterPipelineType needs a name and a factory")
+	}
+
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("pipeline: type %s is already registered", name))
+	}
+	factories[name] = factory
+}
+
+func lookupFactory(name string) (Factory, bool) {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	factory, ok := factories[strings.ToLower(name)]
+	return factory, ok
+}
+
+// validType is the pipeline_type validation rule for command fields that
+// name a pipeline type.
+func validType(value interface{}) error {
+	if _, ok := lookupFactory(fmt.Sprint(value)); !ok {
+		return fmt.Errorf("unknown pipeline type %v", value)
+	}
+	return nil
+}
+
+func init() {
+	command.RegisterRule("pipeline_type", validType)
+
+	RegisterPipelineType("base", NewBasePipeline)
+	RegisterPipelineType("filter", NewFilterPipeline)
+	RegisterPipelineType("chain", NewChainPipeline)
+	RegisterPipelineType("predicate", NewPredicatePipeline)
+	RegisterPipelineType("map", NewMapPipeline)
+	RegisterPipelineType("expression", NewExpressionPipeline)
+	RegisterPipelineType("wasm", NewWasmPipeline)
+	RegisterPipelineType("redact", NewRedactPipeline)
+	RegisterPipelineType("schema", NewSchemaPipeline)
+}
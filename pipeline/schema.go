@@ -0,0 +1,180 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/thinksystemio/package-flow/command"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SchemaPipeline validates command data against a JSON Schema. Valid
+// commands pass unchanged. Invalid ones carry the validation errors
+// and are delivered to the error child instead of the edge's child.
+type SchemaPipeline struct {
+	BasePipeline
+	Schema     json.RawMessage `json:"schema,omitempty"`
+	ErrorChild string          `json:"error_child,omitempty"`
+
+	compiled   *jsonschema.Schema
+	errorChild Receiver
+	mu         sync.RWMutex
+}
+
+//
+// SchemaPipeline Base
+//
+
+func NewSchemaPipeline(cmd *command.CreatePipeline) Pipeline {
+	pipeline := &SchemaPipeline{}
+
+	pipeline.ID = primitive.NewObjectID().Hex()
+	pipeline.Name = cmd.Name
+	pipeline.Type = "schema"
+	return pipeline
+}
+
+//
+// SchemaPipeline Command API
+//
+
+// UpdateSchemaPipeline compiles and replaces the schema. A schema that
+// does not compile leaves the pipeline unchanged. The error child is
+// set separately with SetErrorChild once it has been looked up.
+func (pipeline *SchemaPipeline) UpdateSchemaPipeline(cmd *command.UpdateSchemaPipeline) {
+	compiled, err := compileSchema(cmd.Schema)
+	if err != nil {
+		cmd.AppendError(command.Invalid("schema", "%v", err).WithPipeline(pipeline.ID))
+		return
+	}
+
+	pipeline.mu.Lock()
+	pipeline.Schema = cmd.Schema
+	pipeline.compiled = compiled
+	pipeline.mu.Unlock()
+}
+
+// SetErrorChild sets the node that receives invalid commands. A nil
+// receiver drops them.
+func (pipeline *SchemaPipeline) SetErrorChild(receiver Receiver) {
+	pipeline.mu.Lock()
+	defer pipeline.mu.Unlock()
+
+	pipeline.errorChild = receiver
+	pipeline.ErrorChild = ""
+	if receiver != nil {
+		pipeline.ErrorChild = receiver.GetID()
+	}
+}
+
+//
+// SchemaPipeline Utils
+//
+
+func (pipeline *SchemaPipeline) GetErrorChild() string {
+	pipeline.mu.RLock()
+	defer pipeline.mu.RUnlock()
+	return pipeline.ErrorChild
+}
+
+// Apply validates the data. Invalid commands are enqueued on the error
+// child and not passed on.
+func (pipeline *SchemaPipeline) Apply(cmd command.Command) bool {
+	pipeline.mu.RLock()
+	compiled := pipeline.compiled
+	errorChild := pipeline.errorChild
+	pipeline.mu.RUnlock()
+
+	if compiled == nil {
+		return true
+	}
+
+	errs := validateSchema(compiled, cmd.GetData())
+	if len(errs) == 0 {
+		return true
+	}
+
+	for _, err := range errs {
+		cmd.AppendError(command.AsError(err).WithPipeline(pipeline.ID))
+	}
+	if errorChild != nil {
+		errorChild.Enqueue(cmd)
+	}
+	return false
+}
+
+func (pipeline *SchemaPipeline) ToJSON() ([]byte, error) {
+	pipeline.mu.RLock()
+	defer pipeline.mu.RUnlock()
+	return json.Marshal(pipeline)
+}
+
+func (pipeline *SchemaPipeline) restore() error {
+	if len(pipeline.Schema) == 0 {
+		return nil
+	}
+
+	compiled, err := compileSchema(pipeline.Schema)
+	if err != nil {
+		return err
+	}
+	pipeline.compiled = compiled
+	return nil
+}
+
+// compileSchema compiles a schema without access to anything outside
+// of it; references to files or URLs fail.
+func compileSchema(schema json.RawMessage) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	compiler.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("schema cannot load %s", url)
+	}
+
+	if err := compiler.AddResource("schema.json", bytes.NewReader(schema)); err != nil {
+		return nil, err
+	}
+	return compiler.Compile("schema.json")
+}
+
+// validateSchema returns one error per failed keyword, naming the
+// location of the value that failed as the field.
+func validateSchema(schema *jsonschema.Schema, data interface{}) []error {
+	// The validator only understands values decoded from JSON.
+	JSON, err := json.Marshal(data)
+	if err != nil {
+		return []error{err}
+	}
+	var value interface{}
+	if err := json.Unmarshal(JSON, &value); err != nil {
+		return []error{err}
+	}
+
+	err = schema.Validate(value)
+	if err == nil {
+		return nil
+	}
+
+	var validation *jsonschema.ValidationError
+	if !errors.As(err, &validation) {
+		return []error{err}
+	}
+
+	errs := []error{}
+	var flatten func(*jsonschema.ValidationError)
+	flatten = func(ve *jsonschema.ValidationError) {
+		if len(ve.Causes) == 0 {
+			err := command.Errorf(command.INVALID_ARGUMENT, "%s: %s", ve.InstanceLocation, ve.Message)
+			errs = append(errs, err.WithField(ve.InstanceLocation))
+		}
+		for _, cause := range ve.Causes {
+			flatten(cause)
+		}
+	}
+	flatten(validation)
+	return errs
+}
@@ -0,0 +1,83 @@
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/thinksystemio/package-flow/command"
+)
+
+type testReceiver struct {
+	received []command.Command
+}
+
+func (receiver *testReceiver) GetID() string {
+	return "receiver"
+}
+
+func (receiver *testReceiver) Enqueue(cmd command.Command) {
+	receiver.received = append(receiver.received, cmd)
+}
+
+func createSchemaPipeline(t *testing.T, schema string) *SchemaPipeline {
+	p := NewSchemaPipeline(&command.CreatePipeline{Name: "schema"}).(*SchemaPipeline)
+	cmd := &command.UpdateSchemaPipeline{Schema: []byte(schema)}
+
+	p.UpdateSchemaPipeline(cmd)
+	if cmd.HasErrors() {
+		t.Fatalf("schema %s returned errors: %v", schema, cmd.GetErrors())
+	}
+	return p
+}
+
+func TestSchemaPipeline(t *testing.T) {
+	p := createSchemaPipeline(t, `{
+		"type": "object",
+		"required": ["name", "age"],
+		"properties": {
+			"name": {"type": "string"},
+			"age": {"type": "integer", "minimum": 0}
+		}
+	}`)
+	receiver := &testReceiver{}
+	p.SetErrorChild(receiver)
+
+	valid := &command.BaseCommand{Data: map[string]interface{}{"name": "alice", "age": 30}}
+	if !p.Apply(valid) || valid.HasErrors() {
+		t.Errorf("valid data was rejected: %v", valid.GetErrors())
+	}
+
+	invalid := &command.BaseCommand{Data: map[string]interface{}{"name": 1, "age": -1}}
+	if p.Apply(invalid) {
+		t.Error("invalid data was passed on")
+	}
+	if len(invalid.GetErrors()) != 2 {
+		t.Errorf("expected 2 errors, got %v", invalid.GetErrors())
+	}
+	for _, err := range invalid.GetErrors() {
+		if err.Code != command.INVALID_ARGUMENT || (err.Field != "/name" && err.Field != "/age") || err.Pipeline != p.GetID() {
+			t.Errorf("unexpected error %+v", err)
+		}
+	}
+	if len(receiver.received) != 1 || receiver.received[0] != invalid {
+		t.Errorf("error child received %v", receiver.received)
+	}
+	if p.GetErrorChild() != "receiver" {
+		t.Errorf("error child is %s", p.GetErrorChild())
+	}
+}
+
+func TestSchemaPipelineInvalid(t *testing.T) {
+	p := NewSchemaPipeline(&command.CreatePipeline{Name: "schema"}).(*SchemaPipeline)
+
+	for _, schema := range []string{
+		`{"type": 1}`,
+		`{"$ref": "file:///etc/passwd"}`,
+		`not json`,
+	} {
+		cmd := &command.UpdateSchemaPipeline{Schema: []byte(schema)}
+		p.UpdateSchemaPipeline(cmd)
+		if !cmd.HasErrors() {
+			t.Errorf("schema %s: expected an error", schema)
+		}
+	}
+}
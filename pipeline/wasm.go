@@ -0,0 +1,253 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/thinksystemio/package-flow/command"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	DefaultWasmMemoryPages = 256
+	DefaultWasmTimeout     = 100
+
+	// MaxWasmMemoryPages is the 4GiB a 32-bit module can address.
+	MaxWasmMemoryPages = 65536
+)
+
+// WasmPipeline transforms command data with a WebAssembly module. The
+// module gets no imports and must export
+//
+//	memory
+//	alloc(size i32) i32
+//	transform(ptr i32, len i32) i64
+//
+// The data is written as JSON to the memory returned by alloc and
+// transform returns the transformed JSON as ptr<<32 | len, or a
+// negative value to drop the command. Every invocation runs in a new
+// instance, limited to MemoryPages pages of 64KiB and Timeout
+// milliseconds.
+type WasmPipeline struct {
+	BasePipeline
+	Module      []byte `json:"module"`
+	MemoryPages uint32 `json:"memory_pages"`
+	Timeout     int    `json:"timeout"`
+
+	runtime     wazero.Runtime
+	compiled    wazero.CompiledModule
+	invocations uint64
+	mu          sync.RWMutex
+}
+
+//
+// WasmPipeline Base
+//
+
+func NewWasmPipeline(cmd *command.CreatePipeline) Pipeline {
+	pipeline := &WasmPipeline{
+		MemoryPages: DefaultWasmMemoryPages,
+		Timeout:     DefaultWasmTimeout,
+	}
+
+	pipeline.ID = primitive.NewObjectID().Hex()
+	pipeline.Name = cmd.Name
+	pipeline.Type = "wasm"
+	return pipeline
+}
+
+//
+// WasmPipeline Command API
+//
+
+// UpdateWasmPipeline compiles and replaces the module and its limits.
+// A module that does not compile leaves the pipeline unchanged.
+func (pipeline *WasmPipeline) UpdateWasmPipeline(cmd *command.UpdateWasmPipeline) {
+	pages := cmd.MemoryPages
+	if pages == 0 {
+		pages = DefaultWasmMemoryPages
+	}
+	if pages > MaxWasmMemoryPages {
+		cmd.AppendError(command.Invalid("memory_pages", "memory_pages must be at most %d", MaxWasmMemoryPages).WithPipeline(pipeline.ID))
+		return
+	}
+	timeout := cmd.Timeout
+	if timeout == 0 {
+		timeout = DefaultWasmTimeout
+	}
+
+	runtime, compiled, err := compileWasm(cmd.Module, pages)
+	if err != nil {
+		cmd.AppendError(command.Invalid("module", "%v", err).WithPipeline(pipeline.ID))
+		return
+	}
+
+	pipeline.mu.Lock()
+	old := pipeline.runtime
+	pipeline.Module = cmd.Module
+	pipeline.MemoryPages = pages
+	pipeline.Timeout = timeout
+	pipeline.runtime = runtime
+	pipeline.compiled = compiled
+	pipeline.mu.Unlock()
+
+	if old != nil {
+		old.Close(context.Background())
+	}
+}
+
+//
+// WasmPipeline Utils
+//
+
+// Apply runs the module on the command data. A module that fails,
+// runs out of time or returns invalid JSON fails the command.
+func (pipeline *WasmPipeline) Apply(cmd command.Command) bool {
+	pipeline.mu.RLock()
+	defer pipeline.mu.RUnlock()
+
+	if pipeline.compiled == nil {
+		cmd.AppendError(command.Errorf(command.FAILED_PRECONDITION, "wasm pipeline %s has no module", pipeline.Name).WithPipeline(pipeline.ID))
+		return true
+	}
+
+	input, err := json.Marshal(cmd.GetData())
+	if err != nil {
+		cmd.AppendError(command.Errorf(command.INVALID_ARGUMENT, "%v", err).WithPipeline(pipeline.ID))
+		return true
+	}
+
+	output, keep, err := pipeline.invoke(input)
+	if err != nil {
+		cmd.AppendError(command.Errorf(command.UNKNOWN, "wasm pipeline %s: %v", pipeline.Name, err).WithPipeline(pipeline.ID))
+		return true
+	}
+	if !keep {
+		return false
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(output, &data); err != nil {
+		cmd.AppendError(command.Errorf(command.UNKNOWN, "wasm pipeline %s returned invalid JSON: %v", pipeline.Name, err).WithPipeline(pipeline.ID))
+		return true
+	}
+	cmd.SetData(data)
+	return true
+}
+
+func (pipeline *WasmPipeline) ToJSON() ([]byte, error) {
+	pipeline.mu.RLock()
+	defer pipeline.mu.RUnlock()
+	return json.Marshal(pipeline)
+}
+
+func (pipeline *WasmPipeline) restore() error {
+	if pipeline.MemoryPages == 0 {
+		pipeline.MemoryPages = DefaultWasmMemoryPages
+	}
+	if pipeline.Timeout == 0 {
+		pipeline.Timeout = DefaultWasmTimeout
+	}
+	if len(pipeline.Module) == 0 {
+		return nil
+	}
+
+	runtime, compiled, err := compileWasm(pipeline.Module, pipeline.MemoryPages)
+	if err != nil {
+		return err
+	}
+	pipeline.runtime = runtime
+	pipeline.compiled = compiled
+	return nil
+}
+
+// Close releases the compiled module. Commands applied afterwards fail
+// as if the pipeline had no module.
+func (pipeline *WasmPipeline) Close() error {
+	pipeline.mu.Lock()
+	runtime := pipeline.runtime
+	pipeline.runtime = nil
+	pipeline.compiled = nil
+	pipeline.mu.Unlock()
+
+	if runtime == nil {
+		return nil
+	}
+	return runtime.Close(context.Background())
+}
+
+// invoke must be called with the read lock held.
+func (pipeline *WasmPipeline) invoke(input []byte) ([]byte, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(pipeline.Timeout)*time.Millisecond)
+	defer cancel()
+
+	// Instances need unique names to run concurrently.
+	name := fmt.Sprintf("%s-%d", pipeline.ID, atomic.AddUint64(&pipeline.invocations, 1))
+	mod, err := pipeline.runtime.InstantiateModule(ctx, pipeline.compiled, wazero.NewModuleConfig().WithName(name))
+	if err != nil {
+		return nil, false, err
+	}
+	defer mod.Close(context.Background())
+
+	alloc := mod.ExportedFunction("alloc")
+	transform := mod.ExportedFunction("transform")
+	memory := mod.Memory()
+	if alloc == nil || transform == nil || memory == nil {
+		return nil, false, errors.New("module must export memory, alloc and transform")
+	}
+
+	results, err := alloc.Call(ctx, uint64(len(input)))
+	if err != nil {
+		return nil, false, err
+	}
+	ptr := uint32(results[0])
+	if !memory.Write(ptr, input) {
+		return nil, false, errors.New("alloc returned memory out of range")
+	}
+
+	results, err = transform.Call(ctx, uint64(ptr), uint64(len(input)))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(results[0]) < 0 {
+		return nil, false, nil
+	}
+
+	output, ok := memory.Read(uint32(results[0]>>32), uint32(results[0]))
+	if !ok {
+		return nil, false, errors.New("transform returned memory out of range")
+	}
+	return append([]byte{}, output...), true, nil
+}
+
+func compileWasm(module []byte, pages uint32) (wazero.Runtime, wazero.CompiledModule, error) {
+	if len(module) == 0 {
+		return nil, nil, errors.New("wasm module is empty")
+	}
+	if pages > MaxWasmMemoryPages {
+		return nil, nil, fmt.Errorf("wasm memory is limited to %d pages", MaxWasmMemoryPages)
+	}
+
+	ctx := context.Background()
+	config := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(pages).
+		WithCloseOnContextDone(true)
+	runtime := wazero.NewRuntimeWithConfig(ctx, config)
+
+	compiled, err := runtime.CompileModule(ctx, module)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, nil, err
+	}
+	if len(compiled.ImportedFunctions()) > 0 || len(compiled.ImportedMemories()) > 0 {
+		runtime.Close(ctx)
+		return nil, nil, errors.New("wasm module must not have imports")
+	}
+	return runtime, compiled, nil
+}
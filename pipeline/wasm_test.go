@@ -0,0 +1,129 @@
+package pipeline
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/thinksystemio/package-flow/command"
+)
+
+// testWasmModule is the binary encoding of
+//
+//	(module
+//	  (memory (export "memory") 1)
+//	  (data (i32.const 0) "{\"wasm\":true}")
+//	  (func (export "alloc") (param i32) (result i32) i32.const 1024)
+//	  (func (export "transform") (param i32 i32) (result i64)
+//	    (if (i32.gt_u (local.get 1) (i32.const 1000)) (then (loop (br 0))))
+//	    (if (result i64) (i32.lt_u (local.get 1) (i32.const 10))
+//	      (then (i64.const -1))
+//	      (else (i64.const 13)))))
+//
+// It drops short inputs, loops forever on long ones and replaces
+// anything else with {"wasm":true}.
+var testWasmModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	// types
+	0x01, 0x0c, 0x02, 0x60, 0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e,
+	// functions
+	0x03, 0x03, 0x02, 0x00, 0x01,
+	// memory
+	0x05, 0x03, 0x01, 0x00, 0x01,
+	// exports
+	0x07, 0x1e, 0x03,
+	0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0x00,
+	0x05, 'a', 'l', 'l', 'o', 'c', 0x00, 0x00,
+	0x09, 't', 'r', 'a', 'n', 's', 'f', 'o', 'r', 'm', 0x00, 0x01,
+	// code
+	0x0a, 0x25, 0x02,
+	0x05, 0x00, 0x41, 0x80, 0x08, 0x0b,
+	0x1d, 0x00,
+	0x20, 0x01, 0x41, 0xe8, 0x07, 0x4b, 0x04, 0x40, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x0b,
+	0x20, 0x01, 0x41, 0x0a, 0x49, 0x04, 0x7e, 0x42, 0x7f, 0x05, 0x42, 0x0d, 0x0b, 0x0b,
+	// data
+	0x0b, 0x13, 0x01, 0x00, 0x41, 0x00, 0x0b, 0x0d,
+	'{', '"', 'w', 'a', 's', 'm', '"', ':', 't', 'r', 'u', 'e', '}',
+}
+
+func createWasmPipeline(t *testing.T) *WasmPipeline {
+	p := NewWasmPipeline(&command.CreatePipeline{Name: "wasm"}).(*WasmPipeline)
+	cmd := &command.UpdateWasmPipeline{Module: testWasmModule, Timeout: 50}
+
+	p.UpdateWasmPipeline(cmd)
+	if cmd.HasErrors() {
+		t.Fatalf("module returned errors: %v", cmd.GetErrors())
+	}
+	return p
+}
+
+func TestWasmPipeline(t *testing.T) {
+	p := createWasmPipeline(t)
+
+	cmd := &command.BaseCommand{Data: map[string]interface{}{"name": "alice"}}
+	if !p.Apply(cmd) || cmd.HasErrors() {
+		t.Fatalf("apply failed: %v", cmd.GetErrors())
+	}
+	want := map[string]interface{}{"wasm": true}
+	if !reflect.DeepEqual(cmd.GetData(), want) {
+		t.Errorf("got %v, want %v", cmd.GetData(), want)
+	}
+
+	// short inputs are dropped
+	if p.Apply(&command.BaseCommand{Data: 1}) {
+		t.Error("expected the command to be dropped")
+	}
+
+	// long inputs never return and are stopped by the timeout
+	cmd = &command.BaseCommand{Data: strings.Repeat("x", 2000)}
+	p.Apply(cmd)
+	if !cmd.HasErrors() {
+		t.Error("expected a timeout error")
+	}
+
+	// closed pipelines release the runtime and fail commands
+	if err := Close(p); err != nil {
+		t.Fatal(err)
+	}
+	cmd = &command.BaseCommand{Data: map[string]interface{}{"name": "alice"}}
+	p.Apply(cmd)
+	if errs := cmd.GetErrors(); len(errs) != 1 || errs[0].Code != command.FAILED_PRECONDITION {
+		t.Errorf("expected a FAILED_PRECONDITION error, got %v", errs)
+	}
+}
+
+func TestWasmPipelineInvalid(t *testing.T) {
+	p := createWasmPipeline(t)
+
+	update := &command.UpdateWasmPipeline{Module: []byte("not wasm")}
+	p.UpdateWasmPipeline(update)
+	if !update.HasErrors() {
+		t.Error("expected a compile error")
+	}
+	if !reflect.DeepEqual(p.Module, testWasmModule) {
+		t.Error("module changed")
+	}
+
+	update = &command.UpdateWasmPipeline{Module: testWasmModule, MemoryPages: MaxWasmMemoryPages + 1}
+	p.UpdateWasmPipeline(update)
+	if errs := update.GetErrors(); len(errs) != 1 || errs[0].Code != command.INVALID_ARGUMENT || errs[0].Field != "memory_pages" {
+		t.Errorf("expected a memory_pages error, got %v", errs)
+	}
+	if p.MemoryPages == MaxWasmMemoryPages+1 {
+		t.Error("memory pages changed")
+	}
+
+	// the module is stored with the pipeline and compiled on restore
+	JSON, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := FromJSON(JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := &command.BaseCommand{Data: map[string]interface{}{"name": "alice"}}
+	if !restored.Apply(cmd) || cmd.HasErrors() {
+		t.Fatalf("restored pipeline failed: %v", cmd.GetErrors())
+	}
+}
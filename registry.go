@@ -0,0 +1,140 @@
+package flow
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/thinksystemio/package-flow/command"
+	"github.com/thinksystemio/package-flow/tree"
+)
+
+// Handler runs a command against the tree. It reports failures by
+// appending errors to the command and results by setting its data.
+// The command is always of the type its action decodes into.
+type Handler func(tree *tree.Tree, cmd command.Command, options ...interface{})
+
+var (
+	handlers   = map[reflect.Type]Handler{}
+	handlersMu sync.RWMutex
+)
+
+// RegisterAction adds a command to flow. Dispense decodes the action
+// with decoder and Dispatch runs the decoded command with handler.
+// Every action must decode into its own command type. It panics if
+// the action or its command type is already registered, so it is meant
+// to be called from init.
+func RegisterAction(action string, decoder command.Decoder, handler Handler) {
+	command.RegisterDecoder(action, decoder)
+	handleAction(action, handler)
+}
+
+// handleAction registers the handler of an action whose decoder is
+// already registered.
+func handleAction(action string, handler Handler) {
+	if handler == nil {
+		panic(fmt.Sprintf("flow: action %s needs a handler", action))
+	}
+	commandType := commandTypeOf(action)
+
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+
+	if _, ok := handlers[commandType]; ok {
+		panic(fmt.Sprintf("flow: command %v is already handled", commandType))
+	}
+	handlers[commandType] = handler
+}
+
+// commandTypeOf returns the type an action decodes into, taken from
+// decoding an empty command.
+func commandTypeOf(action string) reflect.Type {
+	decoder, ok := command.LookupDecoder(action)
+	if !ok {
+		panic(fmt.Sprintf("flow: action %s has no decoder", action))
+	}
+	return reflect.TypeOf(decoder([]byte("{}")))
+}
+
+func lookupHandler(cmd command.Command) (Handler, bool) {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+
+	handler, ok := handlers[reflect.TypeOf(cmd)]
+	return handler, ok
+}
+
+func init() {
+	// Tree
+	handleAction(command.CREATE_NODE, createNode)
+	handleAction(command.ADD_CHILD, addChild)
+	handleAction(command.REMOVE_NODE, removeNode)
+	handleAction(command.REMOVE_CHILD, removeChild)
+	handleAction(command.ADD_ERROR_CHILD, addErrorChild)
+	handleAction(command.REMOVE_ERROR_CHILD, removeErrorChild)
+	handleAction(command.CREATE_PIPELINE, createPipeline)
+	handleAction(command.BATCH, batch)
+
+	// Query
+	handleAction(command.GET_TREE, getTree)
+	handleAction(command.GET_NODE, getNode)
+	handleAction(command.LIST_NODES, listNodes)
+	handleAction(command.LIST_PIPELINES, listPipelines)
+	handleAction(command.GET_PIPELINE, getPipeline)
+	handleAction(command.GET_CHILDREN, getChildren)
+	handleAction(command.GET_PARENTS, getParents)
+
+	// Filter Pipeline
+	handleAction(command.UPDATE_FILTER_PIPELINE, updateFilterPipeline)
+
+	// Chain Pipeline
+	handleAction(command.UPDATE_CHAIN_PIPELINE, updateChainPipeline)
+	handleAction(command.INSERT_CHAIN_STAGE, insertChainStage)
+	handleAction(command.REMOVE_CHAIN_STAGE, removeChainStage)
+	handleAction(command.MOVE_CHAIN_STAGE, moveChainStage)
+
+	// Predicate Pipeline
+	handleAction(command.UPDATE_PREDICATE_PIPELINE, updatePredicatePipeline)
+
+	// Map Pipeline
+	handleAction(command.UPDATE_MAP_PIPELINE, updateMapPipeline)
+
+	// Expression Pipeline
+	handleAction(command.UPDATE_EXPRESSION_PIPELINE, updateExpressionPipeline)
+
+	// Wasm Pipeline
+	handleAction(command.UPDATE_WASM_PIPELINE, updateWasmPipeline)
+
+	// Redact Pipeline
+	handleAction(command.UPDATE_REDACT_PIPELINE, updateRedactPipeline)
+
+	// Schema Pipeline
+	handleAction(command.UPDATE_SCHEMA_PIPELINE, updateSchemaPipeline)
+
+	// Node
+	handleAction(command.ACTIVATE_NODE, activateNode)
+	handleAction(command.DEACTIVATE_NODE, deactivateNode)
+	handleAction(command.UPDATE_MAILBOX, updateMailbox)
+
+	// Dead Letter
+	handleAction(command.REPLAY_DEAD_LETTERS, replayDeadLetters)
+	handleAction(command.GET_DEAD_LETTERS, getDeadLetters)
+
+	// Publisher
+	handleAction(command.ADD_SUBSCRIBER, addSubscriber)
+	handleAction(command.UPDATE_PUBLISHER, updatePublisher)
+
+	// Subscriber
+	handleAction(command.UPDATE_URL, updateURL)
+	handleAction(command.ACTIVATE_WS, activateWS)
+	handleAction(command.DECTIVATE_WS, deactivateWS)
+
+	// Mongo
+	handleAction(command.CONNECT_MONGO, connectMongo)
+	handleAction(command.ADD_MONGO, addMongo)
+	handleAction(command.UPDATE_MONGO, updateMongo)
+	handleAction(command.UPDATE_BY_ID_MONGO, updateByIDMongo)
+	handleAction(command.REMOVE_MONGO, removeMongo)
+	handleAction(command.REMOVE_BY_ID_MONGO, removeByIDMongo)
+	handleAction(command.QUERY_ALL_MONGO, queryAllMongo)
+}
@@ -0,0 +1,79 @@
+package flow
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/thinksystemio/package-flow/command"
+	"github.com/thinksystemio/package-flow/node"
+	"github.com/thinksystemio/package-flow/pipeline"
+	"github.com/thinksystemio/package-flow/tree"
+)
+
+// countNodes is a command registered by the test the way a third-party
+// package would.
+type countNodes struct {
+	command.BaseCommand
+	Type string `json:"type"`
+}
+
+func (cmd *countNodes) Valid() error {
+	if cmd.Action == "" {
+		return errors.New("command is not valid")
+	}
+	return nil
+}
+
+func init() {
+	node.RegisterNodeType("test_custom", func(cmd *command.CreateNode) node.Node {
+		n := node.NewBaseNode(cmd)
+		n.Type = "test_custom"
+		return n
+	})
+	pipeline.RegisterPipelineType("test_custom", func(cmd *command.CreatePipeline) pipeline.Pipeline {
+		p := pipeline.NewBasePipeline(cmd).(*pipeline.BasePipeline)
+		p.Type = "test_custom"
+		return p
+	})
+	RegisterAction("test_count_nodes",
+		command.Decoding(func() command.Command { return &countNodes{} }),
+		func(tree *tree.Tree, c command.Command, options ...interface{}) {
+			cmd := c.(*countNodes)
+			cmd.Data = len(tree.ListNodes(func(n node.Node) bool { return n.GetType() == cmd.Type }))
+		})
+}
+
+func TestRegistry(t *testing.T) {
+	tree := tree.NewTree()
+
+	for _, JSON := range [][]byte{
+		CreateNode("a", "test_custom"),
+		CreateNode("b", "TEST_CUSTOM"),
+		CreateNode("c", "base"),
+		CreatePipeline("pipe", "test_custom"),
+		AddChild("a", "b", "pipe"),
+	} {
+		if cmd := DispatchFromJSON(tree, JSON); cmd.HasErrors() {
+			t.Fatalf("%s returned errors: %v", JSON, cmd.GetErrors())
+		}
+	}
+
+	cmd := DispatchFromJSON(tree, []byte(`{"action":"test_count_nodes","type":"test_custom"}`))
+	if cmd.HasErrors() || cmd.GetData() != 2 {
+		t.Errorf("test_count_nodes returned %v, %v", cmd.GetData(), cmd.GetErrors())
+	}
+
+	p, _ := tree.GetPipelineByNameOrID("pipe")
+	JSON, _ := p.ToJSON()
+	restored, err := pipeline.FromJSON(JSON)
+	if err != nil || restored.GetType() != "test_custom" || restored.GetID() != p.GetID() {
+		t.Errorf("restored %v, %v", restored, err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering an action twice to panic")
+		}
+	}()
+	RegisterAction(command.CREATE_NODE, command.Decoding(func() command.Command { return &command.CreateNode{} }), createNode)
+}
@@ -0,0 +1,465 @@
+package tree
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/thinksystemio/package-flow/node"
+	"github.com/thinksystemio/package-flow/pipeline"
+)
+
+// NodeView describes a node the way ToJSON and the query commands
+// present it. Children maps child IDs to pipeline IDs, and
+// Capabilities lists the actions the node accepts. Props are the
+// node's ToJSONStruct in ToJSON and its client view otherwise.
+type NodeView struct {
+	ID            string                 `json:"id"`
+	Name          string                 `json:"name"`
+	Type          string                 `json:"type"`
+	Active        bool                   `json:"active"`
+	Children      map[string]string      `json:"children"`
+	ErrorChildren []string               `json:"error_children"`
+	Capabilities  []string               `json:"capabilities"`
+	Props         map[string]interface{} `json:"props"`
+}
+
+// EdgeView describes the node at the other end of an edge. Pipeline is
+// the ID of the edge's pipeline; error edges only have one when they
+// are the error route of that pipeline.
+type EdgeView struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Pipeline string `json:"pipeline,omitempty"`
+	Error    bool   `json:"error,omitempty"`
+}
+
+// Edge connects a parent to a child. Error edges have no pipeline,
+// except the error routes of pipelines, which have the pipeline that
+// routes to the child.
+type Edge struct {
+	Parent   node.Node
+	Child    node.Node
+	Pipeline pipeline.Pipeline
+	Error    bool
+}
+
+// DescribeNode returns the view of a node sent to clients.
+func (tree *Tree) DescribeNode(n node.Node) *NodeView {
+	return tree.describeNode(n, node.ViewJSONStruct(n))
+}
+
+func (tree *Tree) describeNode(n node.Node, props map[string]interface{}) *NodeView {
+	children := map[string]string{}
+	for child, p := range n.GetChildren() {
+		pipelineID := ""
+		if p != nil {
+			pipelineID = p.GetID()
+		}
+		children[child.GetID()] = pipelineID
+	}
+
+	errorChildren := []string{}
+	for _, child := range n.GetErrorChildren() {
+		errorChildren = append(errorChildren, child.GetID())
+	}
+	sort.Strings(errorChildren)
+
+	return &NodeView{
+		ID:            n.GetID(),
+		Name:          n.GetName(),
+		Type:          n.GetType(),
+		Active:        n.GetActive(),
+		Children:      children,
+		ErrorChildren: errorChildren,
+		Capabilities:  n.Capabilities(),
+		Props:         props,
+	}
+}
+
+// ListNodes returns the nodes that match, sorted by name. A nil match
+// returns every node.
+func (tree *Tree) ListNodes(match func(node.Node) bool) []node.Node {
+	tree.Mu.Lock()
+	nodes := make([]node.Node, 0, len(tree.Nodes))
+	for _, n := range tree.Nodes {
+		nodes = append(nodes, n)
+	}
+	tree.Mu.Unlock()
+
+	result := []node.Node{}
+	for _, n := range nodes {
+		if match == nil || match(n) {
+			result = append(result, n)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].GetName() < result[j].GetName() })
+	return result
+}
+
+// ListPipelines returns the pipelines that match, sorted by name. A
+// nil match returns every pipeline.
+func (tree *Tree) ListPipelines(match func(pipeline.Pipeline) bool) []pipeline.Pipeline {
+	tree.Mu.Lock()
+	pipelines := make([]pipeline.Pipeline, 0, len(tree.Pipelines))
+	for _, p := range tree.Pipelines {
+		pipelines = append(pipelines, p)
+	}
+	tree.Mu.Unlock()
+
+	result := []pipeline.Pipeline{}
+	for _, p := range pipelines {
+		if match == nil || match(p) {
+			result = append(result, p)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].GetName() < result[j].GetName() })
+	return result
+}
+
+// GetChildEdges returns the edges and error edges leaving a node. The
+// error routes of the pipelines on its edges are error edges with that
+// pipeline.
+func (tree *Tree) GetChildEdges(n node.Node) []Edge {
+	edges := []Edge{}
+	for child, p := range n.GetChildren() {
+		edges = append(edges, Edge{Parent: n, Child: child, Pipeline: p})
+	}
+	for _, child := range n.GetErrorChildren() {
+		edges = append(edges, Edge{Parent: n, Child: child, Error: true})
+	}
+
+	tree.Mu.Lock()
+	edges = append(edges, tree.routedEdges(n)...)
+	tree.Mu.Unlock()
+
+	sortEdges(edges, func(e Edge) node.Node { return e.Child })
+	return edges
+}
+
+// GetParentEdges returns the edges and error edges pointing at a node,
+// including the error routes of pipelines on edges of other nodes.
+func (tree *Tree) GetParentEdges(n node.Node) []Edge {
+	tree.Mu.Lock()
+	parents := keys(tree.parents[n])
+	errorParents := keys(tree.errorParents[n])
+	routed := tree.routedParentEdges(n)
+	tree.Mu.Unlock()
+
+	edges := []Edge{}
+	for _, parent := range parents {
+		edges = append(edges, Edge{Parent: parent, Child: n, Pipeline: parent.GetChildren()[n]})
+	}
+	for _, parent := range errorParents {
+		edges = append(edges, Edge{Parent: parent, Child: n, Error: true})
+	}
+	edges = append(edges, routed...)
+	sortEdges(edges, func(e Edge) node.Node { return e.Parent })
+	return edges
+}
+
+// GetErrorRoutes returns the nodes a pipeline routes rejected commands
+// to, directly or through its stages, sorted by name.
+func (tree *Tree) GetErrorRoutes(p pipeline.Pipeline) []node.Node {
+	tree.Mu.Lock()
+	defer tree.Mu.Unlock()
+
+	set := map[node.Node]struct{}{}
+	for _, route := range tree.routesThrough(p) {
+		set[route.child] = struct{}{}
+	}
+	return keys(set)
+}
+
+// GetPipelineUsers returns the nodes with an edge through a pipeline,
+// directly or as a stage, sorted by name.
+func (tree *Tree) GetPipelineUsers(p pipeline.Pipeline) []node.Node {
+	tree.Mu.Lock()
+	nodes := make([]node.Node, 0, len(tree.Nodes))
+	for _, n := range tree.Nodes {
+		nodes = append(nodes, n)
+	}
+	tree.Mu.Unlock()
+
+	set := map[node.Node]struct{}{}
+	for _, n := range nodes {
+		for _, edge := range n.GetChildren() {
+			if uses(edge, p) {
+				set[n] = struct{}{}
+			}
+		}
+	}
+	return keys(set)
+}
+
+// GetParents returns the nodes that have a node as a child or as an
+// error child, sorted by name.
+func (tree *Tree) GetParents(n node.Node) []node.Node {
+	tree.Mu.Lock()
+	defer tree.Mu.Unlock()
+	return tree.parentsOf(n)
+}
+
+// GetAncestors returns every node from which a node can be reached,
+// sorted by name. A node is only its own ancestor when it is in a
+// cycle.
+func (tree *Tree) GetAncestors(n node.Node) []node.Node {
+	tree.Mu.Lock()
+	defer tree.Mu.Unlock()
+	return walk(n, tree.parentsOf)
+}
+
+// GetDescendants returns every node that can be reached from a node,
+// sorted by name. A node is only its own descendant when it is in a
+// cycle.
+func (tree *Tree) GetDescendants(n node.Node) []node.Node {
+	tree.Mu.Lock()
+	defer tree.Mu.Unlock()
+	return walk(n, tree.childrenOf)
+}
+
+// WalkTopological visits every node with parents before their
+// children, following edges and error edges. Nodes that are ready at
+// the same time are visited by name. The walk stops when visit returns
+// false. Nodes in a cycle are never ready, so when the tree has cycles
+// the remaining nodes are skipped and an error is returned.
+func (tree *Tree) WalkTopological(visit func(node.Node) bool) error {
+	nodes := tree.ListNodes(nil)
+
+	tree.Mu.Lock()
+	pending := map[node.Node]int{}
+	children := map[node.Node][]node.Node{}
+	for _, n := range nodes {
+		pending[n] = len(tree.parentsOf(n))
+		children[n] = tree.childrenOf(n)
+	}
+	tree.Mu.Unlock()
+
+	ready := []node.Node{}
+	for _, n := range nodes {
+		if pending[n] == 0 {
+			ready = append(ready, n)
+		}
+	}
+
+	visited := 0
+	for len(ready) > 0 {
+		n := ready[0]
+		ready = ready[1:]
+		if !visit(n) {
+			return nil
+		}
+		visited++
+
+		for _, child := range children[n] {
+			if _, ok := pending[child]; !ok {
+				continue
+			}
+			pending[child]--
+			if pending[child] == 0 {
+				ready = insertByName(ready, child)
+			}
+		}
+	}
+
+	if visited < len(nodes) {
+		return fmt.Errorf("%d nodes are in or below a cycle", len(nodes)-visited)
+	}
+	return nil
+}
+
+// DescribeNodes returns the view of each node.
+func (tree *Tree) DescribeNodes(nodes []node.Node) []*NodeView {
+	views := make([]*NodeView, 0, len(nodes))
+	for _, n := range nodes {
+		views = append(views, tree.DescribeNode(n))
+	}
+	return views
+}
+
+// DescribeEdges describes the node at the far end of each edge, which
+// is the child when children is true and the parent otherwise.
+func (tree *Tree) DescribeEdges(edges []Edge, children bool) []EdgeView {
+	views := make([]EdgeView, 0, len(edges))
+	for _, e := range edges {
+		n := e.Parent
+		if children {
+			n = e.Child
+		}
+
+		view := EdgeView{ID: n.GetID(), Name: n.GetName(), Type: n.GetType(), Error: e.Error}
+		if e.Pipeline != nil {
+			view.Pipeline = e.Pipeline.GetID()
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+func sortEdges(edges []Edge, end func(Edge) node.Node) {
+	sort.SliceStable(edges, func(i, j int) bool {
+		a, b := end(edges[i]), end(edges[j])
+		if a.GetName() != b.GetName() {
+			return a.GetName() < b.GetName()
+		}
+		return !edges[i].Error && edges[j].Error
+	})
+}
+
+// parentsOf returns the distinct parents of a node. The caller must
+// hold the tree's lock.
+func (tree *Tree) parentsOf(n node.Node) []node.Node {
+	set := map[node.Node]struct{}{}
+	for parent := range tree.parents[n] {
+		set[parent] = struct{}{}
+	}
+	for parent := range tree.errorParents[n] {
+		set[parent] = struct{}{}
+	}
+	for _, e := range tree.routedParentEdges(n) {
+		set[e.Parent] = struct{}{}
+	}
+	return keys(set)
+}
+
+// childrenOf returns the distinct children, error children and error
+// routes of a node, sorted by name. The caller must hold the tree's
+// lock.
+func (tree *Tree) childrenOf(n node.Node) []node.Node {
+	set := map[node.Node]struct{}{}
+	for child := range n.GetChildren() {
+		set[child] = struct{}{}
+	}
+	for _, child := range n.GetErrorChildren() {
+		set[child] = struct{}{}
+	}
+	for _, e := range tree.routedEdges(n) {
+		set[e.Child] = struct{}{}
+	}
+	return keys(set)
+}
+
+// errorRoute is a pipeline routing rejected commands to child.
+type errorRoute struct {
+	pipeline pipeline.Pipeline
+	child    node.Node
+}
+
+// routesThrough returns the error routes of a pipeline and of its
+// stages. The caller must hold the tree's lock.
+func (tree *Tree) routesThrough(p pipeline.Pipeline) []errorRoute {
+	routes := []errorRoute{}
+	for router, child := range tree.errorRoutes {
+		if uses(p, router) {
+			routes = append(routes, errorRoute{router, child})
+		}
+	}
+	return routes
+}
+
+// routedEdges returns an error edge for each error route on the edges
+// leaving a node. The caller must hold the tree's lock.
+func (tree *Tree) routedEdges(n node.Node) []Edge {
+	if len(tree.errorRoutes) == 0 {
+		return nil
+	}
+
+	edges := []Edge{}
+	seen := map[errorRoute]struct{}{}
+	for _, p := range n.GetChildren() {
+		if p == nil {
+			continue
+		}
+		for _, route := range tree.routesThrough(p) {
+			if _, ok := seen[route]; !ok {
+				seen[route] = struct{}{}
+				edges = append(edges, Edge{Parent: n, Child: route.child, Pipeline: route.pipeline, Error: true})
+			}
+		}
+	}
+	return edges
+}
+
+// routedParentEdges returns the routed error edges pointing at a node.
+// The caller must hold the tree's lock.
+func (tree *Tree) routedParentEdges(n node.Node) []Edge {
+	routed := false
+	for _, child := range tree.errorRoutes {
+		routed = routed || child == n
+	}
+	if !routed {
+		return nil
+	}
+
+	edges := []Edge{}
+	for _, parent := range tree.Nodes {
+		for _, e := range tree.routedEdges(parent) {
+			if e.Child == n {
+				edges = append(edges, e)
+			}
+		}
+	}
+	return edges
+}
+
+// stager is implemented by pipelines made of other pipelines.
+type stager interface {
+	GetStages() []pipeline.Pipeline
+}
+
+// stageSetter is a stager whose stages can be replaced.
+type stageSetter interface {
+	stager
+	SetStages([]pipeline.Pipeline) error
+}
+
+// uses reports whether p is target or has it as a stage.
+func uses(p pipeline.Pipeline, target pipeline.Pipeline) bool {
+	if p == target {
+		return true
+	}
+	if chain, ok := p.(stager); ok {
+		for _, stage := range chain.GetStages() {
+			if uses(stage, target) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// walk returns every node reachable from start through next, sorted
+// by name.
+func walk(start node.Node, next func(node.Node) []node.Node) []node.Node {
+	found := map[node.Node]struct{}{}
+	stack := next(start)
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if _, ok := found[current]; ok {
+			continue
+		}
+		found[current] = struct{}{}
+		stack = append(stack, next(current)...)
+	}
+	return keys(found)
+}
+
+// keys returns the nodes of a set sorted by name.
+func keys(set map[node.Node]struct{}) []node.Node {
+	nodes := make([]node.Node, 0, len(set))
+	for n := range set {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].GetName() < nodes[j].GetName() })
+	return nodes
+}
+
+func insertByName(nodes []node.Node, n node.Node) []node.Node {
+	i := sort.Search(len(nodes), func(i int) bool { return nodes[i].GetName() >= n.GetName() })
+	nodes = append(nodes, nil)
+	copy(nodes[i+1:], nodes[i:])
+	nodes[i] = n
+	return nodes
+}
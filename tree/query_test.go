@@ -0,0 +1,73 @@
+package tree
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/thinksystemio/package-flow/command"
+	"github.com/thinksystemio/package-flow/node"
+)
+
+func names(nodes []node.Node) []string {
+	result := []string{}
+	for _, n := range nodes {
+		result = append(result, n.GetName())
+	}
+	return result
+}
+
+func TestParentIndex(t *testing.T) {
+	tree := NewTree()
+	nodes := map[string]node.Node{}
+	for _, name := range []string{"a", "b", "c", "d", "dead"} {
+		nodes[name] = node.NewNode(&command.CreateNode{Name: name, Type: "base"})
+		tree.AddNode(nodes[name])
+	}
+
+	tree.AddEdge(nodes["a"], nodes["b"], nil)
+	tree.AddEdge(nodes["a"], nodes["c"], nil)
+	tree.AddEdge(nodes["b"], nodes["d"], nil)
+	tree.AddEdge(nodes["c"], nodes["d"], nil)
+	tree.AddErrorEdge(nodes["b"], nodes["dead"])
+
+	if got := names(tree.GetParents(nodes["d"])); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Errorf("parents of d = %v", got)
+	}
+	if got := names(tree.GetAncestors(nodes["dead"])); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("ancestors of dead = %v", got)
+	}
+	if got := names(tree.GetDescendants(nodes["a"])); !reflect.DeepEqual(got, []string{"b", "c", "d", "dead"}) {
+		t.Errorf("descendants of a = %v", got)
+	}
+
+	order := []node.Node{}
+	err := tree.WalkTopological(func(n node.Node) bool {
+		order = append(order, n)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(order); !reflect.DeepEqual(got, []string{"a", "b", "c", "d", "dead"}) {
+		t.Errorf("topological order = %v", got)
+	}
+
+	tree.RemoveEdge(nodes["c"], nodes["d"])
+	if got := names(tree.GetParents(nodes["d"])); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("parents of d after removing edge = %v", got)
+	}
+
+	tree.RemoveNode(nodes["b"])
+	if got := names(tree.GetParents(nodes["d"])); len(got) != 0 {
+		t.Errorf("parents of d after removing b = %v", got)
+	}
+	if got := names(tree.GetParents(nodes["dead"])); len(got) != 0 {
+		t.Errorf("parents of dead after removing b = %v", got)
+	}
+
+	tree.AddEdge(nodes["d"], nodes["a"], nil)
+	tree.AddEdge(nodes["a"], nodes["d"], nil)
+	if err := tree.WalkTopological(func(node.Node) bool { return true }); err == nil {
+		t.Error("expected an error walking a cycle")
+	}
+}
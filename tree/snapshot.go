@@ -0,0 +1,148 @@
+package tree
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/thinksystemio/package-flow/command"
+	"github.com/thinksystemio/package-flow/node"
+	"github.com/thinksystemio/package-flow/pipeline"
+)
+
+// snapshot mirrors the format produced by Tree.ToJSON.
+type snapshot struct {
+	Nodes     map[string]snapshotNode    `json:"nodes"`
+	Pipelines map[string]json.RawMessage `json:"pipelines"`
+}
+
+type snapshotNode struct {
+	ID            string                 `json:"id"`
+	Name          string                 `json:"name"`
+	Type          string                 `json:"type"`
+	Active        bool                   `json:"active"`
+	Children      map[string]string      `json:"children"`
+	ErrorChildren []string               `json:"error_children"`
+	Props         map[string]interface{} `json:"props"`
+}
+
+// FromJSON rebuilds a tree from the output of Tree.ToJSON. Nodes and
+// pipelines keep their original IDs and every parent to child edge
+// is reattached with its pipeline. Node props are restored last so
+// that any background work they start, such as a subscriber
+// websocket, sees the complete graph.
+func FromJSON(data []byte) (*Tree, error) {
+	s := &snapshot{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+
+	tree := NewTree()
+
+	for id, raw := range s.Pipelines {
+		p, err := pipeline.FromJSON(raw)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: %v", id, err)
+		}
+		if err := tree.AddPipeline(p); err != nil {
+			return nil, fmt.Errorf("pipeline %s: %v", id, err)
+		}
+	}
+
+	for id, p := range tree.Pipelines {
+		if resolver, ok := p.(pipeline.Resolver); ok {
+			if err := resolver.Resolve(tree.GetPipelineByNameOrID); err != nil {
+				return nil, fmt.Errorf("pipeline %s: %v", id, err)
+			}
+		}
+	}
+
+	for id, sn := range s.Nodes {
+		// Base nodes were serialized without a type before it was set
+		// on creation.
+		if sn.Type == "" {
+			sn.Type = "base"
+		}
+
+		cmd := &command.CreateNode{Name: sn.Name, Type: sn.Type}
+		cmd.Action = command.CREATE_NODE
+
+		n := node.NewNode(cmd)
+		if n == nil {
+			return nil, fmt.Errorf("node %s: invalid node type %s", id, sn.Type)
+		}
+
+		n.SetID(id)
+		n.SetActive(sn.Active)
+		if err := tree.AddNode(n); err != nil {
+			return nil, fmt.Errorf("node %s: %v", id, err)
+		}
+	}
+
+	for id, sn := range s.Nodes {
+		parent := tree.Nodes[id]
+		for childID, pipelineID := range sn.Children {
+			child, ok := tree.Nodes[childID]
+			if !ok {
+				return nil, fmt.Errorf("node %s: child %s does not exist", id, childID)
+			}
+
+			if pipelineID == "" {
+				tree.AddEdge(parent, child, nil)
+				continue
+			}
+
+			p, ok := tree.Pipelines[pipelineID]
+			if !ok {
+				return nil, fmt.Errorf("node %s: pipeline %s does not exist", id, pipelineID)
+			}
+			tree.AddEdge(parent, child, p)
+		}
+
+		for _, childID := range sn.ErrorChildren {
+			child, ok := tree.Nodes[childID]
+			if !ok {
+				return nil, fmt.Errorf("node %s: error child %s does not exist", id, childID)
+			}
+			tree.AddErrorEdge(parent, child)
+		}
+	}
+
+	for id, p := range tree.Pipelines {
+		router, ok := p.(pipeline.ErrorRouter)
+		if !ok || router.GetErrorChild() == "" {
+			continue
+		}
+		n, ok := tree.Nodes[router.GetErrorChild()]
+		if !ok {
+			return nil, fmt.Errorf("pipeline %s: error child %s does not exist", id, router.GetErrorChild())
+		}
+		tree.SetErrorRoute(p, n)
+	}
+
+	for id, sn := range s.Nodes {
+		tree.Nodes[id].FromJSONStruct(sn.Props)
+	}
+
+	return tree, nil
+}
+
+// Save writes the output of ToJSON to a file.
+func (tree *Tree) Save(path string) error {
+	data, err := tree.ToJSON()
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// LoadTree reads a file written by Save and rebuilds the tree.
+func LoadTree(path string) (*Tree, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return FromJSON(data)
+}
@@ -0,0 +1,87 @@
+package tree
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/thinksystemio/package-flow/command"
+	"github.com/thinksystemio/package-flow/node"
+	"github.com/thinksystemio/package-flow/pipeline"
+)
+
+func createSnapshotTree(t *testing.T) *Tree {
+	tree := NewTree()
+
+	parent := node.NewNode(&command.CreateNode{Name: "node_parent", Type: "base"})
+	child := node.NewNode(&command.CreateNode{Name: "node_child", Type: "subscriber"})
+	child.(*node.Subscriber).URL = "ws://localhost:8080/subscribe"
+	child.SetActive(false)
+	dead := node.NewNode(&command.CreateNode{Name: "node_dead", Type: "deadletter"})
+	tree.AddNode(parent)
+	tree.AddNode(child)
+	tree.AddNode(dead)
+	tree.AddErrorEdge(parent, dead)
+
+	filter := pipeline.NewPipeline(&command.CreatePipeline{Name: "pipe_filter", Type: "filter"})
+	filter.(*pipeline.FilterPipeline).UpdatePipelineFilter(&command.UpdateFilterPipeline{
+		Filter: command.Paths{"a", "b.c"},
+	})
+	tree.AddPipeline(filter)
+
+	chain := pipeline.NewPipeline(&command.CreatePipeline{Name: "pipe_chain", Type: "chain"})
+	chain.(*pipeline.ChainPipeline).InsertStage(filter, -1)
+	tree.AddPipeline(chain)
+	tree.AddEdge(parent, child, chain)
+
+	return tree
+}
+
+func TestFromJSON(t *testing.T) {
+	original, _ := createSnapshotTree(t).ToJSON()
+
+	restored, err := FromJSON(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	JSON, _ := restored.ToJSON()
+	if !bytes.Equal(original, JSON) {
+		t.Errorf("restored tree differs\nwant %s\ngot  %s", original, JSON)
+	}
+
+	parent, _ := restored.GetNodeByNameOrID("node_parent")
+	child, _ := restored.GetNodeByNameOrID("node_child")
+	filter, _ := restored.GetPipelineByNameOrID("pipe_filter")
+	chain, _ := restored.GetPipelineByNameOrID("pipe_chain")
+	dead, _ := restored.GetNodeByNameOrID("node_dead")
+	if parent.GetChildren()[child] != chain {
+		t.Error("edge should reference the restored pipeline")
+	}
+	if !parent.HasErrorChild(dead) {
+		t.Error("error edge should be restored")
+	}
+	if stages := chain.(*pipeline.ChainPipeline).GetStages(); len(stages) != 1 || stages[0] != filter {
+		t.Error("chain should reference the restored stage")
+	}
+}
+
+func TestSaveAndLoadTree(t *testing.T) {
+	tree := createSnapshotTree(t)
+	path := filepath.Join(t.TempDir(), "tree.json")
+
+	if err := tree.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := LoadTree(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original, _ := tree.ToJSON()
+	JSON, _ := restored.ToJSON()
+	if !bytes.Equal(original, JSON) {
+		t.Errorf("loaded tree differs\nwant %s\ngot  %s", original, JSON)
+	}
+}
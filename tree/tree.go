@@ -2,28 +2,45 @@ package tree
 
 import (
 	"encoding/json"
-	"errors"
-	"fmt"
 	"sync"
 
+	"github.com/thinksystemio/package-flow/command"
 	"github.com/thinksystemio/package-flow/node"
 	"github.com/thinksystemio/package-flow/pipeline"
 )
 
 // Tree is a flat structure that contains a map of nodes. The
 // individual nodes are responsible for keeping track of their
-// children.
+// children, and the tree indexes their parents. Edges must be changed
+// through the tree for the index to stay correct.
 type Tree struct {
 	Nodes     map[string]node.Node
 	Pipelines map[string]pipeline.Pipeline
 	Mu        sync.Mutex
+
+	// DispatchMu isolates batches: commands hold it for reading while
+	// they run, and a batch holds it for writing until it commits or
+	// rolls back.
+	DispatchMu sync.RWMutex
+
+	// parents and errorParents map a node to the nodes that have it
+	// as a child or as an error child. errorRoutes maps a pipeline
+	// that routes rejected commands to the node it routes them to,
+	// which is an error child of every node with an edge through the
+	// pipeline.
+	parents      map[node.Node]map[node.Node]struct{}
+	errorParents map[node.Node]map[node.Node]struct{}
+	errorRoutes  map[pipeline.Pipeline]node.Node
 }
 
 // NewTree creates a new instance of a tree.
 func NewTree() *Tree {
 	return &Tree{
-		Nodes:     map[string]node.Node{},
-		Pipelines: map[string]pipeline.Pipeline{},
+		Nodes:        map[string]node.Node{},
+		Pipelines:    map[string]pipeline.Pipeline{},
+		parents:      map[node.Node]map[node.Node]struct{}{},
+		errorParents: map[node.Node]map[node.Node]struct{}{},
+		errorRoutes:  map[pipeline.Pipeline]node.Node{},
 	}
 }
 
@@ -51,7 +68,7 @@ func (tree *Tree) GetNodeByNameOrID(nameOrID string) (node.Node, error) {
 		}
 	}
 
-	err := fmt.Errorf("node with name or ID of %s does not exist", nameOrID)
+	err := command.Errorf(command.NOT_FOUND, "node with name or ID of %s does not exist", nameOrID)
 	return nil, err
 }
 
@@ -59,11 +76,11 @@ func (tree *Tree) GetNodeByNameOrID(nameOrID string) (node.Node, error) {
 // concurrently.
 func (tree *Tree) AddNode(node node.Node) error {
 	if node.GetID() == "" || node.GetName() == "" {
-		return errors.New("node must have ID and Name")
+		return command.Errorf(command.INVALID_ARGUMENT, "node must have ID and Name")
 	}
 
 	if n, _ := tree.GetNodeByNameOrID(node.GetName()); n != nil {
-		return errors.New("node already exists")
+		return command.Errorf(command.ALREADY_EXISTS, "node already exists").WithNode(n.GetID())
 	}
 
 	tree.Mu.Lock()
@@ -73,12 +90,181 @@ func (tree *Tree) AddNode(node node.Node) error {
 	return nil
 }
 
-// RemoveNode removes a node from the tree. This can
-// be done concurrently.
+// RemoveNode removes a node from the tree along with every edge and
+// error edge pointing at it or leaving it, and any pipeline's
+// reference to it as an error child. The node's background work is not
+// stopped; call Delete on the node for that. This can be done
+// concurrently.
 func (tree *Tree) RemoveNode(node node.Node) {
 	tree.Mu.Lock()
+	defer tree.Mu.Unlock()
+
 	delete(tree.Nodes, node.GetID())
-	tree.Mu.Unlock()
+
+	for parent := range tree.parents[node] {
+		parent.RemoveChild(node)
+	}
+	for child := range node.GetChildren() {
+		node.RemoveChild(child)
+		unindex(tree.parents, node, child)
+	}
+	delete(tree.parents, node)
+
+	for parent := range tree.errorParents[node] {
+		parent.RemoveErrorChild(node)
+	}
+	for _, child := range node.GetErrorChildren() {
+		node.RemoveErrorChild(child)
+		unindex(tree.errorParents, node, child)
+	}
+	delete(tree.errorParents, node)
+
+	for p, child := range tree.errorRoutes {
+		if child == node {
+			p.(pipeline.ErrorRouter).SetErrorChild(nil)
+			delete(tree.errorRoutes, p)
+		}
+	}
+}
+
+// RemoveUnusedPipelines removes those of the given pipelines, and of
+// the stages of those that are chains, that no edge or chain in the
+// tree uses anymore. The removed pipelines are returned without being
+// closed, so that they can be added back. This can be done
+// concurrently.
+func (tree *Tree) RemoveUnusedPipelines(candidates []pipeline.Pipeline) []pipeline.Pipeline {
+	tree.Mu.Lock()
+	defer tree.Mu.Unlock()
+
+	removed := []pipeline.Pipeline{}
+	for len(candidates) > 0 {
+		p := candidates[0]
+		candidates = candidates[1:]
+		if p == nil || tree.Pipelines[p.GetID()] != p || tree.used(p) {
+			continue
+		}
+
+		delete(tree.Pipelines, p.GetID())
+		delete(tree.errorRoutes, p)
+		removed = append(removed, p)
+		if chain, ok := p.(stager); ok {
+			candidates = append(candidates, chain.GetStages()...)
+		}
+	}
+	return removed
+}
+
+// used reports whether an edge or another pipeline uses p. The caller
+// must hold the tree's lock.
+func (tree *Tree) used(p pipeline.Pipeline) bool {
+	for _, n := range tree.Nodes {
+		for _, edge := range n.GetChildren() {
+			if uses(edge, p) {
+				return true
+			}
+		}
+	}
+	for _, other := range tree.Pipelines {
+		if other != p && uses(other, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddEdge makes child a child of parent, replacing the pipeline of an
+// existing edge. A nil pipeline passes every command. This can be done
+// concurrently.
+func (tree *Tree) AddEdge(parent node.Node, child node.Node, p pipeline.Pipeline) {
+	tree.Mu.Lock()
+	defer tree.Mu.Unlock()
+
+	if p == nil {
+		parent.AddChild(child)
+	} else {
+		parent.AddPipeline(child, p)
+	}
+	index(tree.parents, parent, child)
+}
+
+// RemoveEdge removes child from the children of parent. This can be
+// done concurrently.
+func (tree *Tree) RemoveEdge(parent node.Node, child node.Node) {
+	tree.Mu.Lock()
+	defer tree.Mu.Unlock()
+
+	parent.RemoveChild(child)
+	unindex(tree.parents, parent, child)
+}
+
+// AddErrorEdge makes child an error child of parent. This can be done
+// concurrently.
+func (tree *Tree) AddErrorEdge(parent node.Node, child node.Node) {
+	tree.Mu.Lock()
+	defer tree.Mu.Unlock()
+
+	parent.AddErrorChild(child)
+	index(tree.errorParents, parent, child)
+}
+
+// RemoveErrorEdge removes child from the error children of parent.
+// This can be done concurrently.
+func (tree *Tree) RemoveErrorEdge(parent node.Node, child node.Node) {
+	tree.Mu.Lock()
+	defer tree.Mu.Unlock()
+
+	parent.RemoveErrorChild(child)
+	unindex(tree.errorParents, parent, child)
+}
+
+// SetErrorRoute makes child the node a pipeline routes rejected
+// commands to, or stops routing them when child is nil. The pipeline
+// must be a pipeline.ErrorRouter. This can be done concurrently.
+func (tree *Tree) SetErrorRoute(p pipeline.Pipeline, child node.Node) error {
+	router, ok := p.(pipeline.ErrorRouter)
+	if !ok {
+		return command.Errorf(command.TYPE_MISMATCH, "pipeline %s does not route errors", p.GetName()).WithPipeline(p.GetID())
+	}
+
+	tree.Mu.Lock()
+	defer tree.Mu.Unlock()
+
+	if child == nil {
+		router.SetErrorChild(nil)
+		delete(tree.errorRoutes, p)
+		return nil
+	}
+	router.SetErrorChild(child)
+	tree.errorRoutes[p] = child
+	return nil
+}
+
+// Reaches reports whether to can be reached from from by following
+// edges, error edges and the error routes of pipelines. A node reaches
+// itself.
+func (tree *Tree) Reaches(from node.Node, to node.Node) bool {
+	tree.Mu.Lock()
+	defer tree.Mu.Unlock()
+
+	visited := map[node.Node]struct{}{}
+	stack := []node.Node{from}
+
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if current == to {
+			return true
+		}
+		if _, ok := visited[current]; ok {
+			continue
+		}
+		visited[current] = struct{}{}
+
+		stack = append(stack, tree.childrenOf(current)...)
+	}
+
+	return false
 }
 
 // GetPipelineByNameOrID returns a pipeline if found. When searching by ID, the
@@ -95,7 +281,7 @@ func (tree *Tree) GetPipelineByNameOrID(nameOrID string) (pipeline.Pipeline, err
 		}
 	}
 
-	err := fmt.Errorf("pipeline with name or ID of %s does not exist", nameOrID)
+	err := command.Errorf(command.NOT_FOUND, "pipeline with name or ID of %s does not exist", nameOrID)
 	return nil, err
 }
 
@@ -103,11 +289,11 @@ func (tree *Tree) GetPipelineByNameOrID(nameOrID string) (pipeline.Pipeline, err
 // concurrently.
 func (tree *Tree) AddPipeline(pipeline pipeline.Pipeline) error {
 	if pipeline.GetID() == "" || pipeline.GetName() == "" {
-		return errors.New("pipeline must have ID and Name")
+		return command.Errorf(command.INVALID_ARGUMENT, "pipeline must have ID and Name")
 	}
 
 	if pipe, _ := tree.GetPipelineByNameOrID(pipeline.GetID()); pipe != nil {
-		return errors.New("pipeline already exists")
+		return command.Errorf(command.ALREADY_EXISTS, "pipeline already exists").WithPipeline(pipe.GetID())
 	}
 
 	tree.Mu.Lock()
@@ -117,12 +303,69 @@ func (tree *Tree) AddPipeline(pipeline pipeline.Pipeline) error {
 	return nil
 }
 
-// RemovePipeline removes a pipeline from the tree. This can
-// be done concurrently.
-func (tree *Tree) RemovePipeline(pipeline pipeline.Pipeline) {
+// RemovePipeline removes a pipeline from the tree and closes it. This
+// can be done concurrently.
+func (tree *Tree) RemovePipeline(p pipeline.Pipeline) {
 	tree.Mu.Lock()
-	delete(tree.Pipelines, pipeline.GetID())
+	delete(tree.Pipelines, p.GetID())
+	delete(tree.errorRoutes, p)
 	tree.Mu.Unlock()
+
+	pipeline.Close(p)
+}
+
+// ReplacePipeline puts p in place of the pipeline with the same ID, on
+// every edge and in every chain that uses it. The error route of the
+// replaced pipeline moves to p when p routes errors, and the replaced
+// pipeline is closed. This can be done concurrently.
+func (tree *Tree) ReplacePipeline(p pipeline.Pipeline) error {
+	tree.Mu.Lock()
+	defer tree.Mu.Unlock()
+
+	old, ok := tree.Pipelines[p.GetID()]
+	if !ok {
+		return command.Errorf(command.NOT_FOUND, "pipeline with name or ID of %s does not exist", p.GetID())
+	}
+	tree.Pipelines[p.GetID()] = p
+
+	for _, parent := range tree.Nodes {
+		for child, edge := range parent.GetChildren() {
+			if edge == old {
+				parent.AddPipeline(child, p)
+			}
+		}
+	}
+
+	for _, other := range tree.Pipelines {
+		chain, ok := other.(stageSetter)
+		if !ok {
+			continue
+		}
+		stages, replaced := chain.GetStages(), false
+		for i, stage := range stages {
+			if stage == old {
+				stages[i], replaced = p, true
+			}
+		}
+		if replaced {
+			if err := chain.SetStages(stages); err != nil {
+				return command.Errorf(command.FAILED_PRECONDITION, "%v", err).WithPipeline(other.GetID())
+			}
+		}
+	}
+
+	if child, ok := tree.errorRoutes[old]; ok {
+		delete(tree.errorRoutes, old)
+		if router, ok := p.(pipeline.ErrorRouter); ok {
+			router.SetErrorChild(child)
+			tree.errorRoutes[p] = child
+		}
+	}
+
+	if old != p {
+		pipeline.Close(old)
+	}
+	return nil
 }
 
 // ToJSON converts the tree to sendable bytes. This
@@ -130,38 +373,55 @@ func (tree *Tree) RemovePipeline(pipeline pipeline.Pipeline) {
 // having its own ToJSON function that converts each
 // child node of a particular node into an ID. This ID
 // can then be used by the tree to lookup a particular node
-// when sent to the client as JSON.
+// when sent to the client as JSON. It is what Save writes, so
+// pipelines keep their secrets; clients get ViewJSON instead.
 func (tree *Tree) ToJSON() ([]byte, error) {
 	nodes := map[string]interface{}{}
 	for key, n := range tree.Nodes {
-		children := map[string]string{}
-		for key, child := range n.GetChildren() {
-			children[key.GetID()] = child.GetID()
-		}
+		nodes[key] = tree.describeNode(n, n.ToJSONStruct())
+	}
+	return tree.toJSON(nodes, tree.Pipelines)
+}
 
-		s := &struct {
-			ID       string                 `json:"id"`
-			Name     string                 `json:"name"`
-			Type     string                 `json:"type"`
-			Active   bool                   `json:"active"`
-			Children map[string]string      `json:"children"`
-			Props    map[string]interface{} `json:"props"`
-		}{
-			n.GetID(),
-			n.GetName(),
-			n.GetType(),
-			n.GetActive(),
-			children,
-			n.ToJSONStruct(),
-		}
+// ViewJSON is ToJSON for clients: pipelines leave out secrets such as
+// redact salts and nodes leave out bulky props such as dead letters,
+// so its output cannot be used to restore the tree.
+func (tree *Tree) ViewJSON() ([]byte, error) {
+	nodes := map[string]interface{}{}
+	for key, n := range tree.Nodes {
+		nodes[key] = tree.DescribeNode(n)
+	}
 
-		nodes[key] = s
+	pipelines := map[string]json.RawMessage{}
+	for key, p := range tree.Pipelines {
+		JSON, err := pipeline.ViewJSON(p)
+		if err != nil {
+			return nil, err
+		}
+		pipelines[key] = JSON
 	}
+	return tree.toJSON(nodes, pipelines)
+}
 
+func (tree *Tree) toJSON(nodes interface{}, pipelines interface{}) ([]byte, error) {
 	result := map[string]interface{}{
 		"nodes":     nodes,
-		"pipelines": tree.Pipelines,
+		"pipelines": pipelines,
 	}
 
 	return json.Marshal(result)
 }
+
+func index(parents map[node.Node]map[node.Node]struct{}, parent node.Node, child node.Node) {
+	if parents[child] == nil {
+		parents[child] = map[node.Node]struct{}{}
+	}
+	parents[child][parent] = struct{}{}
+}
+
+func unindex(parents map[node.Node]map[node.Node]struct{}, parent node.Node, child node.Node) {
+	delete(parents[child], parent)
+	if len(parents[child]) == 0 {
+		delete(parents, child)
+	}
+}